@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	AggregationMean        = "mean"
+	AggregationMedian      = "median"
+	AggregationP90         = "p90"
+	AggregationMax         = "max"
+	AggregationTrimmedMean = "trimmed_mean"
+)
+
+func validateAggregation(aggregation string) error {
+	switch aggregation {
+	case "", AggregationMean, AggregationMedian, AggregationP90, AggregationMax, AggregationTrimmedMean:
+		return nil
+	}
+	return errors.Errorf("unknown aggregation %q", aggregation)
+}
+
+// aggregate returns the app with CpuAvg and MemAvg replaced by the loads of
+// its instances (excluding the outliers) aggregated as required by the rule.
+// If the app carries no per-instance stats, it is returned as is.
+func aggregate(rule Rule, app App) App {
+	if len(app.Stats) == 0 {
+		return app
+	}
+
+	if rule.CpuAggregation != "" && rule.CpuAggregation != AggregationMean {
+		app.CpuAvg = int(aggregateValues(app.loads(MetricCpu), rule.CpuAggregation) + 0.5)
+	}
+	if rule.MemAggregation != "" && rule.MemAggregation != AggregationMean {
+		app.MemAvg = int(aggregateValues(app.loads(MetricMem), rule.MemAggregation) + 0.5)
+	}
+	return app
+}
+
+// aggregateValues returns the aggregation of a non-empty list of values.
+func aggregateValues(values []float64, aggregation string) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+
+	switch aggregation {
+	case AggregationMedian:
+		return percentile(sorted, 50)
+	case AggregationP90:
+		return percentile(sorted, 90)
+	case AggregationMax:
+		return sorted[n-1]
+	case AggregationTrimmedMean:
+		// discard the lowest and highest 10% of the values, and at least one
+		// value on each side if there are at least 3 values
+		trim := n / 10
+		if trim == 0 && n >= 3 {
+			trim = 1
+		}
+		sorted = sorted[trim : n-trim]
+	}
+	return mean(sorted)
+}
+
+func mean(values []float64) float64 {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+// percentile returns the p-th percentile of the sorted values, linearly
+// interpolating between the closest ranks.
+func percentile(sorted []float64, p float64) float64 {
+	rank := p / 100 * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	if lo >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[lo] + (rank-float64(lo))*(sorted[lo+1]-sorted[lo])
+}
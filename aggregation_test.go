@@ -0,0 +1,52 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAggregateValues(t *testing.T) {
+	tests := []struct {
+		values      []float64
+		aggregation string
+		exp         float64
+	}{
+		{[]float64{10}, AggregationMean, 10},
+		{[]float64{10}, AggregationMedian, 10},
+		{[]float64{10}, AggregationP90, 10},
+		{[]float64{10}, AggregationMax, 10},
+		{[]float64{10}, AggregationTrimmedMean, 10},
+		{[]float64{90, 10, 20}, AggregationMean, 40},
+		{[]float64{90, 10, 20}, AggregationMedian, 20},
+		{[]float64{90, 10, 20}, AggregationP90, 76},
+		{[]float64{90, 10, 20}, AggregationMax, 90},
+		{[]float64{90, 10, 20}, AggregationTrimmedMean, 20},
+		{[]float64{40, 10, 20, 30}, AggregationMedian, 25},
+		{[]float64{40, 10, 20, 30}, AggregationTrimmedMean, 25},
+		{[]float64{100, 0, 50, 50, 50, 50, 50, 50, 50, 50, 50}, AggregationTrimmedMean, 50},
+		{[]float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}, AggregationP90, 10},
+	}
+
+	for i, test := range tests {
+		if v := aggregateValues(test.values, test.aggregation); math.Abs(v-test.exp) > 1e-9 {
+			t.Fatalf("%d: %s of %v: %f, expected %f", i, test.aggregation, test.values, v, test.exp)
+		}
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	app := App{CpuAvg: 40, MemAvg: 50, Stats: []InstanceStats{{"0", 90, 50, 0}, {"1", 10, 40, 0}, {"2", 20, 60, 0}}}
+
+	if a := aggregate(Rule{}, app); a.CpuAvg != 40 || a.MemAvg != 50 {
+		t.Fatalf("default aggregation: %+v", a)
+	}
+	if a := aggregate(Rule{CpuAggregation: AggregationMean, MemAggregation: AggregationMean}, app); a.CpuAvg != 40 || a.MemAvg != 50 {
+		t.Fatalf("mean aggregation: %+v", a)
+	}
+	if a := aggregate(Rule{CpuAggregation: AggregationMedian, MemAggregation: AggregationMax}, app); a.CpuAvg != 20 || a.MemAvg != 60 {
+		t.Fatalf("median/max aggregation: %+v", a)
+	}
+	if a := aggregate(Rule{CpuAggregation: AggregationMedian}, App{CpuAvg: 40}); a.CpuAvg != 40 {
+		t.Fatalf("aggregation without stats: %+v", a)
+	}
+}
@@ -2,8 +2,12 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
+	"sort"
+	"time"
 
 	cfclient "github.com/cloudfoundry-community/go-cfclient"
 	"github.com/pkg/errors"
@@ -12,6 +16,35 @@ import (
 type Client interface {
 	GetApps() (Apps, error)
 	Scale(app App, desired int) error
+	// RestartInstance kills an instance of the app, that is then restarted
+	// by Cloud Foundry
+	RestartInstance(app App, index string) error
+	// Start starts the app, and removes the IdleMarkerEnv marker if the app
+	// was stopped because it was idle
+	Start(app App) error
+	// Stop stops the app because it is idle since t, and marks it with
+	// IdleMarkerEnv so that it can be woken up after a restart
+	Stop(app App, t time.Time) error
+	// CloneApp creates a stopped copy of the app named name, with the same
+	// settings and service bindings (but no routes) and memory MB of memory
+	// per instance, marked as a clone of the app by CloneMarkerEnv. The bits
+	// of the app are copied asynchronously by the returned job, if any.
+	CloneApp(app App, name string, memory int) (clone App, job string, err error)
+	// JobDone returns true if the asynchronous job is finished; if the job
+	// failed, err is set as well
+	JobDone(job string) (done bool, err error)
+	// SwapApp maps the routes of the app to the clone, deletes the app and
+	// renames the clone to the name of the app. If it fails, the app may have
+	// been deleted already.
+	SwapApp(app, clone App) error
+	// RenameApp renames the clone of an app to name and removes its marker,
+	// so that it is not a clone anymore
+	RenameApp(app App, name string) error
+	// DeleteApp deletes the app with its service bindings and route mappings
+	DeleteApp(app App) error
+	// AppRoutes returns the HTTP routes mapped to the app, as
+	// host.domain/path
+	AppRoutes(app App) ([]string, error)
 }
 
 type App struct {
@@ -21,14 +54,51 @@ type App struct {
 	Org              string
 	Instances        int
 	InstancesRunning int
+	Warming          int
+	Stopped          bool
+	MemoryMB         int
 	CpuAvg           int
 	MemAvg           int
+	DiskAvg          int
+	// value of the custom metric of the rule of the app, if any
+	Custom float64
+	// requests per second per running instance, if the rule uses them
+	Rps float64
+	// 95th percentile of the response times and percentage of 5xx responses,
+	// if the rule uses them
+	Latency   time.Duration
+	ErrorRate float64
+	// percentile of the response times of the probes and percentage of
+	// failed probes, if the rule uses them
+	ProbeLatency  time.Duration
+	ProbeFailures float64
+	// guid of the app of which the app is a clone, if any (see CloneApp)
+	CloneOf string
+	// time the app was stopped because it was idle, if it was (see Stop)
+	StoppedIdle time.Time
+	Stats       []InstanceStats
+	Outliers    []Outlier
+}
+
+// InstanceStats holds the loads (in percent) of a running instance
+type InstanceStats struct {
+	Index string
+	Cpu   float64
+	Mem   float64
+	Disk  float64
 }
 
 type Apps map[string]App
 
 type ApiClient struct {
 	Client *cfclient.Client
+	// Rules are used to exclude the instances warming up from the loads
+	Rules []Rule
+	// if set, the loads are averaged over time from log-cache instead of
+	// being the current ones
+	LogCache *logCache
+	// Logger, if set, logs the errors reading from log-cache
+	Logger *log.Logger
 }
 
 func (c *ApiClient) GetApps() (Apps, error) {
@@ -58,36 +128,68 @@ func (c *ApiClient) GetApps() (Apps, error) {
 			if err != nil {
 				return nil, errors.Wrapf(err, "get app %s stats", app.Guid)
 			}
+			if c.LogCache != nil {
+				// without averages, the current loads are used rather
+				// than failing the reads of all the apps
+				usage, err := c.LogCache.containerMetrics(app.Guid)
+				if err != nil && c.Logger != nil {
+					c.Logger.Print(errors.Wrapf(err, "get app %s container metrics, using the current loads", app.Guid))
+				}
+				instances = withUsage(instances, usage)
+			}
 		}
 
-		r[app.Guid] = processApp(app.Guid, app.Name, space.Name, org.Name, started, app.Instances, instances)
+		rule, _ := ruleFor(c.Rules, app.Name, space.Name, org.Name)
+		a := processApp(app.Guid, app.Name, space.Name, org.Name, started, app.Instances, time.Duration(rule.Warmup), instances)
+		a.MemoryMB = app.Memory
+		a.CloneOf, _ = app.Environment[CloneMarkerEnv].(string)
+		if stopped, ok := app.Environment[IdleMarkerEnv].(string); ok && !started {
+			a.StoppedIdle, _ = time.Parse(time.RFC3339, stopped)
+		}
+		r[app.Guid] = a
 	}
 
 	return r, nil
 }
 
-func processApp(guid, app, space, org string, started bool, desired int, instances map[string]cfclient.AppStats) App {
-	a := App{Guid: guid, App: app, Space: space, Org: org}
+// processApp computes the loads of the running instances of the app; the
+// instances started less than warmup ago are counted as running but excluded
+// from the loads.
+func processApp(guid, app, space, org string, started bool, desired int, warmup time.Duration, instances map[string]cfclient.AppStats) App {
+	a := App{Guid: guid, App: app, Space: space, Org: org, Stopped: !started}
 
 	if started {
-		var cpu, mem float64
-
-		for _, instance := range instances {
-			if instance.State != "RUNNING" || instance.Stats.Usage.CPU < 0 || instance.Stats.Usage.CPU > 1 || instance.Stats.Usage.Mem < 0 || instance.Stats.Usage.Mem > instance.Stats.MemQuota {
+		for index, instance := range instances {
+			if instance.State != "RUNNING" || instance.Stats.Usage.CPU < 0 || instance.Stats.Usage.CPU > 1 || instance.Stats.Usage.Mem < 0 || instance.Stats.Usage.Mem > instance.Stats.MemQuota || instance.Stats.Usage.Disk < 0 || instance.Stats.Usage.Disk > instance.Stats.DiskQuota {
 				// if anything seems suspicious, we skip this instance; autoscaleApp
 				// will refuse to scale the app if instances are missing
 				continue
 			}
 			a.InstancesRunning += 1
-			cpu += instance.Stats.Usage.CPU
-			mem += float64(instance.Stats.Usage.Mem) / float64(instance.Stats.MemQuota)
+			if time.Duration(instance.Stats.Uptime)*time.Second < warmup {
+				a.Warming += 1
+				continue
+			}
+			a.Stats = append(a.Stats, InstanceStats{
+				Index: index,
+				Cpu:   instance.Stats.Usage.CPU * 100.0,
+				Mem:   float64(instance.Stats.Usage.Mem) / float64(instance.Stats.MemQuota) * 100.0,
+				Disk:  float64(instance.Stats.Usage.Disk) / float64(instance.Stats.DiskQuota) * 100.0,
+			})
 		}
+		sort.Slice(a.Stats, func(i, j int) bool {
+			return indexLess(a.Stats[i].Index, a.Stats[j].Index)
+		})
 
-		if a.InstancesRunning > 0 {
+		// outliers (e.g. hung or spinning instances) are excluded from the averages
+		a.Outliers = findOutliers(a.Stats)
+
+		if len(a.Stats) > 0 {
 			// FIXME: golang fail: there's no round function so do it manually by adding +0.5
 			// this should be fine because we only treat non-negative, normal numbers
-			a.CpuAvg = int(cpu/float64(a.InstancesRunning)*100.0 + 0.5)
-			a.MemAvg = int(mem/float64(a.InstancesRunning)*100.0 + 0.5)
+			a.CpuAvg = int(mean(a.loads(MetricCpu)) + 0.5)
+			a.MemAvg = int(mean(a.loads(MetricMem)) + 0.5)
+			a.DiskAvg = int(mean(a.loads(MetricDisk)) + 0.5)
 		}
 		a.Instances = desired
 	}
@@ -95,23 +197,274 @@ func processApp(guid, app, space, org string, started bool, desired int, instanc
 	return a
 }
 
+// indexLess compares instance indexes numerically
+func indexLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
 func (c *ApiClient) Scale(app App, desired int) error {
+	return c.update(app, fmt.Sprintf(`{"instances":%d}`, desired), "scaling")
+}
+
+func (c *ApiClient) Start(app App) error {
+	if app.StoppedIdle.IsZero() {
+		return c.update(app, `{"state":"STARTED"}`, "start")
+	}
+	return c.updateEnv(app, map[string]interface{}{"state": "STARTED"}, IdleMarkerEnv, "", "start")
+}
+
+func (c *ApiClient) Stop(app App, t time.Time) error {
+	return c.updateEnv(app, map[string]interface{}{"state": "STOPPED"}, IdleMarkerEnv, t.UTC().Format(time.RFC3339), "stop")
+}
+
+// update sends the body in a request that updates the app; what describes the
+// request in the errors.
+func (c *ApiClient) update(app App, body, what string) error {
 	requestURL := fmt.Sprintf("/v2/apps/%s?async=true", app.Guid)
-	body := bytes.NewBufferString(fmt.Sprintf(`{"instances":%d}`, desired))
-	req := c.Client.NewRequestWithBody("PUT", requestURL, body)
+	req := c.Client.NewRequestWithBody("PUT", requestURL, bytes.NewBufferString(body))
 	resp, err := c.Client.DoRequest(req)
 	if err != nil {
-		return errors.Wrap(err, "sending scaling request")
+		return errors.Wrapf(err, "sending %s request", what)
 	}
 	defer resp.Body.Close()
 
 	msg, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return errors.Wrap(err, "reading scaling response")
+		return errors.Wrapf(err, "reading %s response", what)
 	}
 	if resp.StatusCode != 201 {
-		return errors.Errorf("scaling request rejected: %d %s", resp.StatusCode, string(msg))
+		return errors.Errorf("%s request rejected: %d %s", what, resp.StatusCode, string(msg))
 	}
 
 	return nil
 }
+
+// request sends a request with the body (if not nil) serialized as JSON and
+// unmarshals the response in out (if not nil); what describes the request in
+// the errors.
+func (c *ApiClient) request(method, path string, body, out interface{}, what string) error {
+	req := c.Client.NewRequest(method, path)
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return errors.Wrapf(err, "encoding %s request", what)
+		}
+		req = c.Client.NewRequestWithBody(method, path, bytes.NewReader(b))
+	}
+	resp, err := c.Client.DoRequest(req)
+	if err != nil {
+		return errors.Wrapf(err, "sending %s request", what)
+	}
+	defer resp.Body.Close()
+
+	msg, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "reading %s response", what)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("%s request rejected: %d %s", what, resp.StatusCode, string(msg))
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(msg, out); err != nil {
+			return errors.Wrapf(err, "decoding %s response", what)
+		}
+	}
+	return nil
+}
+
+// resource is the part of the responses of the v2 API shared by all resources
+type resource struct {
+	Metadata struct {
+		Guid string `json:"guid"`
+	} `json:"metadata"`
+	Entity struct {
+		Status              string `json:"status"`
+		ServiceInstanceGuid string `json:"service_instance_guid"`
+	} `json:"entity"`
+}
+
+// cloneFields are the fields of the apps that are copied to their clones
+var cloneFields = []string{
+	"space_guid", "stack_guid", "instances", "disk_quota", "command", "buildpack", "environment_json",
+	"health_check_type", "health_check_timeout", "health_check_http_endpoint", "enable_ssh", "diego", "ports",
+	"docker_image", "docker_credentials",
+}
+
+func (c *ApiClient) CloneApp(app App, name string, memory int) (App, string, error) {
+	var src struct {
+		Entity map[string]interface{} `json:"entity"`
+	}
+	if err := c.request("GET", "/v2/apps/"+app.Guid, nil, &src, "get app"); err != nil {
+		return App{}, "", err
+	}
+
+	body := map[string]interface{}{"name": name, "memory": memory, "state": "STOPPED"}
+	for _, field := range cloneFields {
+		if v := src.Entity[field]; v != nil {
+			body[field] = v
+		}
+	}
+	env := map[string]interface{}{}
+	if e, ok := body["environment_json"].(map[string]interface{}); ok {
+		for k, v := range e {
+			env[k] = v
+		}
+	}
+	env[CloneMarkerEnv] = app.Guid
+	body["environment_json"] = env
+	if creds, ok := body["docker_credentials"].(map[string]interface{}); ok {
+		if password, _ := creds["password"].(string); password == "" || password == "***" {
+			return App{}, "", errors.New("the docker credentials of the app are not readable")
+		}
+	}
+	var created resource
+	if err := c.request("POST", "/v2/apps", body, &created, "create clone"); err != nil {
+		return App{}, "", err
+	}
+	clone := App{Guid: created.Metadata.Guid, App: name, Space: app.Space, Org: app.Org, Instances: app.Instances, Stopped: true, MemoryMB: memory, CloneOf: app.Guid}
+
+	var bindings struct {
+		Resources []resource `json:"resources"`
+	}
+	if err := c.request("GET", fmt.Sprintf("/v2/apps/%s/service_bindings?results-per-page=100", app.Guid), nil, &bindings, "list service bindings"); err != nil {
+		return clone, "", err
+	}
+	for _, b := range bindings.Resources {
+		body := map[string]string{"service_instance_guid": b.Entity.ServiceInstanceGuid, "app_guid": clone.Guid}
+		if err := c.request("POST", "/v2/service_bindings", body, nil, "bind service"); err != nil {
+			return clone, "", err
+		}
+	}
+
+	if src.Entity["docker_image"] != nil {
+		return clone, "", nil
+	}
+	var job resource
+	if err := c.request("POST", fmt.Sprintf("/v2/apps/%s/copy_bits", clone.Guid), map[string]string{"source_app_guid": app.Guid}, &job, "copy bits"); err != nil {
+		return clone, "", err
+	}
+	return clone, job.Metadata.Guid, nil
+}
+
+func (c *ApiClient) JobDone(guid string) (bool, error) {
+	var job resource
+	if err := c.request("GET", "/v2/jobs/"+guid, nil, &job, "get job"); err != nil {
+		return false, err
+	}
+	switch job.Entity.Status {
+	case "finished":
+		return true, nil
+	case "failed":
+		return true, errors.Errorf("job %s failed", guid)
+	}
+	return false, nil
+}
+
+func (c *ApiClient) SwapApp(app, clone App) error {
+	routes, err := c.Client.GetAppRoutes(app.Guid)
+	if err != nil {
+		return errors.Wrap(err, "get app routes")
+	}
+	for _, route := range routes {
+		if err := c.request("PUT", fmt.Sprintf("/v2/routes/%s/apps/%s", route.Guid, clone.Guid), nil, nil, "map route"); err != nil {
+			return err
+		}
+	}
+	if err := c.DeleteApp(app); err != nil {
+		return err
+	}
+	return c.RenameApp(clone, app.App)
+}
+
+func (c *ApiClient) RenameApp(app App, name string) error {
+	return c.updateEnv(app, map[string]interface{}{"name": name}, CloneMarkerEnv, "", "rename")
+}
+
+// updateEnv updates the app with the fields, and sets the environment
+// variable name to value (or removes it if value is empty); what describes
+// the request in the errors.
+func (c *ApiClient) updateEnv(app App, fields map[string]interface{}, name, value, what string) error {
+	var src struct {
+		Entity struct {
+			Environment map[string]interface{} `json:"environment_json"`
+		} `json:"entity"`
+	}
+	if err := c.request("GET", "/v2/apps/"+app.Guid, nil, &src, "get app"); err != nil {
+		return err
+	}
+	env := src.Entity.Environment
+	if env == nil {
+		env = map[string]interface{}{}
+	}
+	if value == "" {
+		delete(env, name)
+	} else {
+		env[name] = value
+	}
+	fields["environment_json"] = env
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return errors.Wrapf(err, "encoding %s request", what)
+	}
+	return c.update(app, string(body), what)
+}
+
+func (c *ApiClient) AppRoutes(app App) ([]string, error) {
+	routes, err := c.Client.GetAppRoutes(app.Guid)
+	if err != nil {
+		return nil, errors.Wrap(err, "get app routes")
+	}
+	r := []string{}
+	domains := map[string]string{}
+	for _, route := range routes {
+		// TCP routes can not be probed over HTTP
+		if route.Port != 0 {
+			continue
+		}
+		domain, found := domains[route.DomainGuid]
+		if !found {
+			var d struct {
+				Entity struct {
+					Name     string `json:"name"`
+					Internal bool   `json:"internal"`
+				} `json:"entity"`
+			}
+			if err := c.request("GET", "/v2/domains/"+route.DomainGuid, nil, &d, "get domain"); err != nil {
+				return nil, err
+			}
+			// routes of internal domains (e.g. apps.internal) are only
+			// reachable from other apps
+			if !d.Entity.Internal {
+				domain = d.Entity.Name
+			}
+			domains[route.DomainGuid] = domain
+		}
+		if domain == "" {
+			continue
+		}
+		if route.Host != "" {
+			domain = route.Host + "." + domain
+		}
+		r = append(r, domain+route.Path)
+	}
+	return r, nil
+}
+
+func (c *ApiClient) DeleteApp(app App) error {
+	return c.request("DELETE", fmt.Sprintf("/v2/apps/%s?recursive=true", app.Guid), nil, nil, "delete")
+}
+
+func (c *ApiClient) RestartInstance(app App, index string) error {
+	// note that KillAppInstance does not report unexpected status codes: if
+	// the instance is not restarted, it will be restarted again once it has
+	// been an outlier for long enough
+	err := c.Client.KillAppInstance(app.Guid, index)
+	if err != nil {
+		return errors.Wrap(err, "kill app instance")
+	}
+	return nil
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"testing"
+	"time"
 
 	cfclient "github.com/cloudfoundry-community/go-cfclient"
 )
@@ -15,6 +17,41 @@ type MockClient struct {
 	ScaleApp     *App
 	ScaleDesired *int
 	ScaleError   error
+	// all the calls to Scale, as guid:desired; if ScaleErrorGuid is set only
+	// the calls for that app fail
+	ScaleCalls     []string
+	ScaleErrorGuid string
+
+	RestartApp   *App
+	RestartIndex *string
+	RestartError error
+
+	StartApp   *App
+	StartError error
+	StopApp    *App
+	StopTime   time.Time
+	StopError  error
+
+	ClonedApp   *App
+	CloneName   string
+	CloneMemory int
+	CloneError  error
+	// job copying the bits returned by CloneApp, and its status
+	CloneJob     string
+	JobsDone     map[string]bool
+	JobError     error
+	SwappedApp   *App
+	SwappedClone *App
+	SwapError    error
+	RenamedApp   *App
+	RenameName   string
+	RenameError  error
+	DeletedApp   *App
+	DeleteError  error
+
+	// routes per app guid
+	Routes      map[string][]string
+	RoutesError error
 }
 
 func (c *MockClient) GetApps() (Apps, error) {
@@ -24,29 +61,114 @@ func (c *MockClient) GetApps() (Apps, error) {
 func (c *MockClient) Scale(app App, desired int) error {
 	c.ScaleApp = &app
 	c.ScaleDesired = &desired
+	c.ScaleCalls = append(c.ScaleCalls, fmt.Sprintf("%s:%d", app.Guid, desired))
+	if c.ScaleErrorGuid != "" && c.ScaleErrorGuid != app.Guid {
+		return nil
+	}
 	return c.ScaleError
 }
 
+func (c *MockClient) RestartInstance(app App, index string) error {
+	c.RestartApp = &app
+	c.RestartIndex = &index
+	return c.RestartError
+}
+
+func (c *MockClient) Start(app App) error {
+	c.StartApp = &app
+	return c.StartError
+}
+
+func (c *MockClient) Stop(app App, t time.Time) error {
+	c.StopApp, c.StopTime = &app, t
+	return c.StopError
+}
+
+func (c *MockClient) CloneApp(app App, name string, memory int) (App, string, error) {
+	c.ClonedApp, c.CloneName, c.CloneMemory = &app, name, memory
+	if c.CloneError != nil {
+		return App{}, "", c.CloneError
+	}
+	return App{Guid: "clone-" + app.Guid, App: name, Space: app.Space, Org: app.Org, Instances: app.Instances, Stopped: true, MemoryMB: memory, CloneOf: app.Guid}, c.CloneJob, nil
+}
+
+func (c *MockClient) JobDone(job string) (bool, error) {
+	return c.JobsDone[job], c.JobError
+}
+
+func (c *MockClient) SwapApp(app, clone App) error {
+	c.SwappedApp, c.SwappedClone = &app, &clone
+	return c.SwapError
+}
+
+func (c *MockClient) RenameApp(app App, name string) error {
+	c.RenamedApp, c.RenameName = &app, name
+	return c.RenameError
+}
+
+func (c *MockClient) DeleteApp(app App) error {
+	c.DeletedApp = &app
+	return c.DeleteError
+}
+
+func (c *MockClient) AppRoutes(app App) ([]string, error) {
+	return c.Routes[app.Guid], c.RoutesError
+}
+
 func IS(cpuPct, memPct float64) (a cfclient.AppStats) {
-	memQuota := 1024 * 1024 * 1024
-	s := fmt.Sprintf(`{"state":"RUNNING","stats":{"usage":{"cpu":%f,"mem":%d},"mem_quota":%d}}`, cpuPct, int(memPct*float64(memQuota)), memQuota)
+	return ISD(cpuPct, memPct, 0)
+}
+
+func ISD(cpuPct, memPct, diskPct float64) (a cfclient.AppStats) {
+	memQuota, diskQuota := 1024*1024*1024, 2*1024*1024*1024
+	s := fmt.Sprintf(`{"state":"RUNNING","stats":{"usage":{"cpu":%f,"mem":%d,"disk":%d},"mem_quota":%d,"disk_quota":%d}}`, cpuPct, int(memPct*float64(memQuota)), int(diskPct*float64(diskQuota)), memQuota, diskQuota)
 	json.Unmarshal([]byte(s), &a)
 	return a
 }
 
 func TestProcessApps(t *testing.T) {
-	a := processApp(guid, "a", "s", "o", true, 1, map[string]cfclient.AppStats{"0": IS(0.5, 0.75)})
+	a := processApp(guid, "a", "s", "o", true, 1, 0, map[string]cfclient.AppStats{"0": IS(0.5, 0.75)})
 	if a.CpuAvg != 50 || a.MemAvg != 75 || a.Instances != 1 || a.InstancesRunning != 1 {
 		t.Fatalf("processApp fail: %+v", a)
 	}
 
-	a = processApp(guid, "a", "s", "o", true, 2, map[string]cfclient.AppStats{"0": IS(0.5, 0.8), "1": IS(0.3, 0.6)})
+	a = processApp(guid, "a", "s", "o", true, 2, 0, map[string]cfclient.AppStats{"0": IS(0.5, 0.8), "1": IS(0.3, 0.6)})
 	if a.CpuAvg != 40 || a.MemAvg != 70 || a.Instances != 2 || a.InstancesRunning != 2 {
 		t.Fatalf("processApp fail: %+v", a)
 	}
 
-	a = processApp(guid, "a", "s", "o", true, 2, map[string]cfclient.AppStats{"0": IS(0.5, 0.8), "1": {}})
+	a = processApp(guid, "a", "s", "o", true, 2, 0, map[string]cfclient.AppStats{"0": IS(0.5, 0.8), "1": {}})
 	if a.CpuAvg != 50 || a.MemAvg != 80 || a.Instances != 2 || a.InstancesRunning != 1 {
 		t.Fatalf("processApp fail: %+v", a)
 	}
+
+	a = processApp(guid, "a", "s", "o", true, 12, 0, map[string]cfclient.AppStats{"10": IS(0.5, 0.8), "2": IS(0.3, 0.6), "1": {}})
+	if len(a.Stats) != 2 || a.Stats[0].Index != "2" || a.Stats[1].Index != "10" || a.Stats[0].Cpu != 30 || math.Abs(a.Stats[0].Mem-60) > 1e-6 {
+		t.Fatalf("processApp fail: %+v", a)
+	}
+
+	warm, fresh := IS(0.3, 0.6), IS(0.9, 0.9)
+	warm.Stats.Uptime, fresh.Stats.Uptime = 3600, 30
+	a = processApp(guid, "a", "s", "o", true, 2, time.Minute, map[string]cfclient.AppStats{"0": warm, "1": fresh})
+	if a.CpuAvg != 30 || a.MemAvg != 60 || a.InstancesRunning != 2 || a.Warming != 1 || len(a.Stats) != 1 || a.Stats[0].Index != "0" {
+		t.Fatalf("processApp fail: %+v", a)
+	}
+
+	a = processApp(guid, "a", "s", "o", true, 1, time.Minute, map[string]cfclient.AppStats{"0": fresh})
+	if a.CpuAvg != 0 || a.InstancesRunning != 1 || a.Warming != 1 || len(a.Stats) != 0 {
+		t.Fatalf("processApp fail: %+v", a)
+	}
+	if _, err := decide(Rule{MinInstances: 1, MaxInstances: 3, MinCpu: 20, MaxCpu: 80}, a); err == nil {
+		t.Fatalf("decide succeeded with all instances warming up")
+	}
+
+	a = processApp(guid, "a", "s", "o", true, 2, 0, map[string]cfclient.AppStats{"0": ISD(0.5, 0.8, 0.4), "1": ISD(0.3, 0.6, 0.6)})
+	if a.CpuAvg != 40 || a.MemAvg != 70 || a.DiskAvg != 50 || a.InstancesRunning != 2 {
+		t.Fatalf("processApp fail: %+v", a)
+	}
+
+	a = processApp(guid, "a", "s", "o", true, 2, 0, map[string]cfclient.AppStats{"0": ISD(0.5, 0.8, 0.4), "1": ISD(0.3, 0.6, 1.5)})
+	if a.DiskAvg != 40 || a.InstancesRunning != 1 {
+		t.Fatalf("processApp fail: %+v", a)
+	}
 }
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"crypto/tls"
 	"log"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/cloudfoundry-community/go-cfclient"
@@ -14,12 +17,40 @@ const (
 	MinInstancesLimit = 3
 	// autoscaler interval
 	Interval = 30 * time.Second
+	// how long samples are kept in the per-app history
+	HistoryLength = time.Hour
 )
 
 type autoscaler struct {
 	rules  []Rule
 	log    *log.Logger
 	client Client
+	// clock returns the current time; if nil, time.Now is used
+	clock       func() time.Time
+	history     map[string][]sample
+	cooldowns   map[string]cooldown
+	predictors  map[string]*predictor
+	controllers map[string]*controllers
+	reapers     map[string]*reaper
+	idlers      map[string]*idler
+	resizes     map[string]*resize
+	// traffic counts the requests to the apps, if any rule uses them
+	traffic *firehose
+	// drain receives the response times of the apps, if any rule uses them
+	drain *drain
+	// probes sends synthetic requests to the apps, if any rule uses them
+	probes *prober
+	// logCache reads custom metrics from log-cache, if configured
+	logCache *logCache
+	// metrics reads the metrics from the other sources; if nil, a client
+	// with the default timeout is used
+	metrics *http.Client
+	// external holds the metrics read from sources other than the CF API at
+	// the beginning of the iteration
+	external map[string]*externalMetrics
+	// mu protects wakeUps, that are requested via HTTP
+	mu      sync.Mutex
+	wakeUps map[string]bool
 }
 
 type Config struct {
@@ -29,6 +60,24 @@ type Config struct {
 	SkipSslValidation bool
 	Rules             []Rule
 	Logger            *log.Logger
+	// if set, wake-ups of idle apps can be requested with this token
+	WakeUpToken string
+	// subscription id used to consume the firehose
+	FirehoseSubscription string
+	// the syslog drain requires the token from HTTPS drains and, if the TLS
+	// port is set, a client certificate signed by the CA from TLS drains
+	SyslogTLSPort     string
+	SyslogTLSCert     string
+	SyslogTLSKey      string
+	SyslogTLSClientCA string
+	SyslogToken       string
+	// maximum number of probes per second
+	ProbeRate float64
+	// MetricsBackendStats or MetricsBackendLogCache; the log-cache API is at
+	// LogCacheURL, if set, or else next to the CF API
+	MetricsBackend string
+	LogCacheURL    string
+	LogCacheWindow time.Duration
 }
 
 func run(cfg Config) {
@@ -50,7 +99,53 @@ func run(cfg Config) {
 		cfg.Logger.Fatal(errors.Wrap(err, "validate autoscaler rules"))
 	}
 
-	as := &autoscaler{client: &ApiClient{client}, rules: cfg.Rules, log: cfg.Logger}
+	apiClient := &ApiClient{Client: client, Rules: cfg.Rules, Logger: cfg.Logger}
+	as := &autoscaler{client: apiClient, rules: cfg.Rules, log: cfg.Logger, metrics: newMetricsClient(cfg.SkipSslValidation)}
+
+	if cfg.MetricsBackend == MetricsBackendLogCache || usesLogCache(cfg.Rules) {
+		u := cfg.LogCacheURL
+		if u == "" {
+			u = strings.Replace(strings.TrimSuffix(cfg.ApiUrl, "/"), "://api.", "://log-cache.", 1)
+		}
+		cfg.Logger.Printf("reading metrics from log-cache %s", u)
+		as.logCache = &logCache{
+			url:    u,
+			token:  client.GetToken,
+			client: as.metrics,
+			window: cfg.LogCacheWindow,
+		}
+		if cfg.MetricsBackend == MetricsBackendLogCache {
+			apiClient.LogCache = as.logCache
+		}
+	}
+
+	for _, rule := range cfg.Rules {
+		if (rule.ScaleOutRps > 0 || rule.Idle != nil && rule.Idle.Rps > 0) && as.traffic == nil {
+			as.traffic = &firehose{}
+			go as.traffic.consume(client.Endpoint.DopplerEndpoint+"/firehose/"+cfg.FirehoseSubscription, client.GetToken, &tls.Config{InsecureSkipVerify: cfg.SkipSslValidation}, cfg.Logger)
+		}
+	}
+
+	for _, rule := range cfg.Rules {
+		if (rule.ScaleOutLatency > 0 || rule.MaxErrorRate > 0) && as.drain == nil {
+			as.drain = &drain{}
+			if err := as.drain.listen(cfg); err != nil {
+				cfg.Logger.Fatal(errors.Wrap(err, "start syslog drain"))
+			}
+		}
+	}
+
+	for _, rule := range cfg.Rules {
+		if rule.Probe != nil && as.probes == nil {
+			transport := &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: &tls.Config{InsecureSkipVerify: cfg.SkipSslValidation}}
+			as.probes = newProber(as.client, cfg.ProbeRate, transport)
+			go as.probes.run(cfg.Logger)
+		}
+	}
+
+	if cfg.WakeUpToken != "" {
+		http.Handle("/wake-up", as.wakeUpHandler(cfg.WakeUpToken))
+	}
 
 	cfg.Logger.Print("starting autoscaler loop")
 	for range time.Tick(Interval) {
@@ -59,62 +154,268 @@ func run(cfg Config) {
 	}
 }
 
+// usesLogCache returns true if any rule reads a custom metric from log-cache.
+func usesLogCache(rules []Rule) bool {
+	for _, rule := range rules {
+		if rule.CustomMetric != nil && rule.CustomMetric.Source == SourceLogCache {
+			return true
+		}
+	}
+	return false
+}
+
 func (as *autoscaler) autoscaleApps() error {
 	apps, err := as.client.GetApps()
 	if err != nil {
 		return errors.Wrap(err, "get app list")
 	}
 
+	// clones are handled together with the original apps, or reconciled
+	// before if they were left over
+	as.reconcileClones(apps)
+	as.external = as.readExternal(apps)
+	defer func() { as.external = nil }()
+	clones := map[string]bool{}
+	for _, app := range apps {
+		_, clones[app.Guid] = cloneOf(app, apps)
+	}
+
 	for _, app := range apps {
-		err := as.autoscaleApp(app)
+		if clones[app.Guid] {
+			continue
+		}
+		err := as.autoscaleApp(app, apps)
 		if err != nil {
 			as.log.Print(errors.Wrapf(err, "autoscale app %v", app))
 		}
 	}
 
+	as.forget(apps)
+
 	return nil
 }
 
-func (as *autoscaler) autoscaleApp(app App) error {
-	desired, err := as.analyzeApp(app)
+func (as *autoscaler) autoscaleApp(app App, apps Apps) error {
+	rule, found := ruleFor(as.rules, app.App, app.Space, app.Org)
+	if found && rule.Ratio > 0 {
+		// followers are scaled together with the driver of their group
+		as.log.Printf("autoscale app %v: following group %s", app, rule.Group)
+		return nil
+	}
+	if found && rule.Idle != nil {
+		if handled, err := as.idle(rule, app); handled {
+			return err
+		}
+	}
+	if found && rule.MaxMemoryMB > 0 {
+		if handled, err := as.resizeApp(rule, app, apps); handled {
+			return err
+		}
+	}
+
+	desired, err := as.analyzeApp(app, apps)
 	if err != nil {
 		return errors.Wrap(err, "analyze app")
 	}
 
 	as.log.Printf("autoscale app %v: target %d instances", app, desired)
 
-	if desired != app.Instances {
-		if desired < MinInstancesLimit {
-			// this should never happen
-			return errors.Errorf("illegal to scale below %d instances", MinInstancesLimit)
+	if desired != app.Instances && desired < MinInstancesLimit {
+		// this should never happen
+		return errors.Errorf("illegal to scale below %d instances", MinInstancesLimit)
+	}
+
+	if rule.Group != "" {
+		// the followers are brought to their ratio even if the driver is not scaled
+		err = as.scaleGroup(rule, app, desired, apps)
+		if err != nil || desired != app.Instances {
+			return err
 		}
+	} else if desired != app.Instances {
 		err = as.client.Scale(app, desired)
 		if err != nil {
 			return errors.Wrap(err, "scale app")
 		}
+		as.scaled(app, desired)
+		return nil
 	}
 
-	return nil
+	// outlier instances are restarted only when the app is not being scaled
+	return as.reapApp(rule, app)
 }
 
-func (as *autoscaler) analyzeApp(app App) (desired int, err error) {
+func (as *autoscaler) analyzeApp(app App, apps Apps) (desired int, err error) {
 	rule, found := ruleFor(as.rules, app.App, app.Space, app.Org)
 	if !found {
 		err = errors.New("no applicable rule")
 		return
 	}
 
+	if app.Warming > 0 {
+		as.log.Printf("autoscale app %v: ignoring %d instances warming up", app, app.Warming)
+	}
+	for _, o := range app.Outliers {
+		as.log.Printf("autoscale app %v: ignoring outlier %s", app, o)
+	}
+	as.trackOutliers(app)
+
+	// from here on CpuAvg and MemAvg hold the loads aggregated as required by
+	// the rule
+	app = aggregate(rule, app)
+	if rule.MetricsFrom != nil {
+		if app, err = as.metricsFrom(rule, app, apps); err != nil {
+			return
+		}
+	}
+	if rule.CustomMetric != nil {
+		if app, err = as.customMetric(rule, app); err != nil {
+			return
+		}
+	}
+	if rule.ScaleOutRps > 0 {
+		if app, err = as.requestRate(app); err != nil {
+			return
+		}
+	}
+	if rule.ScaleOutLatency > 0 || rule.MaxErrorRate > 0 {
+		if app, err = as.responseTimes(app); err != nil {
+			return
+		}
+	}
+	if rule.Probe != nil {
+		if app, err = as.probeLatency(rule, app); err != nil {
+			return
+		}
+	}
+	history := as.record(app)
+
+	// when a schedule starts or ends, the app is brought within the new bounds
+	// right away: the bounds are a requirement, so scale_out_after,
+	// scale_in_after and the cooldowns do not apply
+	min, max := instancesRange(rule)
+	rule = scheduledRule(rule, as.now())
+	if app.Instances == app.InstancesRunning && app.Instances >= min && app.Instances <= max {
+		switch {
+		case app.Instances < rule.MinInstances:
+			as.log.Printf("autoscale app %v: scaling to current minimum of %d instances", app, rule.MinInstances)
+			return rule.MinInstances, nil
+		case app.Instances > rule.MaxInstances:
+			as.log.Printf("autoscale app %v: scaling to current maximum of %d instances", app, rule.MaxInstances)
+			return rule.MaxInstances, nil
+		}
+	}
+
+	desired, err = decide(rule, app)
+	if err != nil {
+		return
+	}
+	if rule.Policy == PolicyPID {
+		desired = as.control(rule, app)
+	}
+
+	switch {
+	case desired > app.Instances && !sustained(rule, history, time.Duration(rule.ScaleOutAfter), 1):
+		as.log.Printf("autoscale app %v: scale out to %d instances not sustained for %s", app, desired, rule.ScaleOutAfter)
+		desired = app.Instances
+	case desired < app.Instances && !sustained(rule, history, time.Duration(rule.ScaleInAfter), -1):
+		as.log.Printf("autoscale app %v: scale in to %d instances not sustained for %s", app, desired, rule.ScaleInAfter)
+		desired = app.Instances
+	}
+
+	// a load rising fast enough triggers a scale-out even below the thresholds
+	if trended := as.trending(rule, app, history); trended > desired {
+		desired = trended
+	}
+
+	// the backlog of the queue can require more instances than the loads
+	if rule.Queue != nil {
+		read := as.externalOf(rule, app)
+		stats, err := read.queue, read.queueErr
+		if err != nil {
+			return 0, errors.Wrapf(err, "read queue %s", rule.Queue.Name)
+		}
+		n := queueInstances(rule, stats, app.InstancesRunning)
+		as.log.Printf("autoscale app %v: queue %s has %d messages published at %.1f messages/s, %d consumers acking %.1f messages/s, requiring %d instances", app, rule.Queue.Name, stats.Messages, stats.MessageStats.PublishDetails.Rate, stats.Consumers, stats.MessageStats.AckDetails.Rate, n)
+		if n > desired {
+			desired = n
+		}
+	}
+
+	if rule.Predictive != nil {
+		if predicted, ok := as.predict(rule, app); !ok {
+			as.log.Printf("autoscale app %v: not enough data for predictive scaling", app)
+		} else if predicted > desired {
+			as.log.Printf("autoscale app %v: predicted demand requires %d instances", app, predicted)
+			desired = predicted
+		}
+	}
+
+	if remaining := as.cooldownRemaining(rule, app, desired); remaining > 0 {
+		as.log.Printf("autoscale app %v: skipping scaling to %d instances, cooldown expires in %s", app, desired, remaining)
+		desired = app.Instances
+	}
+	return
+}
+
+// decide returns the number of instances the app should have according to the
+// rule, based only on the current state of the app.
+func decide(rule Rule, app App) (desired int, err error) {
 	switch {
 	case app.Instances < rule.MinInstances || app.Instances > rule.MaxInstances:
 		err = errors.New("number of instances outside of min/max bounds")
 	case app.Instances != app.InstancesRunning:
 		err = errors.Errorf("number of running instances differs from desired: %d/%d", app.InstancesRunning, app.Instances)
-	case app.Instances < rule.MaxInstances && (rule.MaxCpu <= app.CpuAvg || rule.MaxMem <= app.MemAvg):
-		desired = app.Instances + 1
-	case app.Instances > rule.MinInstances && (rule.MinCpu >= app.CpuAvg && rule.MinMem >= app.MemAvg):
-		desired = app.Instances - 1
+	case app.Warming > 0 && app.Warming == app.InstancesRunning:
+		err = errors.New("all running instances are warming up")
+	case rule.Policy == PolicyTarget:
+		desired = targetInstances(rule, app)
+	case rule.Policy == PolicyPID:
+		// the pid policy depends on the previous iterations, see control
+		desired = app.Instances
+	case app.Instances < rule.MaxInstances && overloaded(rule, app):
+		desired = app.Instances + scaleOutStep(rule, app)
+		if desired > rule.MaxInstances {
+			desired = rule.MaxInstances
+		}
+	case app.Instances > rule.MinInstances && underloaded(rule, app):
+		desired = app.Instances - scaleInStep(rule, app)
+		if desired < rule.MinInstances {
+			desired = rule.MinInstances
+		}
 	default:
 		desired = app.Instances
 	}
 	return
 }
+
+// overloaded returns true if the app should be scaled out: by default, when
+// any metric is above its scale-out threshold, or else when the scale out
+// condition of the rule holds.
+func overloaded(rule Rule, app App) bool {
+	if rule.scaleOutWhen != nil {
+		return evalBool(rule.scaleOutWhen, exprEnv(app))
+	}
+	return rule.MaxCpu <= app.CpuAvg || rule.MaxMem <= app.MemAvg || rule.MaxDisk <= app.DiskAvg ||
+		rule.CustomMetric != nil && rule.CustomMetric.ScaleOut <= app.Custom ||
+		rule.ScaleOutRps > 0 && rule.ScaleOutRps <= app.Rps ||
+		rule.ScaleOutLatency > 0 && time.Duration(rule.ScaleOutLatency) <= app.Latency ||
+		rule.Probe != nil && time.Duration(rule.Probe.ScaleOut) <= app.ProbeLatency
+}
+
+// underloaded returns true if the app should be scaled in: by default, when
+// all metrics are below their scale-in thresholds, or else when the scale in
+// condition of the rule holds. An app is never scaled in while its error rate
+// is above the max error rate of the rule.
+func underloaded(rule Rule, app App) bool {
+	if rule.MaxErrorRate > 0 && app.ErrorRate > rule.MaxErrorRate {
+		return false
+	}
+	if rule.scaleInWhen != nil {
+		return evalBool(rule.scaleInWhen, exprEnv(app))
+	}
+	return rule.MinCpu >= app.CpuAvg && rule.MinMem >= app.MemAvg && rule.MinDisk >= app.DiskAvg &&
+		(rule.CustomMetric == nil || rule.CustomMetric.ScaleIn >= app.Custom) &&
+		(rule.ScaleOutRps == 0 || rule.ScaleInRps >= app.Rps) &&
+		(rule.ScaleInLatency == 0 || time.Duration(rule.ScaleInLatency) >= app.Latency) &&
+		(rule.Probe == nil || app.ProbeFailures == 0 && time.Duration(rule.Probe.ScaleIn) >= app.ProbeLatency)
+}
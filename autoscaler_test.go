@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"errors"
 	"log"
+	"reflect"
 	"testing"
+	"time"
 )
 
 type appTest struct {
@@ -248,6 +250,158 @@ func TestAutoscaler(t *testing.T) {
 				asoNoScale(4, 100, 60, nil),
 			},
 		},
+		{
+			rules: []Rule{
+				Rule{App: "a", Space: "s", Org: "o", MinInstances: 5, MaxInstances: 10, MinCpu: 40, MaxCpu: 60, MinDisk: 50, MaxDisk: 80},
+			},
+			apps: []appTest{
+				// cpu low load, disk low usage
+				asoDiskScale(9, 0, 0, 8),
+				// cpu low load, disk ok usage
+				asoDiskNoScale(9, 0, 60),
+				// cpu low load, disk hi usage
+				asoDiskScale(9, 0, 90, 10),
+				asoDiskNoScale(10, 0, 90),
+				// cpu ok load, disk hi usage
+				asoDiskScale(6, 50, 80, 7),
+				// cpu hi load, disk low usage
+				asoDiskScale(6, 100, 0, 7),
+			},
+		},
+		{
+			rules: []Rule{
+				Rule{App: "a", Space: "s", Org: "o", MinInstances: 5, MaxInstances: 10, ScaleOutWhen: "cpu > 70 || (mem > 85 && instances < 8)", ScaleInWhen: "cpu < 30 && mem < 50"},
+			},
+			apps: []appTest{
+				asoScale(6, 80, 0, 7),
+				asoNoScale(6, 60, 80, nil),
+				asoScale(7, 60, 90, 8),
+				asoNoScale(8, 60, 90, nil),
+				asoScale(9, 80, 90, 10),
+				asoScale(9, 20, 40, 8),
+				asoNoScale(9, 20, 60, nil),
+				asoNoScale(5, 20, 40, nil),
+			},
+		},
+		{
+			rules: []Rule{
+				Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 20, MinCpu: 20, MaxCpu: 60, Policy: PolicyTarget, TargetCpu: 30},
+			},
+			apps: []appTest{
+				// out of bounds
+				asoNoScale(2, 90, 0, nil),
+				asoNoScale(21, 90, 0, nil),
+				// on target
+				asoNoScale(3, 30, 0, nil),
+				asoNoScale(4, 30, 0, nil),
+				asoNoScale(20, 30, 0, nil),
+				// hi load
+				asoScale(4, 90, 0, 12),
+				asoScale(4, 40, 0, 5),
+				asoScale(3, 100, 0, 10),
+				asoScale(10, 100, 0, 20),
+				asoScale(19, 100, 0, 20),
+				asoNoScale(20, 100, 0, nil),
+				// slightly above target
+				asoScale(4, 35, 0, 5),
+				asoNoScale(4, 32, 0, nil),
+				// low load
+				asoScale(12, 10, 0, 4),
+				asoScale(4, 22, 0, 3),
+				asoScale(20, 0, 0, 3),
+				asoNoScale(3, 0, 0, nil),
+				asoNoScale(3, 10, 0, nil),
+				// hysteresis: one instance less would exceed the target
+				asoNoScale(4, 24, 0, nil),
+				asoNoScale(10, 28, 0, nil),
+				asoScale(10, 27, 0, 9),
+				// mem is ignored
+				asoNoScale(4, 30, 100, nil),
+			},
+		},
+		{
+			rules: []Rule{
+				Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 20, MinCpu: 20, MaxCpu: 60, MinMem: 40, MaxMem: 80, Policy: PolicyTarget, TargetCpu: 30, TargetMem: 60},
+			},
+			apps: []appTest{
+				// on target
+				asoNoScale(6, 30, 60, nil),
+				// cpu hi load
+				asoScale(6, 60, 60, 12),
+				// mem hi load
+				asoScale(6, 30, 90, 9),
+				// cpu and mem hi load
+				asoScale(6, 60, 90, 12),
+				asoScale(6, 45, 100, 10),
+				// cpu low load, mem on target
+				asoNoScale(6, 10, 60, nil),
+				// cpu on target, mem low load
+				asoNoScale(6, 30, 20, nil),
+				// cpu and mem low load
+				asoScale(6, 10, 20, 3),
+				asoScale(6, 15, 40, 4),
+			},
+		},
+		{
+			rules: []Rule{
+				Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 20, MinCpu: 40, MaxCpu: 60, Steps: []Step{
+					{Metric: MetricCpu, Lower: 0, Upper: 10, Adjustment: -50, Percent: true},
+					{Metric: MetricCpu, Lower: 10, Upper: 20, Adjustment: -2},
+					{Metric: MetricCpu, Lower: 60, Upper: 75, Adjustment: 1},
+					{Metric: MetricCpu, Lower: 75, Upper: 90, Adjustment: 3},
+					{Metric: MetricCpu, Lower: 90, Adjustment: 50, Percent: true},
+				}},
+			},
+			apps: []appTest{
+				// ok load
+				asoNoScale(6, 50, 100, nil),
+				// hi load
+				asoScale(6, 60, 0, 7),
+				asoScale(6, 74, 0, 7),
+				asoScale(6, 75, 0, 9),
+				asoScale(6, 89, 0, 9),
+				asoScale(6, 90, 0, 9),
+				asoScale(7, 90, 0, 11),
+				asoScale(6, 100, 0, 9),
+				asoScale(18, 80, 0, 20),
+				asoScale(18, 100, 0, 20),
+				asoNoScale(20, 100, 0, nil),
+				// low load
+				asoScale(6, 40, 0, 5),
+				asoScale(6, 20, 0, 5),
+				asoScale(6, 19, 0, 4),
+				asoScale(6, 10, 0, 4),
+				asoScale(6, 9, 0, 3),
+				asoScale(7, 0, 0, 3),
+				asoScale(9, 0, 0, 4),
+				asoScale(4, 0, 0, 3),
+				asoNoScale(3, 0, 0, nil),
+			},
+		},
+		{
+			rules: []Rule{
+				Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 20, MinCpu: 40, MaxCpu: 60, MinMem: 50, MaxMem: 70, Steps: []Step{
+					{Metric: MetricCpu, Lower: 0, Upper: 20, Adjustment: -3},
+					{Metric: MetricCpu, Lower: 80, Adjustment: 4},
+					{Metric: MetricMem, Lower: 0, Upper: 20, Adjustment: -2},
+					{Metric: MetricMem, Lower: 80, Adjustment: 2},
+				}},
+			},
+			apps: []appTest{
+				// hi load: the largest step wins
+				asoScale(6, 60, 60, 7),
+				asoScale(6, 80, 60, 10),
+				asoScale(6, 60, 80, 8),
+				asoScale(6, 80, 80, 10),
+				// low load: the smallest step wins
+				asoScale(10, 40, 50, 9),
+				asoScale(10, 10, 50, 9),
+				asoScale(10, 40, 10, 9),
+				asoScale(10, 10, 10, 8),
+				// cpu low load, mem ok load
+				asoNoScale(10, 10, 60, nil),
+			},
+		},
 		{
 			rules: []Rule{
 				Rule{App: "a", Space: "s", Org: "o", MinInstances: 5, MaxInstances: 10, MinCpu: 50, MaxCpu: 70},
@@ -311,7 +465,7 @@ func TestAutoscaler(t *testing.T) {
 			} else {
 				if mock.ScaleApp == nil {
 					t.Fatalf("%d/%d: Scale not called\n%s", i, j, buf.String())
-				} else if *mock.ScaleApp != *app.ScaleApp || *mock.ScaleDesired != *app.ScaleDesired {
+				} else if !reflect.DeepEqual(*mock.ScaleApp, *app.ScaleApp) || *mock.ScaleDesired != *app.ScaleDesired {
 					t.Fatalf("%d/%d: Scale called with wrong args: %v %d\n%s", i, j, *mock.ScaleApp, *mock.ScaleDesired, buf.String())
 				}
 			}
@@ -319,6 +473,161 @@ func TestAutoscaler(t *testing.T) {
 	}
 }
 
+func TestAggregation(t *testing.T) {
+	rules := []Rule{
+		Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 10, MinCpu: 40, MaxCpu: 60, MinMem: 50, MaxMem: 70, CpuAggregation: AggregationMedian, MemAggregation: AggregationMax},
+	}
+	if err := validateRules(rules); err != nil {
+		t.Fatalf("validateRules: %s", err)
+	}
+
+	tests := []struct {
+		stats   []InstanceStats
+		desired int
+	}{
+		// one hot instance does not trigger a scale out...
+		{[]InstanceStats{{"0", 100, 10, 0}, {"1", 30, 10, 0}, {"2", 30, 10, 0}, {"3", 30, 10, 0}}, 3},
+		{[]InstanceStats{{"0", 100, 10, 0}, {"1", 50, 10, 0}, {"2", 50, 10, 0}, {"3", 50, 10, 0}}, 0},
+		{[]InstanceStats{{"0", 100, 10, 0}, {"1", 70, 10, 0}, {"2", 70, 10, 0}, {"3", 50, 10, 0}}, 5},
+		// ...unless it is about memory
+		{[]InstanceStats{{"0", 50, 90, 0}, {"1", 50, 10, 0}, {"2", 50, 10, 0}, {"3", 50, 10, 0}}, 5},
+		{[]InstanceStats{{"0", 0, 60, 0}, {"1", 0, 10, 0}, {"2", 0, 10, 0}, {"3", 0, 10, 0}}, 0},
+	}
+
+	for i, test := range tests {
+		app := App{App: "a", Space: "s", Org: "o", Guid: guid, Instances: 4, InstancesRunning: 4, Stats: test.stats}
+		for _, s := range test.stats {
+			app.CpuAvg += int(s.Cpu) / len(test.stats)
+			app.MemAvg += int(s.Mem) / len(test.stats)
+		}
+		mock := &MockClient{Apps: Apps{guid: app}}
+		buf := &bytes.Buffer{}
+		as := &autoscaler{client: mock, rules: rules, log: log.New(buf, "", log.Lshortfile)}
+		as.autoscaleApps()
+
+		if test.desired == 0 && mock.ScaleDesired != nil {
+			t.Fatalf("%d: Scale called: %d\n%s", i, *mock.ScaleDesired, buf.String())
+		} else if test.desired != 0 && (mock.ScaleDesired == nil || *mock.ScaleDesired != test.desired) {
+			t.Fatalf("%d: Scale not called with %d\n%s", i, test.desired, buf.String())
+		}
+	}
+}
+
+func TestSustainedBreach(t *testing.T) {
+	rules := []Rule{
+		Rule{App: "a", Space: "s", Org: "o", MinInstances: 5, MaxInstances: 10, MinCpu: 40, MaxCpu: 60, ScaleOutAfter: Duration(time.Minute), ScaleInAfter: Duration(2 * time.Minute)},
+	}
+	if err := validateRules(rules); err != nil {
+		t.Fatalf("validateRules: %s", err)
+	}
+
+	tests := []struct {
+		cpu     int
+		desired int
+	}{
+		// scale out after 1 minute
+		{70, 0},
+		{70, 0},
+		{70, 8},
+		{70, 8},
+		// interrupted breach
+		{50, 0},
+		{70, 0},
+		{30, 0},
+		{70, 0},
+		// scale in after 2 minutes
+		{30, 0},
+		{30, 0},
+		{30, 0},
+		{30, 0},
+		{30, 6},
+		{30, 6},
+		// breach in the opposite direction
+		{70, 0},
+		{70, 0},
+		{30, 0},
+	}
+
+	now := time.Now()
+	buf := &bytes.Buffer{}
+	as := &autoscaler{rules: rules, log: log.New(buf, "", log.Lshortfile), clock: func() time.Time { return now }}
+
+	for i, test := range tests {
+		now = now.Add(Interval)
+		app := App{App: "a", Space: "s", Org: "o", Guid: guid, Instances: 7, InstancesRunning: 7, CpuAvg: test.cpu}
+		mock := &MockClient{Apps: Apps{guid: app}}
+		as.client = mock
+		as.autoscaleApps()
+
+		if test.desired == 0 && mock.ScaleDesired != nil {
+			t.Fatalf("%d: Scale called: %d\n%s", i, *mock.ScaleDesired, buf.String())
+		} else if test.desired != 0 && (mock.ScaleDesired == nil || *mock.ScaleDesired != test.desired) {
+			t.Fatalf("%d: Scale not called with %d\n%s", i, test.desired, buf.String())
+		}
+	}
+
+	// the history is discarded once the app is gone
+	as.client = &MockClient{Apps: Apps{}}
+	as.autoscaleApps()
+	if len(as.history) != 0 {
+		t.Fatalf("history not discarded: %v", as.history)
+	}
+}
+
+func TestCooldown(t *testing.T) {
+	rules := []Rule{
+		Rule{App: "a", Space: "s", Org: "o", MinInstances: 5, MaxInstances: 10, MinCpu: 40, MaxCpu: 60, ScaleOutCooldown: Duration(time.Minute), ScaleInCooldown: Duration(2 * time.Minute)},
+	}
+	if err := validateRules(rules); err != nil {
+		t.Fatalf("validateRules: %s", err)
+	}
+
+	tests := []struct {
+		cpu     int
+		desired int
+	}{
+		// scale out at most once a minute
+		{70, 8},
+		{70, 0},
+		{70, 9},
+		// scale in at most two minutes after scaling out
+		{30, 0},
+		{30, 0},
+		{30, 0},
+		{30, 8},
+		// scale out is not affected by scale in
+		{70, 9},
+		// scale in at most two minutes after scaling in
+		{30, 0},
+		{30, 0},
+		{30, 0},
+		{30, 8},
+		{30, 0},
+	}
+
+	now := time.Now()
+	buf := &bytes.Buffer{}
+	as := &autoscaler{rules: rules, log: log.New(buf, "", log.Lshortfile), clock: func() time.Time { return now }}
+	instances := 7
+
+	for i, test := range tests {
+		now = now.Add(Interval)
+		app := App{App: "a", Space: "s", Org: "o", Guid: guid, Instances: instances, InstancesRunning: instances, CpuAvg: test.cpu}
+		mock := &MockClient{Apps: Apps{guid: app}}
+		as.client = mock
+		as.autoscaleApps()
+
+		if test.desired == 0 && mock.ScaleDesired != nil {
+			t.Fatalf("%d: Scale called: %d\n%s", i, *mock.ScaleDesired, buf.String())
+		} else if test.desired != 0 && (mock.ScaleDesired == nil || *mock.ScaleDesired != test.desired) {
+			t.Fatalf("%d: Scale not called with %d\n%s", i, test.desired, buf.String())
+		}
+		if mock.ScaleDesired != nil {
+			instances = *mock.ScaleDesired
+		}
+	}
+}
+
 func asoNoScale(i, c, m int, err error) appTest {
 	return appTest{App: &App{App: "a", Space: "s", Org: "o", Guid: guid, Instances: i, InstancesRunning: i, CpuAvg: c, MemAvg: m}, AppsError: err}
 }
@@ -328,3 +637,13 @@ func asoScale(i, c, m, d int) appTest {
 	t.ScaleApp, t.ScaleDesired = &*t.App, &d
 	return t
 }
+
+func asoDiskNoScale(i, c, d int) appTest {
+	return appTest{App: &App{App: "a", Space: "s", Org: "o", Guid: guid, Instances: i, InstancesRunning: i, CpuAvg: c, DiskAvg: d}}
+}
+
+func asoDiskScale(i, c, d, desired int) appTest {
+	t := asoDiskNoScale(i, c, d)
+	t.ScaleApp, t.ScaleDesired = &*t.App, &desired
+	return t
+}
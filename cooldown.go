@@ -0,0 +1,53 @@
+package main
+
+import (
+	"time"
+)
+
+// cooldown records when an app was last scaled out and in
+type cooldown struct {
+	Out time.Time
+	In  time.Time
+}
+
+// scaled records that the app has been scaled to desired instances.
+func (as *autoscaler) scaled(app App, desired int) {
+	if as.cooldowns == nil {
+		as.cooldowns = make(map[string]cooldown)
+	}
+
+	c := as.cooldowns[app.Guid]
+	if desired > app.Instances {
+		c.Out = as.now()
+	} else {
+		c.In = as.now()
+	}
+	as.cooldowns[app.Guid] = c
+}
+
+// cooldownRemaining returns how long the app has to wait before it can be
+// scaled to desired instances: a scale-out has to wait scale_out_cooldown
+// since the last scale-out, while a scale-in has to wait scale_in_cooldown
+// since the last scale-out or scale-in.
+func (as *autoscaler) cooldownRemaining(rule Rule, app App, desired int) time.Duration {
+	c := as.cooldowns[app.Guid]
+
+	var expires time.Time
+	switch {
+	case desired > app.Instances:
+		expires = c.Out.Add(time.Duration(rule.ScaleOutCooldown))
+	case desired < app.Instances:
+		last := c.In
+		if c.Out.After(last) {
+			last = c.Out
+		}
+		expires = last.Add(time.Duration(rule.ScaleInCooldown))
+	default:
+		return 0
+	}
+
+	if remaining := expires.Sub(as.now()); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// cron is a parsed cron expression in the standard 5 fields format
+// (minute, hour, day of month, month, day of week)
+type cron struct {
+	minute, hour, dom, month, dow uint64
+	// day of month and day of week are matched with OR semantics unless one
+	// of them is *
+	domAny, dowAny bool
+}
+
+type cronField struct {
+	name     string
+	min, max int
+	names    []string
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59, nil},
+	{"hour", 0, 23, nil},
+	{"day of month", 1, 31, nil},
+	{"month", 1, 12, []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{"day of week", 0, 7, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+func parseCron(expr string) (*cron, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, errors.Errorf("cron expression should have %d fields", len(cronFields))
+	}
+
+	var bits [5]uint64
+	for i, field := range fields {
+		b, err := cronFields[i].parse(field)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s field %q", cronFields[i].name, field)
+		}
+		bits[i] = b
+	}
+
+	c := &cron{minute: bits[0], hour: bits[1], dom: bits[2], month: bits[3], dow: bits[4]}
+	c.domAny, c.dowAny = fields[2] == "*", fields[4] == "*"
+	if c.dow&(1<<7) != 0 {
+		// both 0 and 7 are sunday
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+func (f cronField) parse(field string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s <= 0 {
+				return 0, errors.Errorf("invalid step %q", part[i+1:])
+			}
+			rng, step = part[:i], s
+		}
+
+		lo, hi := f.min, f.max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if lo, err = f.value(bounds[0]); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = f.value(bounds[1]); err != nil {
+					return 0, err
+				}
+			} else if step != 1 {
+				// a/n is a shorthand for a-max/n
+				hi = f.max
+			}
+			if hi < lo {
+				return 0, errors.Errorf("invalid range %q", rng)
+			}
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (f cronField) value(s string) (int, error) {
+	for i, name := range f.names {
+		if name != "" && strings.ToLower(s) == name {
+			return i, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, errors.Errorf("invalid value %q", s)
+	}
+	return v, nil
+}
+
+// matches returns true if the cron expression matches the minute of t.
+func (c *cron) matches(t time.Time) bool {
+	return c.minute&(1<<uint(t.Minute())) != 0 && c.hour&(1<<uint(t.Hour())) != 0 && c.matchesDay(t)
+}
+
+// matchesDay returns true if the cron expression matches the day of t.
+func (c *cron) matchesDay(t time.Time) bool {
+	if c.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dom, dow := c.dom&(1<<uint(t.Day())) != 0, c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// last returns the latest time, not before since, at which the cron expression
+// matched; if it never matched, ok is false.
+func (c *cron) last(now, since time.Time) (t time.Time, ok bool) {
+	for t = now.Truncate(time.Minute); !t.Before(since); t = t.Add(-time.Minute) {
+		if c.matches(t) {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// next returns the earliest time after after at which the cron expression
+// matches; if it does not match in the following 10 years, ok is false.
+func (c *cron) next(after time.Time) (t time.Time, ok bool) {
+	end := after.AddDate(10, 0, 0)
+	for t = after.Truncate(time.Minute).Add(time.Minute); t.Before(end); {
+		y, m, d := t.Date()
+		var n time.Time
+		switch {
+		case !c.matchesDay(t):
+			n = time.Date(y, m, d+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			n = time.Date(y, m, d, t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			n = t.Add(time.Minute)
+		default:
+			return t, true
+		}
+		// around daylight saving time changes the next day or hour may not
+		// be later
+		if !n.After(t) {
+			n = t.Add(time.Minute)
+		}
+		t = n
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	valid := []string{"* * * * *", "0 8 * * 1-5", "*/15 0-6,18-23 1,15 jan-mar mon-fri", "30 12 * * 7", "5/10 * * DEC SUN"}
+	for _, expr := range valid {
+		if _, err := parseCron(expr); err != nil {
+			t.Fatalf("%q: %s", expr, err)
+		}
+	}
+
+	invalid := []string{"", "* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "a * * * *", "* * * foo *", "1- * * * *"}
+	for _, expr := range invalid {
+		if _, err := parseCron(expr); err == nil {
+			t.Fatalf("%q: parsed", expr)
+		}
+	}
+}
+
+func TestCronMatches(t *testing.T) {
+	tests := []struct {
+		expr    string
+		time    string
+		matches bool
+	}{
+		{"* * * * *", "2017-06-01T08:00:00Z", true},
+		{"0 8 * * 1-5", "2017-06-01T08:00:00Z", true},
+		{"0 8 * * 1-5", "2017-06-01T08:01:00Z", false},
+		{"0 8 * * 1-5", "2017-06-03T08:00:00Z", false},
+		{"0 8 * * 7", "2017-06-04T08:00:00Z", true},
+		{"0 8 * * 0", "2017-06-04T08:00:00Z", true},
+		{"*/15 * * * *", "2017-06-01T08:45:00Z", true},
+		{"*/15 * * * *", "2017-06-01T08:50:00Z", false},
+		{"5/20 * * * *", "2017-06-01T08:45:00Z", true},
+		{"0 0 1 jan *", "2017-01-01T00:00:00Z", true},
+		{"0 0 1 jan *", "2017-02-01T00:00:00Z", false},
+		// day of month or day of week
+		{"0 0 13 * fri", "2017-06-02T00:00:00Z", true},
+		{"0 0 13 * fri", "2017-06-13T00:00:00Z", true},
+		{"0 0 13 * fri", "2017-06-14T00:00:00Z", false},
+		{"0 0 13 * *", "2017-06-02T00:00:00Z", false},
+	}
+
+	for i, test := range tests {
+		c, err := parseCron(test.expr)
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		tm, _ := time.Parse(time.RFC3339, test.time)
+		if c.matches(tm) != test.matches {
+			t.Fatalf("%d: %q matches %s: %t", i, test.expr, test.time, !test.matches)
+		}
+	}
+}
+
+func TestCronLast(t *testing.T) {
+	c, _ := parseCron("0 8 * * 1-5")
+	now, _ := time.Parse(time.RFC3339, "2017-06-01T19:59:30Z")
+	if last, ok := c.last(now, now.Add(-12*time.Hour)); !ok || last.Format(time.RFC3339) != "2017-06-01T08:00:00Z" {
+		t.Fatalf("wrong last match: %s %t", last, ok)
+	}
+	if last, ok := c.last(now, now.Add(-11*time.Hour)); ok {
+		t.Fatalf("wrong last match: %s", last)
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	paris, _ := time.LoadLocation("Europe/Paris")
+	tests := []struct {
+		expr  string
+		after time.Time
+		next  string // empty if it never matches
+	}{
+		{"0 8 * * 1-5", time.Date(2017, 6, 1, 19, 59, 30, 0, time.UTC), "2017-06-02T08:00:00Z"},
+		{"0 8 * * 1-5", time.Date(2017, 6, 2, 8, 0, 0, 0, time.UTC), "2017-06-05T08:00:00Z"},
+		{"*/15 * * * *", time.Date(2017, 6, 1, 19, 59, 30, 0, time.UTC), "2017-06-01T20:00:00Z"},
+		// 02:30 does not exist on the day daylight saving time starts
+		{"30 2 * * *", time.Date(2017, 3, 25, 12, 0, 0, 0, paris), "2017-03-27T02:30:00+02:00"},
+		{"0 0 29 2 *", time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC), "2020-02-29T00:00:00Z"},
+		{"0 0 30 2 *", time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC), ""},
+	}
+
+	for i, test := range tests {
+		c, err := parseCron(test.expr)
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		next, ok := c.next(test.after)
+		if ok != (test.next != "") || ok && next.Format(time.RFC3339) != test.next {
+			t.Fatalf("%d: wrong next match: %s %t", i, next, ok)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// the values of a custom metric can also be summed
+const AggregationSum = "sum"
+
+// names of metrics and labels
+var promName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// CustomMetric is a metric read from a source other than the CF API, with its
+// own thresholds: the app is scaled out when the value of the metric is at or
+// above scale out, and it can be scaled in when it is at or below scale in.
+//
+// The metric is scraped in the Prometheus text exposition format from url,
+// either once (an endpoint aggregating the metrics of the app) or once per
+// running instance. If source is "log-cache", the metric is instead a gauge
+// emitted by the app, averaged over the log-cache window for each instance.
+// If source is "promql", the metric is the result of query, a template
+// expanded for each app, evaluated by the Prometheus HTTP API at url.
+type CustomMetric struct {
+	Metric      string            `json:"metric"`
+	Labels      map[string]string `json:"labels"`
+	Aggregation string            `json:"aggregation"`
+	URL         string            `json:"url"`
+	PerInstance bool              `json:"per_instance"`
+	ScaleIn     float64           `json:"scale_in"`
+	ScaleOut    float64           `json:"scale_out"`
+	Source      string            `json:"source"`
+	Query       string            `json:"query"`
+}
+
+// name returns the name of the metric in logs and errors.
+func (m CustomMetric) name() string {
+	if m.Source == SourcePromQL {
+		return "query"
+	}
+	return m.Metric
+}
+
+func validateCustomMetric(m CustomMetric) error {
+	switch {
+	case m.Source != "" && m.Source != SourceLogCache && m.Source != SourcePromQL:
+		return errors.Errorf("custom metric source should be %q or %q", SourceLogCache, SourcePromQL)
+	case m.Source == SourcePromQL && (m.Query == "" || m.URL == ""):
+		return errors.New("custom metric query and url are required with promql source")
+	case m.Source == SourcePromQL && (m.Metric != "" || len(m.Labels) > 0 || m.PerInstance):
+		return errors.New("custom metrics with promql source can not have metric, labels or per instance")
+	case m.Source != SourcePromQL && m.Query != "":
+		return errors.New("custom metric query requires promql source")
+	case m.Source != SourcePromQL && m.Metric == "":
+		return errors.New("custom metric name is required")
+	case m.Source == SourceLogCache && (m.URL != "" || m.PerInstance):
+		return errors.New("custom metrics read from log-cache can not have url or per instance")
+	case m.Source == SourceLogCache && !promName.MatchString(m.Metric):
+		return errors.Errorf("invalid custom metric name %q", m.Metric)
+	case m.Source == "" && m.URL == "":
+		return errors.New("custom metric url is required")
+	case m.ScaleIn >= m.ScaleOut:
+		return errors.New("custom metric scale in threshold should be less than scale out threshold")
+	}
+	for k := range m.Labels {
+		if !promName.MatchString(k) {
+			return errors.Errorf("invalid custom metric label %q", k)
+		}
+	}
+	if _, err := url.Parse(m.URL); err != nil {
+		return errors.Wrap(err, "parse custom metric url")
+	}
+	if m.Source == SourcePromQL {
+		if _, err := expandQuery(m.Query, App{}); err != nil {
+			return errors.Wrap(err, "custom metric query")
+		}
+	}
+	if m.Aggregation != AggregationSum {
+		if err := validateAggregation(m.Aggregation); err != nil {
+			return errors.Wrap(err, "custom metric aggregation")
+		}
+	}
+	return nil
+}
+
+// readCustomMetric returns the values of the custom metric for the app, read
+// from its source. It is safe to call it concurrently.
+func (as *autoscaler) readCustomMetric(m CustomMetric, app App) ([]float64, error) {
+	switch m.Source {
+	case SourceLogCache:
+		if as.logCache == nil {
+			return nil, errors.New("log-cache not configured")
+		}
+		return as.logCache.gauge(m, app)
+	case SourcePromQL:
+		return queryApp(as.metricsClient(), m, app)
+	}
+	return scrapeApp(as.metricsClient(), m, app)
+}
+
+// customMetric returns the app with Custom set to the aggregated value of the
+// custom metric of the rule.
+func (as *autoscaler) customMetric(rule Rule, app App) (App, error) {
+	m := rule.CustomMetric
+	read := as.externalOf(rule, app)
+	values, err := read.custom, read.customErr
+	if err != nil {
+		return app, errors.Wrapf(err, "read %s", m.name())
+	}
+	if len(values) == 0 {
+		return app, errors.Errorf("read %s: no matching samples", m.name())
+	}
+
+	if m.Aggregation == AggregationSum {
+		app.Custom = 0
+		for _, v := range values {
+			app.Custom += v
+		}
+	} else {
+		app.Custom = aggregateValues(values, m.Aggregation)
+	}
+	as.log.Printf("autoscale app %v: %s is %g", app, m.name(), app.Custom)
+	return app, nil
+}
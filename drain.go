@@ -0,0 +1,161 @@
+package main
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// latencies and error rates are computed over this window
+	LatencyWindow = time.Minute
+	// at most this many requests per app are kept in the window
+	LatencyMaxSamples = 10000
+)
+
+var (
+	rtrStatus       = regexp.MustCompile(`\] "(?:[^"\\]|\\.)*" (\d{3}) `)
+	rtrResponseTime = regexp.MustCompile(` response_time:(\d+(?:\.\d+)?)`)
+	rtrAppId        = regexp.MustCompile(` app_id:"([0-9a-f-]+)"`)
+)
+
+// rtrLine holds the fields of a gorouter access log line used by the drain.
+type rtrLine struct {
+	AppGuid      string
+	Status       int
+	ResponseTime time.Duration
+}
+
+// parseRTR parses the access log line emitted by the gorouter for a request;
+// ok is false if the line is not an access log line.
+func parseRTR(m syslogMessage) (l rtrLine, ok bool) {
+	if !strings.HasPrefix(m.ProcID, "[RTR") {
+		return l, false
+	}
+	status := rtrStatus.FindStringSubmatch(m.Msg)
+	rt := rtrResponseTime.FindStringSubmatch(m.Msg)
+	if status == nil || rt == nil {
+		return l, false
+	}
+	l.Status, _ = strconv.Atoi(status[1])
+	seconds, _ := strconv.ParseFloat(rt[1], 64)
+	l.ResponseTime = time.Duration(seconds * float64(time.Second))
+
+	// the app name of the messages of syslog drains is the app guid; it is
+	// set by Loggregator, while the message could name any app
+	l.AppGuid = m.AppName
+	if id := rtrAppId.FindStringSubmatch(m.Msg); id != nil && id[1] != m.AppName {
+		return l, false
+	}
+	return l, true
+}
+
+type response struct {
+	Time    time.Time
+	Latency time.Duration
+	Error   bool
+}
+
+// drain receives the logs of the apps bound to simple-autoscaler as a syslog
+// drain, and keeps the response times and statuses of the requests routed to
+// them over the last LatencyWindow. It is safe to use it concurrently.
+type drain struct {
+	// clock returns the current time; if nil, time.Now is used
+	clock func() time.Time
+
+	mu        sync.Mutex
+	started   time.Time
+	responses map[string][]response
+}
+
+func (d *drain) now() time.Time {
+	if d.clock != nil {
+		return d.clock()
+	}
+	return time.Now()
+}
+
+// start records when the drain started receiving logs.
+func (d *drain) start() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.started = d.now()
+}
+
+// receive records the request of a syslog message, if it is a gorouter access
+// log line; other messages are ignored.
+func (d *drain) receive(s string) {
+	m, err := parseSyslog(s)
+	if err != nil {
+		return
+	}
+	l, ok := parseRTR(m)
+	if !ok {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.responses == nil {
+		d.responses = make(map[string][]response)
+	}
+	now := d.now()
+	r := append(d.responses[l.AppGuid], response{Time: now, Latency: l.ResponseTime, Error: l.Status >= 500})
+	i := 0
+	for i < len(r) && (now.Sub(r[i].Time) >= LatencyWindow || len(r)-i > LatencyMaxSamples) {
+		i++
+	}
+	d.responses[l.AppGuid] = r[i:]
+}
+
+// stats returns the 95th percentile of the response times of the app and the
+// percentage of requests that failed with a 5xx status over the last
+// LatencyWindow; ok is false if the drain has not been receiving logs for that
+// long.
+func (d *drain) stats(guid string) (p95 time.Duration, errorRate float64, n int, ok bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.now()
+	if d.started.IsZero() || now.Sub(d.started) < LatencyWindow {
+		return 0, 0, 0, false
+	}
+
+	var latencies []float64
+	errs := 0
+	for _, r := range d.responses[guid] {
+		if now.Sub(r.Time) >= LatencyWindow {
+			continue
+		}
+		latencies = append(latencies, float64(r.Latency))
+		if r.Error {
+			errs++
+		}
+	}
+	if len(latencies) == 0 {
+		return 0, 0, 0, true
+	}
+	sort.Float64s(latencies)
+	p95 = time.Duration(math.Ceil(percentile(latencies, 95)))
+	return p95, float64(errs) / float64(len(latencies)) * 100, len(latencies), true
+}
+
+// responseTimes returns the app with Latency and ErrorRate set from the
+// requests received by the drain.
+func (as *autoscaler) responseTimes(app App) (App, error) {
+	if as.drain == nil {
+		return app, errors.New("syslog drain not running")
+	}
+	p95, errorRate, n, ok := as.drain.stats(app.Guid)
+	if !ok {
+		return app, errors.Errorf("syslog drain not running for %s yet", LatencyWindow)
+	}
+	app.Latency, app.ErrorRate = p95, errorRate
+	as.log.Printf("autoscale app %v: %d requests, p95 latency %s, %.1f%% 5xx", app, n, p95, errorRate)
+	return app, nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rtr returns a syslog message carrying the gorouter access log line of a
+// request to the app.
+func rtr(guid string, status int, responseTime float64) string {
+	return fmt.Sprintf(`<14>1 2017-06-01T10:00:00.123456+00:00 o.s.a %s [RTR/1] - [tags@47450 source_type="RTR"] a.example.com - [2017-06-01T10:00:00.120+0000] "GET /path?q=\"x\" HTTP/1.1" %d 0 42 "-" "curl/7.54.0" "10.0.0.1:55000" "10.0.16.5:61001" x_forwarded_for:"10.0.0.1" x_forwarded_proto:"https" vcap_request_id:"0cbe4e2c-6a56-4b6f-6d76-3f7a6a0e1b2f" response_time:%g app_id:"%s" app_index:"0"`, guid, status, responseTime, guid)
+}
+
+func TestParseSyslog(t *testing.T) {
+	tests := []struct {
+		s   string
+		exp syslogMessage
+	}{
+		{
+			"<14>1 2017-06-01T10:00:00Z host app [APP/PROC/WEB/0] - - hello world\n",
+			syslogMessage{"host", "app", "[APP/PROC/WEB/0]", "hello world"},
+		},
+		{
+			`<14>1 2017-06-01T10:00:00Z host app [RTR/1] - [a@1 x="y\]z"][b@1] ` + "\xef\xbb\xbfmessage",
+			syslogMessage{"host", "app", "[RTR/1]", "message"},
+		},
+		{"<14>1 2017-06-01T10:00:00Z host app proc - -", syslogMessage{"host", "app", "proc", ""}},
+	}
+	for i, test := range tests {
+		if m, err := parseSyslog(test.s); err != nil {
+			t.Fatalf("%d: %s", i, err)
+		} else if m != test.exp {
+			t.Fatalf("%d: got %+v, expected %+v", i, m, test.exp)
+		}
+	}
+
+	for _, s := range []string{"hello", "<14>2 2017-06-01T10:00:00Z host app proc - - m", `<14>1 2017-06-01T10:00:00Z host app proc - [a@1 x="y"`, "<14>1 2017-06-01T10:00:00Z host app proc - [a@1]m"} {
+		if _, err := parseSyslog(s); err == nil {
+			t.Fatalf("parsed %q", s)
+		}
+	}
+}
+
+func TestParseRTR(t *testing.T) {
+	m, _ := parseSyslog(rtr(guid, 503, 0.25))
+	if l, ok := parseRTR(m); !ok || l != (rtrLine{AppGuid: guid, Status: 503, ResponseTime: 250 * time.Millisecond}) {
+		t.Fatalf("got %+v %v", l, ok)
+	}
+
+	m, _ = parseSyslog("<14>1 2017-06-01T10:00:00Z o.s.a " + guid + " [APP/PROC/WEB/0] - - GET / 200 response_time:1")
+	if l, ok := parseRTR(m); ok {
+		t.Fatalf("parsed app log: %+v", l)
+	}
+
+	// the line names another app than the one whose logs are drained
+	m, _ = parseSyslog(strings.Replace(rtr(guid, 200, 0.25), " o.s.a "+guid+" ", " o.s.a other ", 1))
+	if l, ok := parseRTR(m); ok {
+		t.Fatalf("parsed line of another app: %+v", l)
+	}
+}
+
+func TestReadSyslogFrame(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("11 hello\nworld<14>1 newline framing\n4 last"))
+	for _, exp := range []string{"hello\nworld", "<14>1 newline framing\n", "last"} {
+		if s, err := readSyslogFrame(r); err != nil || s != exp {
+			t.Fatalf("got %q %v, expected %q", s, err, exp)
+		}
+	}
+	if _, err := readSyslogFrame(bufio.NewReader(strings.NewReader("99999999 x"))); err == nil {
+		t.Fatalf("read too large frame")
+	}
+}
+
+// clientCertificate returns a self-signed client certificate and its key,
+// PEM-encoded.
+func clientCertificate(t *testing.T) (cert, key string) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "loggregator"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("create certificate: %s", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("marshal key: %s", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+}
+
+func TestDrainTransports(t *testing.T) {
+	d := &drain{}
+	logger := log.New(ioutil.Discard, "", 0)
+
+	// the certificate of the clients is also used by the server
+	certPEM, keyPEM := clientCertificate(t)
+	clientCert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		t.Fatalf("load certificate: %s", err)
+	}
+	cfg := Config{Logger: logger, SyslogToken: "secret", SyslogTLSCert: certPEM, SyslogTLSKey: keyPEM, SyslogTLSClientCA: certPEM}
+	tlsConfig, err := syslogTLSConfig(cfg)
+	if err != nil {
+		t.Fatalf("syslogTLSConfig: %s", err)
+	}
+	l, err := d.listenSyslog("127.0.0.1:0", tlsConfig, logger)
+	if err != nil {
+		t.Fatalf("listenSyslog: %s", err)
+	}
+	defer l.Close()
+	for _, certs := range [][]tls.Certificate{{clientCert}, nil} {
+		tlsConn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true, Certificates: certs})
+		if err != nil {
+			// the handshake may fail on the client side without a certificate
+			continue
+		}
+		s := rtr("tls", 200, 0.1)
+		if certs == nil {
+			s = rtr("anonymous", 200, 0.1)
+		}
+		fmt.Fprintf(tlsConn, "%d %s", len(s), s)
+		tlsConn.Close()
+	}
+
+	hs := httptest.NewServer(d.syslogHandler("secret"))
+	defer hs.Close()
+	for _, token := range []string{"secret", "wrong", ""} {
+		res, err := http.Post(hs.URL+"/syslog?token="+token, "text/plain", strings.NewReader(rtr("https", 200, 0.1)))
+		if err != nil {
+			t.Fatalf("post: %s", err)
+		}
+		res.Body.Close()
+		if (res.StatusCode == http.StatusOK) != (token == "secret") {
+			t.Fatalf("token %s: status %s", token, res.Status)
+		}
+	}
+
+	count := func(guid string) int {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return len(d.responses[guid])
+	}
+	for i := 0; i < 100 && count("tls") < 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if count("tls") != 1 || count("anonymous") != 0 || count("https") != 1 {
+		t.Fatalf("wrong responses: %+v", d.responses)
+	}
+
+	// without a token, or a client CA for the TLS drain, the drain does not
+	// start
+	noToken, noCA := cfg, cfg
+	noToken.SyslogToken = ""
+	noCA.SyslogTLSPort, noCA.SyslogTLSClientCA = "0", ""
+	for _, cfg := range []Config{noToken, noCA} {
+		if err := (&drain{}).listen(cfg); err == nil {
+			t.Fatalf("listen %+v: started", cfg)
+		}
+	}
+}
+
+func TestLatencyScaling(t *testing.T) {
+	rules := []Rule{
+		Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 10, MinCpu: 20, MaxCpu: 80, ScaleOutLatency: Duration(500 * time.Millisecond), MaxErrorRate: 5},
+	}
+	if err := validateRules(rules); err != nil {
+		t.Fatalf("validateRules: %s", err)
+	}
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+	d := &drain{clock: clock}
+	d.start()
+
+	tests := []struct {
+		elapsed time.Duration // since the previous iteration
+		slow    int           // requests taking 1s out of 100
+		errors  int           // requests failing out of 100
+		cpu     int
+		exp     int // 0 if not scaled
+	}{
+		// the drain has not been running long enough
+		{30 * time.Second, 10, 0, 50, 0},
+		{time.Minute, 4, 0, 50, 0},
+		{time.Minute, 6, 0, 50, 5},
+		{time.Minute, 0, 0, 10, 3},
+		// no scale-in while the error rate is elevated
+		{time.Minute, 0, 6, 10, 0},
+		{time.Minute, 0, 6, 90, 5},
+	}
+
+	for i, test := range tests {
+		now = now.Add(test.elapsed)
+		for r := 0; r < 100; r++ {
+			status, responseTime := 200, 0.01
+			if r < test.slow {
+				responseTime = 1
+			}
+			if r >= 100-test.errors {
+				status = 502
+			}
+			d.receive(rtr(guid, status, responseTime))
+		}
+
+		buf := &bytes.Buffer{}
+		as := &autoscaler{rules: rules, log: log.New(buf, "", log.Lshortfile), clock: clock, drain: d}
+		mock := &MockClient{Apps: Apps{guid: App{App: "a", Space: "s", Org: "o", Guid: guid, Instances: 4, InstancesRunning: 4, CpuAvg: test.cpu}}}
+		as.client = mock
+		as.autoscaleApps()
+
+		switch {
+		case test.exp == 0 && mock.ScaleDesired != nil:
+			t.Fatalf("%d: scaled to %d\n%s", i, *mock.ScaleDesired, buf.String())
+		case test.exp != 0 && (mock.ScaleDesired == nil || *mock.ScaleDesired != test.exp):
+			t.Fatalf("%d: not scaled to %d\n%s", i, test.exp, buf.String())
+		}
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Conditions like `cpu > 70 || (mem > 85 && instances < 6)` are parsed into a
+// tree of expressions that is type-checked while parsing. The grammar, from
+// the lowest to the highest precedence, is:
+//
+//	or     = and { "||" and }
+//	and    = not { "&&" not }
+//	not    = "!" not | cmp
+//	cmp    = sum [ ( "<" | "<=" | ">" | ">=" | "==" | "!=" ) sum ]
+//	sum    = term { ( "+" | "-" ) term }
+//	term   = factor { ( "*" | "/" ) factor }
+//	factor = number | variable | "-" factor | "(" or ")"
+
+// ExprVars are the variables that can be used in conditions: the aggregated
+// loads of the app, its number of instances, the value of the custom metric of
+// the rule, the requests per second per instance, the 95th percentile of the
+// response times in milliseconds, the percentage of 5xx responses, and the
+// percentile of the response times of the probes in milliseconds and the
+// percentage of failed probes (see unavailableVars).
+var ExprVars = []string{MetricCpu, MetricMem, MetricDisk, "instances", "custom", "rps", "latency", "error_rate", "probe_latency", "probe_failures"}
+
+type exprType int
+
+const (
+	typeNumber exprType = iota
+	typeBool
+)
+
+func (t exprType) String() string {
+	if t == typeBool {
+		return "boolean"
+	}
+	return "number"
+}
+
+// ExprError reports an error at a position (counted in bytes from 1) of the
+// expression.
+type ExprError struct {
+	Pos int
+	Msg string
+}
+
+func (e *ExprError) Error() string {
+	return fmt.Sprintf("position %d: %s", e.Pos, e.Msg)
+}
+
+type expr interface {
+	typ() exprType
+	pos() int
+}
+
+type numberExpr struct {
+	Pos   int
+	Value float64
+}
+
+type varExpr struct {
+	Pos  int
+	Name string
+}
+
+type unaryExpr struct {
+	Pos int
+	Op  string
+	X   expr
+}
+
+type binaryExpr struct {
+	Pos  int
+	Op   string
+	X, Y expr
+}
+
+func (e *numberExpr) typ() exprType { return typeNumber }
+func (e *varExpr) typ() exprType    { return typeNumber }
+
+func (e *unaryExpr) typ() exprType {
+	if e.Op == "!" {
+		return typeBool
+	}
+	return typeNumber
+}
+
+func (e *binaryExpr) typ() exprType {
+	switch e.Op {
+	case "+", "-", "*", "/":
+		return typeNumber
+	}
+	return typeBool
+}
+
+func (e *numberExpr) pos() int { return e.Pos }
+func (e *varExpr) pos() int    { return e.Pos }
+func (e *unaryExpr) pos() int  { return e.Pos }
+func (e *binaryExpr) pos() int { return e.X.pos() }
+
+type token struct {
+	Pos  int
+	Text string
+	Kind int
+}
+
+const (
+	tokenEOF = iota
+	tokenNumber
+	tokenIdent
+	tokenOp
+)
+
+func isDigit(c byte) bool  { return c >= '0' && c <= '9' }
+func isLetter(c byte) bool { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' }
+
+func tokenize(s string) ([]token, error) {
+	var r []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case isDigit(c) || c == '.':
+			j := i
+			for j < len(s) && (isDigit(s[j]) || s[j] == '.') {
+				j++
+			}
+			r = append(r, token{Pos: i + 1, Text: s[i:j], Kind: tokenNumber})
+			i = j
+			continue
+		case isLetter(c):
+			j := i
+			for j < len(s) && (isLetter(s[j]) || isDigit(s[j])) {
+				j++
+			}
+			r = append(r, token{Pos: i + 1, Text: s[i:j], Kind: tokenIdent})
+			i = j
+			continue
+		}
+
+		op := ""
+		if i+1 < len(s) {
+			switch s[i : i+2] {
+			case "||", "&&", "<=", ">=", "==", "!=":
+				op = s[i : i+2]
+			}
+		}
+		if op == "" {
+			switch c {
+			case '<', '>', '!', '+', '-', '*', '/', '(', ')':
+				op = s[i : i+1]
+			default:
+				return nil, &ExprError{i + 1, fmt.Sprintf("unexpected character %q", c)}
+			}
+		}
+		r = append(r, token{Pos: i + 1, Text: op, Kind: tokenOp})
+		i += len(op)
+	}
+	return append(r, token{Pos: len(s) + 1, Kind: tokenEOF}), nil
+}
+
+type parser struct {
+	tokens []token
+	next   int
+	// variables that can not be used, with the reason
+	unavailable map[string]string
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.next]
+}
+
+// accept consumes the next token if it is one of the operators ops.
+func (p *parser) accept(ops ...string) (token, bool) {
+	t := p.peek()
+	if t.Kind != tokenOp {
+		return t, false
+	}
+	for _, op := range ops {
+		if t.Text == op {
+			p.next++
+			return t, true
+		}
+	}
+	return t, false
+}
+
+func unexpected(t token) error {
+	if t.Kind == tokenEOF {
+		return &ExprError{t.Pos, "unexpected end of expression"}
+	}
+	return &ExprError{t.Pos, fmt.Sprintf("unexpected %q", t.Text)}
+}
+
+func expect(e expr, t exprType, op string) error {
+	if e.typ() != t {
+		return &ExprError{e.pos(), fmt.Sprintf("operand of %q should be a %s", op, t)}
+	}
+	return nil
+}
+
+// parseCondition parses a boolean expression over ExprVars; the variables in
+// unavailable are rejected, with the reason they map to.
+func parseCondition(s string, unavailable map[string]string) (expr, error) {
+	tokens, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens, unavailable: unavailable}
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.Kind != tokenEOF {
+		return nil, unexpected(t)
+	}
+	if e.typ() != typeBool {
+		return nil, &ExprError{e.pos(), "condition should be a boolean expression"}
+	}
+	return e, nil
+}
+
+// binary parses a left-associative sequence of operands of type t separated by
+// the operators ops.
+func (p *parser) binary(operand func() (expr, error), t exprType, ops ...string) (expr, error) {
+	x, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept(ops...)
+		if !ok {
+			return x, nil
+		}
+		if err := expect(x, t, op.Text); err != nil {
+			return nil, err
+		}
+		y, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		if err := expect(y, t, op.Text); err != nil {
+			return nil, err
+		}
+		x = &binaryExpr{Pos: op.Pos, Op: op.Text, X: x, Y: y}
+	}
+}
+
+func (p *parser) or() (expr, error) {
+	return p.binary(p.and, typeBool, "||")
+}
+
+func (p *parser) and() (expr, error) {
+	return p.binary(p.not, typeBool, "&&")
+}
+
+func (p *parser) not() (expr, error) {
+	if op, ok := p.accept("!"); ok {
+		x, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		if err := expect(x, typeBool, op.Text); err != nil {
+			return nil, err
+		}
+		return &unaryExpr{Pos: op.Pos, Op: op.Text, X: x}, nil
+	}
+	return p.cmp()
+}
+
+func (p *parser) cmp() (expr, error) {
+	x, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.accept("<", "<=", ">", ">=", "==", "!=")
+	if !ok {
+		return x, nil
+	}
+	if err := expect(x, typeNumber, op.Text); err != nil {
+		return nil, err
+	}
+	y, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	if err := expect(y, typeNumber, op.Text); err != nil {
+		return nil, err
+	}
+	if _, ok := p.accept("<", "<=", ">", ">=", "==", "!="); ok {
+		return nil, &ExprError{p.tokens[p.next-1].Pos, "comparisons can not be chained"}
+	}
+	return &binaryExpr{Pos: op.Pos, Op: op.Text, X: x, Y: y}, nil
+}
+
+func (p *parser) sum() (expr, error) {
+	return p.binary(p.term, typeNumber, "+", "-")
+}
+
+func (p *parser) term() (expr, error) {
+	return p.binary(p.factor, typeNumber, "*", "/")
+}
+
+func (p *parser) factor() (expr, error) {
+	t := p.peek()
+	switch t.Kind {
+	case tokenNumber:
+		p.next++
+		v, err := strconv.ParseFloat(t.Text, 64)
+		if err != nil {
+			return nil, &ExprError{t.Pos, fmt.Sprintf("invalid number %q", t.Text)}
+		}
+		return &numberExpr{Pos: t.Pos, Value: v}, nil
+	case tokenIdent:
+		p.next++
+		if reason, ok := p.unavailable[t.Text]; ok {
+			return nil, &ExprError{t.Pos, fmt.Sprintf("variable %q %s", t.Text, reason)}
+		}
+		for _, v := range ExprVars {
+			if t.Text == v {
+				return &varExpr{Pos: t.Pos, Name: t.Text}, nil
+			}
+		}
+		return nil, &ExprError{t.Pos, fmt.Sprintf("unknown variable %q", t.Text)}
+	}
+
+	if op, ok := p.accept("-"); ok {
+		x, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		if err := expect(x, typeNumber, op.Text); err != nil {
+			return nil, err
+		}
+		return &unaryExpr{Pos: op.Pos, Op: op.Text, X: x}, nil
+	}
+
+	if _, ok := p.accept("("); ok {
+		x, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.accept(")"); !ok {
+			return nil, &ExprError{p.peek().Pos, "missing \")\""}
+		}
+		return x, nil
+	}
+
+	return nil, unexpected(t)
+}
+
+// exprEnv returns the values of ExprVars for the app.
+func exprEnv(app App) map[string]float64 {
+	return map[string]float64{
+		MetricCpu:        float64(app.CpuAvg),
+		MetricMem:        float64(app.MemAvg),
+		MetricDisk:       float64(app.DiskAvg),
+		"instances":      float64(app.Instances),
+		"custom":         app.Custom,
+		"rps":            app.Rps,
+		"latency":        app.Latency.Seconds() * 1000,
+		"error_rate":     app.ErrorRate,
+		"probe_latency":  app.ProbeLatency.Seconds() * 1000,
+		"probe_failures": app.ProbeFailures,
+	}
+}
+
+// evalBool evaluates a type-checked boolean expression.
+func evalBool(e expr, env map[string]float64) bool {
+	switch e := e.(type) {
+	case *unaryExpr:
+		return !evalBool(e.X, env)
+	case *binaryExpr:
+		switch e.Op {
+		case "||":
+			return evalBool(e.X, env) || evalBool(e.Y, env)
+		case "&&":
+			return evalBool(e.X, env) && evalBool(e.Y, env)
+		}
+		x, y := evalNumber(e.X, env), evalNumber(e.Y, env)
+		switch e.Op {
+		case "<":
+			return x < y
+		case "<=":
+			return x <= y
+		case ">":
+			return x > y
+		case ">=":
+			return x >= y
+		case "==":
+			return x == y
+		case "!=":
+			return x != y
+		}
+	}
+	panic(fmt.Sprintf("not a boolean expression: %#v", e))
+}
+
+// evalNumber evaluates a type-checked numeric expression.
+func evalNumber(e expr, env map[string]float64) float64 {
+	switch e := e.(type) {
+	case *numberExpr:
+		return e.Value
+	case *varExpr:
+		return env[e.Name]
+	case *unaryExpr:
+		return -evalNumber(e.X, env)
+	case *binaryExpr:
+		x, y := evalNumber(e.X, env), evalNumber(e.Y, env)
+		switch e.Op {
+		case "+":
+			return x + y
+		case "-":
+			return x - y
+		case "*":
+			return x * y
+		case "/":
+			return x / y
+		}
+	}
+	panic(fmt.Sprintf("not a numeric expression: %#v", e))
+}
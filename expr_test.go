@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseCondition(t *testing.T) {
+	env := map[string]float64{"cpu": 75, "mem": 90, "disk": 40, "instances": 4}
+
+	tests := []struct {
+		expr string
+		exp  bool
+	}{
+		{"cpu > 70", true},
+		{"cpu >= 75 && cpu <= 75", true},
+		{"cpu < 70", false},
+		{"cpu > 80 || (mem > 85 && instances < 6)", true},
+		{"cpu > 80 || mem > 85 && instances < 4", false},
+		{"(cpu > 80 || mem > 85) && instances < 4", false},
+		{"!(disk > 50)", true},
+		{"!!(disk == 40) && disk != 41", true},
+		{"cpu + mem > 160", true},
+		{"cpu * instances / 5 > 60", false},
+		{"cpu - 2 * 5 == 65", true},
+		{"-cpu < -70.5", true},
+		{"\tcpu>70&&mem>70\n", true},
+	}
+
+	for _, test := range tests {
+		e, err := parseCondition(test.expr, nil)
+		if err != nil {
+			t.Fatalf("%q: %s", test.expr, err)
+		}
+		if r := evalBool(e, env); r != test.exp {
+			t.Fatalf("%q: got %v, expected %v", test.expr, r, test.exp)
+		}
+	}
+}
+
+func TestParseConditionErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		pos  int
+	}{
+		{"", 1},
+		{"cpu", 1},
+		{"cpu + 5", 1},
+		{"cpu > ", 7},
+		{"cpu > 70 ||", 12},
+		{"cpu > 70 | mem > 80", 10},
+		{"cpu > 70 && net > 10", 13},
+		{"cpu && mem > 80", 1},
+		{"cpu > 70 && 5", 13},
+		{"cpu > (mem > 80)", 8},
+		{"!cpu", 2},
+		{"-(cpu > 5) < 3", 3},
+		{"(cpu > 70", 10},
+		{"cpu > 70)", 9},
+		{"cpu > 7.0.1", 7},
+		{"0 < cpu < 70", 9},
+		{"cpu > 70 mem > 80", 10},
+		{"cpu = 70", 5},
+	}
+
+	for _, test := range tests {
+		_, err := parseCondition(test.expr, nil)
+		if err == nil {
+			t.Fatalf("%q: succeeded", test.expr)
+		}
+		if e, ok := err.(*ExprError); !ok || e.Pos != test.pos {
+			t.Fatalf("%q: wrong error %s, expected position %d", test.expr, err, test.pos)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// timeout of the requests reading metrics from sources other than the CF
+	// API
+	MetricsTimeout = 10 * time.Second
+	// at most this many apps have their metrics read from sources other than
+	// the CF API concurrently
+	MaxConcurrentReads = 8
+)
+
+// defaultMetricsClient is used when the autoscaler has no metrics client
+var defaultMetricsClient = &http.Client{Timeout: MetricsTimeout}
+
+// newMetricsClient returns the client reading metrics from sources other than
+// the CF API.
+func newMetricsClient(skipSslValidation bool) *http.Client {
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: &tls.Config{InsecureSkipVerify: skipSslValidation}}
+	return &http.Client{Timeout: MetricsTimeout, Transport: transport}
+}
+
+func (as *autoscaler) metricsClient() *http.Client {
+	if as.metrics != nil {
+		return as.metrics
+	}
+	return defaultMetricsClient
+}
+
+// externalMetrics holds the statistics of the queue and the values of the
+// custom metric of an app, or the errors reading them.
+type externalMetrics struct {
+	queue     QueueStats
+	queueErr  error
+	custom    []float64
+	customErr error
+}
+
+// readExternal reads the queues and custom metrics of the apps whose rules use
+// them, at most MaxConcurrentReads apps at a time, so that a slow source
+// delays the iteration once rather than once per app.
+func (as *autoscaler) readExternal(apps Apps) map[string]*externalMetrics {
+	r := make(map[string]*externalMetrics)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, MaxConcurrentReads)
+	for _, app := range apps {
+		rule, found := ruleFor(as.rules, app.App, app.Space, app.Org)
+		if !found || rule.Ratio > 0 || app.Stopped || rule.Queue == nil && rule.CustomMetric == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(rule Rule, app App) {
+			defer wg.Done()
+			slots <- struct{}{}
+			m := as.readExternalApp(rule, app)
+			<-slots
+			mu.Lock()
+			r[app.Guid] = m
+			mu.Unlock()
+		}(rule, app)
+	}
+	wg.Wait()
+	return r
+}
+
+// readExternalApp reads the queue and the custom metric of the rule for the
+// app.
+func (as *autoscaler) readExternalApp(rule Rule, app App) *externalMetrics {
+	m := &externalMetrics{}
+	if rule.Queue != nil {
+		m.queue, m.queueErr = readQueue(as.metricsClient(), *rule.Queue)
+	}
+	if rule.CustomMetric != nil {
+		m.custom, m.customErr = as.readCustomMetric(*rule.CustomMetric, app)
+	}
+	return m
+}
+
+// externalOf returns the metrics of the app read at the beginning of the
+// iteration, or reads them now if they were not.
+func (as *autoscaler) externalOf(rule Rule, app App) *externalMetrics {
+	if m := as.external[app.Guid]; m != nil {
+		return m
+	}
+	return as.readExternalApp(rule, app)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMetricsClient(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "queue_length 42")
+	}))
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	if _, err := scrape(newMetricsClient(false), server.URL, "", "queue_length", nil); err == nil {
+		t.Fatalf("scraped server with self-signed certificate")
+	}
+	values, err := scrape(newMetricsClient(true), server.URL, "", "queue_length", nil)
+	if err != nil || len(values) != 1 || values[0] != 42 {
+		t.Fatalf("scrape without ssl validation: %v %v", values, err)
+	}
+}
+
+func TestReadExternalConcurrently(t *testing.T) {
+	delay := 200 * time.Millisecond
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		fmt.Fprintln(w, "queue_length 500")
+	}))
+	defer server.Close()
+
+	var rules []Rule
+	apps := Apps{}
+	for i := 0; i < MaxConcurrentReads; i++ {
+		name, guid := fmt.Sprintf("a%d", i), fmt.Sprintf("guid-%d", i)
+		rules = append(rules, Rule{App: name, Space: "s", Org: "o", MinInstances: 3, MaxInstances: 10, CustomMetric: &CustomMetric{Metric: "queue_length", URL: server.URL, ScaleIn: 10, ScaleOut: 100}})
+		apps[guid] = App{App: name, Space: "s", Org: "o", Guid: guid, Instances: 4, InstancesRunning: 4}
+	}
+	if err := validateRules(rules); err != nil {
+		t.Fatalf("validateRules: %s", err)
+	}
+
+	buf := &bytes.Buffer{}
+	mock := &MockClient{Apps: apps}
+	as := &autoscaler{rules: rules, log: log.New(buf, "", log.Lshortfile), client: mock}
+	start := time.Now()
+	as.autoscaleApps()
+
+	if elapsed := time.Since(start); elapsed >= 2*delay {
+		t.Fatalf("metrics of %d apps read in %s", len(apps), elapsed)
+	}
+	if len(mock.ScaleCalls) != len(apps) {
+		t.Fatalf("wrong scale calls: %v\n%s", mock.ScaleCalls, buf.String())
+	}
+}
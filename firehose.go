@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+const (
+	// requests per second are averaged over this window
+	RpsWindow = time.Minute
+	// wait this long before reconnecting to the firehose
+	FirehoseRetryInterval = 10 * time.Second
+	// the connection to the firehose is considered lost if neither events nor
+	// pings are received for this long
+	FirehoseReadTimeout = time.Minute
+)
+
+// firehose counts the requests routed by the gorouter to each app, as seen in
+// the HttpStartStop events of the Loggregator firehose. It is safe to use it
+// concurrently.
+type firehose struct {
+	// clock returns the current time; if nil, time.Now is used
+	clock func() time.Time
+	// timeout is the read timeout; if zero, FirehoseReadTimeout is used
+	timeout time.Duration
+
+	mu sync.Mutex
+	// since when the firehose has been consumed without interruptions
+	since time.Time
+	// number of requests per app guid and unix second
+	counts map[string]map[int64]int
+	// unix second at which the apps without recent requests were last
+	// forgotten
+	pruned int64
+}
+
+func (f *firehose) now() time.Time {
+	if f.clock != nil {
+		return f.clock()
+	}
+	return time.Now()
+}
+
+// connected records that the firehose is being consumed from now on; the
+// requests counted before are discarded, as some may have been missed.
+func (f *firehose) connected() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.since = f.now()
+	f.counts = make(map[string]map[int64]int)
+}
+
+// record counts a request to the app, and forgets the counts older than
+// RpsWindow. At most once per RpsWindow, the apps that received no requests
+// within RpsWindow are forgotten too, so that the counts do not grow with
+// every app ever seen on the firehose.
+func (f *firehose) record(guid string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := f.now().Unix()
+	window := int64(RpsWindow / time.Second)
+	if f.counts == nil {
+		f.counts = make(map[string]map[int64]int)
+	}
+	c := f.counts[guid]
+	if c == nil {
+		c = make(map[int64]int)
+		f.counts[guid] = c
+	}
+	c[now]++
+	expire(c, now-window)
+
+	if now-f.pruned < window {
+		return
+	}
+	f.pruned = now
+	for g, c := range f.counts {
+		if expire(c, now-window); len(c) == 0 {
+			delete(f.counts, g)
+		}
+	}
+}
+
+// expire deletes the counts of the unix seconds up to before.
+func expire(counts map[int64]int, before int64) {
+	for s := range counts {
+		if s <= before {
+			delete(counts, s)
+		}
+	}
+}
+
+// rps returns the requests per second received by the app over the last
+// RpsWindow; ok is false if the firehose has not been consumed for that long.
+func (f *firehose) rps(guid string) (rps float64, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := f.now()
+	if f.since.IsZero() || now.Sub(f.since) < RpsWindow {
+		return 0, false
+	}
+	n := 0
+	for s, count := range f.counts[guid] {
+		if s > now.Unix()-int64(RpsWindow/time.Second) {
+			n += count
+		}
+	}
+	return float64(n) / RpsWindow.Seconds(), true
+}
+
+// stream consumes the firehose at url until an error occurs.
+func (f *firehose) stream(url string, token func() (string, error), tlsConfig *tls.Config) error {
+	t, err := token()
+	if err != nil {
+		return errors.Wrap(err, "get token")
+	}
+	timeout := f.timeout
+	if timeout == 0 {
+		timeout = FirehoseReadTimeout
+	}
+	dialer := websocket.Dialer{TLSClientConfig: tlsConfig, HandshakeTimeout: timeout}
+	ws, _, err := dialer.Dial(url, http.Header{"Authorization": {t}})
+	if err != nil {
+		return errors.Wrap(err, "connect")
+	}
+	defer ws.Close()
+	f.connected()
+
+	// a stalled connection would otherwise block the reads forever
+	ws.SetReadDeadline(time.Now().Add(timeout))
+	ws.SetPingHandler(func(data string) error {
+		ws.SetReadDeadline(time.Now().Add(timeout))
+		err := ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(timeout))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
+
+	for {
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			return errors.Wrap(err, "read")
+		}
+		ws.SetReadDeadline(time.Now().Add(timeout))
+		var e events.Envelope
+		if err := proto.Unmarshal(msg, &e); err != nil {
+			return errors.Wrap(err, "decode")
+		}
+		if e.GetEventType() != events.Envelope_HttpStartStop {
+			continue
+		}
+		// the apps themselves may emit events for the requests they serve
+		h := e.GetHttpStartStop()
+		if h.GetPeerType() == events.PeerType_Client && h.GetApplicationId() != nil {
+			f.record(guidOf(h.GetApplicationId()))
+		}
+	}
+}
+
+// guidOf formats the UUID of an app as its guid.
+func guidOf(id *events.UUID) string {
+	var b [16]byte
+	binary.LittleEndian.PutUint64(b[:8], id.GetLow())
+	binary.LittleEndian.PutUint64(b[8:], id.GetHigh())
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// consume consumes the firehose at url forever, reconnecting after errors.
+// token returns the value of the Authorization header, e.g. "bearer ...".
+func (f *firehose) consume(url string, token func() (string, error), tlsConfig *tls.Config, logger *log.Logger) {
+	for {
+		logger.Printf("consuming firehose %s", url)
+		err := f.stream(url, token, tlsConfig)
+		logger.Print(errors.Wrap(err, "consume firehose"))
+		f.mu.Lock()
+		f.since = time.Time{}
+		f.mu.Unlock()
+		time.Sleep(FirehoseRetryInterval)
+	}
+}
+
+// requestRate returns the app with Rps set to the requests per second per
+// running instance.
+func (as *autoscaler) requestRate(app App) (App, error) {
+	if as.traffic == nil {
+		return app, errors.New("firehose not consumed")
+	}
+	rps, ok := as.traffic.rps(app.Guid)
+	if !ok {
+		return app, errors.Errorf("firehose not consumed for %s yet", RpsWindow)
+	}
+	if app.InstancesRunning > 0 {
+		app.Rps = rps / float64(app.InstancesRunning)
+	}
+	as.log.Printf("autoscale app %v: %.1f requests per second, %.1f per instance", app, rps, app.Rps)
+	return app, nil
+}
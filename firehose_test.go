@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+// envelope encodes a dropsonde envelope with an HttpStartStop event.
+func envelope(guid string, peerType events.PeerType) []byte {
+	b, err := hex.DecodeString(strings.Replace(guid, "-", "", -1))
+	if err != nil || len(b) != 16 {
+		panic("invalid guid " + guid)
+	}
+	id := &events.UUID{Low: proto.Uint64(binary.LittleEndian.Uint64(b[:8])), High: proto.Uint64(binary.LittleEndian.Uint64(b[8:]))}
+	e := &events.Envelope{
+		Origin:    proto.String("gorouter"),
+		EventType: events.Envelope_HttpStartStop.Enum(),
+		Timestamp: proto.Int64(1500000000000000000),
+		HttpStartStop: &events.HttpStartStop{
+			StartTimestamp: proto.Int64(1500000000000000000),
+			StopTimestamp:  proto.Int64(1500000000100000000),
+			RequestId:      &events.UUID{Low: proto.Uint64(1), High: proto.Uint64(2)},
+			PeerType:       peerType.Enum(),
+			Method:         events.Method_GET.Enum(),
+			Uri:            proto.String("https://a.example.com/"),
+			RemoteAddress:  proto.String("10.0.0.1:5000"),
+			UserAgent:      proto.String("curl"),
+			StatusCode:     proto.Int32(200),
+			ContentLength:  proto.Int64(0),
+			ApplicationId:  id,
+		},
+	}
+	msg, err := proto.Marshal(e)
+	if err != nil {
+		panic(err)
+	}
+	return msg
+}
+
+func TestGuidOf(t *testing.T) {
+	guid := "6f1c4a2e-93b1-4d7a-8c55-0e2b9f3d1a77"
+	var e events.Envelope
+	if err := proto.Unmarshal(envelope(guid, events.PeerType_Client), &e); err != nil {
+		t.Fatalf("unmarshal: %s", err)
+	}
+	if g := guidOf(e.GetHttpStartStop().GetApplicationId()); g != guid {
+		t.Fatalf("wrong guid: %s", g)
+	}
+	if g := guidOf(&events.UUID{Low: proto.Uint64(1), High: proto.Uint64(0)}); g != "01000000-0000-0000-0000-000000000000" {
+		t.Fatalf("wrong guid: %s", g)
+	}
+}
+
+// ping is sent as a ping by firehoseServer.
+var ping = []byte("ping")
+
+// firehoseServer returns a stand-in for the firehose that sends the messages
+// to clients presenting the token, and then closes the websocket, or leaves it
+// open without sending anything if stall is set. The payloads of the pongs
+// received are sent to pongs.
+func firehoseServer(token string, messages [][]byte, stall bool, pongs chan<- string) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != token {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/firehose/sub" {
+			http.NotFound(w, r)
+			return
+		}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		ws.SetPongHandler(func(data string) error {
+			pongs <- data
+			return nil
+		})
+		// the pongs are handled while reading
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			for {
+				if _, _, err := ws.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+
+		for i, m := range messages {
+			if bytes.Equal(m, ping) {
+				ws.WriteControl(websocket.PingMessage, []byte(strconv.Itoa(i)), time.Now().Add(time.Second))
+				time.Sleep(50 * time.Millisecond)
+				continue
+			}
+			ws.WriteMessage(websocket.BinaryMessage, m)
+		}
+		if !stall {
+			ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		}
+		<-closed
+	}))
+}
+
+func TestFirehosePrune(t *testing.T) {
+	now := time.Date(2017, 3, 1, 7, 0, 0, 0, time.UTC)
+	f := &firehose{clock: func() time.Time { return now }}
+	f.connected()
+
+	f.record("a")
+	f.record("b")
+	now = now.Add(RpsWindow / 2)
+	f.record("b")
+	now = now.Add(RpsWindow / 2)
+	f.record("c")
+	if len(f.counts) != 2 || f.counts["a"] != nil || len(f.counts["b"]) != 1 {
+		t.Fatalf("apps without requests within the window not forgotten: %v", f.counts)
+	}
+	if rps, ok := f.rps("b"); !ok || rps != 1/RpsWindow.Seconds() {
+		t.Fatalf("wrong request rate: %g %v", rps, ok)
+	}
+
+	// the apps are forgotten at most once per window
+	now = now.Add(RpsWindow)
+	f.record("c")
+	now = now.Add(time.Second)
+	f.record("d")
+	if len(f.counts) != 2 || f.counts["b"] != nil || len(f.counts["c"]) != 1 {
+		t.Fatalf("wrong counts: %v", f.counts)
+	}
+	now = now.Add(RpsWindow)
+	f.record("d")
+	if len(f.counts) != 1 || len(f.counts["d"]) != 1 {
+		t.Fatalf("wrong counts: %v", f.counts)
+	}
+}
+
+func TestFirehoseStream(t *testing.T) {
+	a, b := "6f1c4a2e-93b1-4d7a-8c55-0e2b9f3d1a77", "0a0b0c0d-0e0f-1011-1213-141516171819"
+	logMessage, err := proto.Marshal(&events.Envelope{
+		Origin:     proto.String("rep"),
+		EventType:  events.Envelope_LogMessage.Enum(),
+		LogMessage: &events.LogMessage{Message: []byte("hello"), MessageType: events.LogMessage_OUT.Enum(), Timestamp: proto.Int64(1500000000000000000)},
+	})
+	if err != nil {
+		t.Fatalf("marshal: %s", err)
+	}
+	messages := [][]byte{
+		envelope(a, events.PeerType_Client),
+		ping,
+		envelope(a, events.PeerType_Client),
+		// emitted by the app, not by the gorouter
+		envelope(a, events.PeerType_Server),
+		logMessage,
+		envelope(b, events.PeerType_Client),
+	}
+	pongs := make(chan string, 1)
+	server := firehoseServer("bearer token", messages, false, pongs)
+	defer server.Close()
+
+	f := &firehose{}
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/firehose/sub"
+	err = f.stream(url, func() (string, error) { return "bearer token", nil }, nil)
+	if !websocket.IsCloseError(errors.Cause(err), websocket.CloseNormalClosure) {
+		t.Fatalf("stream: %v", err)
+	}
+	if pong := <-pongs; pong != "1" {
+		t.Fatalf("wrong pong: %q", pong)
+	}
+
+	count := func(guid string) int {
+		n := 0
+		for _, c := range f.counts[guid] {
+			n += c
+		}
+		return n
+	}
+	if count(a) != 2 || count(b) != 1 {
+		t.Fatalf("wrong counts: %v", f.counts)
+	}
+
+	if err := f.stream(url, func() (string, error) { return "bearer wrong", nil }, nil); err == nil {
+		t.Fatalf("stream with wrong token succeeded")
+	}
+	if err := f.stream(url, func() (string, error) { return "", errors.New("no token") }, nil); err == nil {
+		t.Fatalf("stream without token succeeded")
+	}
+}
+
+func TestFirehoseStall(t *testing.T) {
+	// the pings keep the connection alive for 500ms
+	messages := [][]byte{envelope(guid, events.PeerType_Client)}
+	for i := 0; i < 10; i++ {
+		messages = append(messages, ping)
+	}
+	pongs := make(chan string, len(messages))
+	server := firehoseServer("bearer token", messages, true, pongs)
+	defer server.Close()
+
+	f := &firehose{timeout: 200 * time.Millisecond}
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/firehose/sub"
+	start := time.Now()
+	err := f.stream(url, func() (string, error) { return "bearer token", nil }, nil)
+	if e, ok := errors.Cause(err).(net.Error); !ok || !e.Timeout() {
+		t.Fatalf("stream: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Fatalf("timed out after %s despite the pings", elapsed)
+	}
+	if len(f.counts[guid]) != 1 {
+		t.Fatalf("wrong counts: %v", f.counts)
+	}
+}
+
+func TestRequestRateScaling(t *testing.T) {
+	rules := []Rule{
+		Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 10, ScaleInRps: 5, ScaleOutRps: 20},
+	}
+	if err := validateRules(rules); err != nil {
+		t.Fatalf("validateRules: %s", err)
+	}
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+	f := &firehose{clock: clock}
+	f.connected()
+
+	tests := []struct {
+		elapsed time.Duration // since the previous iteration
+		rps     int           // requests per second during the elapsed time
+		exp     int           // 0 if not scaled
+	}{
+		// not enough data yet
+		{30 * time.Second, 100, 0},
+		// 100 rps, 25 per instance
+		{30 * time.Second, 100, 5},
+		{30 * time.Second, 30, 0},
+		{30 * time.Second, 10, 3},
+	}
+
+	for i, test := range tests {
+		for s := 0; s < int(test.elapsed/time.Second); s++ {
+			now = now.Add(time.Second)
+			for r := 0; r < test.rps; r++ {
+				f.record(guid)
+			}
+		}
+
+		buf := &bytes.Buffer{}
+		as := &autoscaler{rules: rules, log: log.New(buf, "", log.Lshortfile), clock: clock, traffic: f}
+		mock := &MockClient{Apps: Apps{guid: App{App: "a", Space: "s", Org: "o", Guid: guid, Instances: 4, InstancesRunning: 4}}}
+		as.client = mock
+		as.autoscaleApps()
+
+		switch {
+		case test.exp == 0 && mock.ScaleDesired != nil:
+			t.Fatalf("%d: scaled to %d\n%s", i, *mock.ScaleDesired, buf.String())
+		case test.exp != 0 && (mock.ScaleDesired == nil || *mock.ScaleDesired != test.exp):
+			t.Fatalf("%d: not scaled to %d\n%s", i, test.exp, buf.String())
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// round the number of instances of followers up, down or to the nearest integer
+	RoundingUp      = "up"
+	RoundingDown    = "down"
+	RoundingNearest = "nearest"
+)
+
+// validateGroups checks that each group has exactly one driver, i.e. a rule
+// without ratio; the other rules of the group follow it.
+func validateGroups(rules []Rule) error {
+	drivers := map[string]int{}
+	for _, rule := range rules {
+		if rule.Group == "" {
+			continue
+		}
+		if _, found := drivers[rule.Group]; !found {
+			drivers[rule.Group] = 0
+		}
+		if rule.Ratio == 0 {
+			drivers[rule.Group]++
+		}
+	}
+	for group, n := range drivers {
+		if n != 1 {
+			return errors.Errorf("group %q should have exactly one driver rule (without ratio), found %d", group, n)
+		}
+	}
+	return nil
+}
+
+// followerInstances returns the number of instances of a follower when the
+// driver of its group has driver instances.
+func followerInstances(rule Rule, driver int) int {
+	// tolerate the rounding errors of ratios like 0.333
+	const epsilon = 1e-6
+	x := float64(driver) * rule.Ratio
+	var n int
+	switch rule.Rounding {
+	case RoundingDown:
+		n = int(math.Floor(x + epsilon))
+	case RoundingNearest:
+		n = int(math.Floor(x + 0.5))
+	default:
+		n = int(math.Ceil(x - epsilon))
+	}
+	switch {
+	case n < rule.MinInstances:
+		n = rule.MinInstances
+	case n > rule.MaxInstances:
+		n = rule.MaxInstances
+	}
+	return n
+}
+
+// appFor returns the app the rule applies to.
+func appFor(apps Apps, rule Rule) (App, bool) {
+	for _, app := range apps {
+		if app.App == rule.App && app.Space == rule.Space && app.Org == rule.Org {
+			return app, true
+		}
+	}
+	return App{}, false
+}
+
+// scaleGroup scales the driver app to desired instances, and its followers
+// according to their ratios. If scaling one of the apps fails, the apps that
+// were already scaled are scaled back.
+func (as *autoscaler) scaleGroup(rule Rule, app App, desired int, apps Apps) error {
+	type member struct {
+		App     App
+		Desired int
+	}
+	members := []member{{app, desired}}
+
+	for _, r := range as.rules {
+		if r.Group != rule.Group || r.Ratio == 0 {
+			continue
+		}
+		f, found := appFor(apps, r)
+		switch {
+		case !found:
+			return errors.Errorf("group %s: app %s not found", rule.Group, ruleKey(r))
+		case f.Instances != f.InstancesRunning:
+			return errors.Errorf("group %s: app %v: number of running instances differs from desired: %d/%d", rule.Group, f, f.InstancesRunning, f.Instances)
+		}
+		members = append(members, member{f, followerInstances(r, desired)})
+	}
+
+	var scaled []member
+	for _, m := range members {
+		if m.Desired == m.App.Instances {
+			continue
+		}
+		as.log.Printf("autoscale group %s: scaling app %v to %d instances", rule.Group, m.App, m.Desired)
+		if err := as.client.Scale(m.App, m.Desired); err != nil {
+			for _, s := range scaled {
+				as.log.Printf("autoscale group %s: rolling back app %v to %d instances", rule.Group, s.App, s.App.Instances)
+				if err := as.client.Scale(s.App, s.App.Instances); err != nil {
+					as.log.Print(errors.Wrapf(err, "autoscale group %s: roll back app %v", rule.Group, s.App))
+				}
+			}
+			return errors.Wrapf(err, "group %s: scale app %v", rule.Group, m.App)
+		}
+		scaled = append(scaled, m)
+	}
+
+	for _, s := range scaled {
+		as.scaled(s.App, s.Desired)
+	}
+	return nil
+}
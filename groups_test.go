@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestValidateGroups(t *testing.T) {
+	driver := Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 20, MinCpu: 40, MaxCpu: 60, Group: "g"}
+	follower := Rule{App: "b", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 20, Group: "g", Ratio: 0.5}
+
+	tests := []struct {
+		rules []Rule
+		ok    bool
+	}{
+		{[]Rule{driver}, true},
+		{[]Rule{driver, follower}, true},
+		{[]Rule{follower, driver}, true},
+		{[]Rule{follower}, false},
+		{[]Rule{driver, follower, Rule{App: "c", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 20, MinCpu: 40, MaxCpu: 60, Group: "g"}}, false},
+		{[]Rule{driver, Rule{App: "c", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 20, Group: "h", Ratio: 2}}, false},
+	}
+
+	for idx, test := range tests {
+		if err := validateRules(test.rules); (err == nil) != test.ok {
+			t.Fatalf("test %d: got %v", idx, err)
+		}
+	}
+
+	// followers can not define the options of the rules scaled on their own
+	options := []func(r *Rule){
+		func(r *Rule) { r.Policy = PolicyThreshold },
+		func(r *Rule) { r.ScaleInCooldown = Duration(time.Minute) },
+		func(r *Rule) { r.Predictive = &Predictive{Horizon: Duration(time.Hour), TargetCpu: 50} },
+		func(r *Rule) {
+			r.Schedules = []Schedule{{Cron: "0 8 * * *", Duration: Duration(time.Hour), MinInstances: 4}}
+		},
+		func(r *Rule) { r.RestartOutliersAfter, r.MaxRestartsPerHour = 3, 1 },
+		func(r *Rule) { r.Idle = &Idle{After: Duration(time.Hour)} },
+		func(r *Rule) { r.MinMemoryMB, r.MaxMemoryMB, r.ScaleUpMem = 256, 1024, 80 },
+		func(r *Rule) {
+			r.Queue = &Queue{Name: "q", MessagesPerInstance: 100, ManagementURL: "https://rabbitmq.example.com/api"}
+		},
+		func(r *Rule) { r.ScaleInRps, r.ScaleOutRps = 10, 100 },
+		func(r *Rule) { r.Probe = &Probe{ScaleIn: Duration(time.Second), ScaleOut: Duration(2 * time.Second)} },
+	}
+	for idx, option := range options {
+		d, f := driver, follower
+		option(&d)
+		option(&f)
+		if err := validateRules([]Rule{d, follower}); err != nil {
+			t.Fatalf("option %d: driver rejected: %s", idx, err)
+		}
+		if err := validateRules([]Rule{driver, f}); err == nil {
+			t.Fatalf("option %d: follower accepted: %+v", idx, f)
+		}
+	}
+}
+
+func TestFollowerInstances(t *testing.T) {
+	tests := []struct {
+		ratio    float64
+		rounding string
+		driver   int
+		exp      int
+	}{
+		{0.5, "", 4, 2},
+		{0.5, "", 5, 3},
+		{0.5, RoundingUp, 5, 3},
+		{0.5, RoundingDown, 5, 2},
+		{0.5, RoundingNearest, 5, 3},
+		{0.4, RoundingNearest, 5, 2},
+		{0.333, RoundingUp, 3, 1},
+		// 0.999 rounded down, raised to the min instances
+		{0.333, RoundingDown, 3, 1},
+		{0.333, RoundingDown, 6, 1},
+		{2, "", 3, 6},
+		// clamped to the bounds of the follower
+		{0.1, RoundingDown, 3, 1},
+		{3, "", 5, 12},
+	}
+
+	for i, test := range tests {
+		rule := Rule{MinInstances: 1, MaxInstances: 12, Ratio: test.ratio, Rounding: test.rounding}
+		if n := followerInstances(rule, test.driver); n != test.exp {
+			t.Fatalf("%d: got %d, expected %d", i, n, test.exp)
+		}
+	}
+}
+
+func TestGroupScaling(t *testing.T) {
+	rules := []Rule{
+		Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 20, MinCpu: 20, MaxCpu: 80, Group: "g"},
+		Rule{App: "b", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 20, Group: "g", Ratio: 0.5},
+	}
+	if err := validateRules(rules); err != nil {
+		t.Fatalf("validateRules: %s", err)
+	}
+
+	tests := []struct {
+		cpu      int
+		driver   int
+		follower int
+		running  int // running instances of the follower
+		scaleErr string
+		exp      []string
+		scaled   bool // the driver was recorded as scaled
+	}{
+		{50, 8, 4, 4, "", nil, false},
+		// the follower is brought to its ratio even if the driver is not scaled
+		{50, 8, 5, 5, "", []string{"b:4"}, false},
+		{90, 8, 4, 4, "", []string{"a:9", "b:5"}, true},
+		// 3.5 rounded up
+		{10, 8, 4, 4, "", []string{"a:7"}, true},
+		// followers must be stable before scaling the group
+		{90, 8, 4, 3, "", nil, false},
+		// the driver is scaled back if the follower can not be scaled
+		{90, 8, 4, 4, "b", []string{"a:9", "b:5", "a:8"}, false},
+		{90, 8, 4, 4, "a", []string{"a:9"}, false},
+	}
+
+	for i, test := range tests {
+		buf := &bytes.Buffer{}
+		as := &autoscaler{rules: rules, log: log.New(buf, "", log.Lshortfile), clock: time.Now}
+		mock := &MockClient{Apps: Apps{
+			"a": App{App: "a", Space: "s", Org: "o", Guid: "a", Instances: test.driver, InstancesRunning: test.driver, CpuAvg: test.cpu},
+			"b": App{App: "b", Space: "s", Org: "o", Guid: "b", Instances: test.follower, InstancesRunning: test.running},
+		}}
+		if test.scaleErr != "" {
+			mock.ScaleError, mock.ScaleErrorGuid = errors.New("scale failed"), test.scaleErr
+		}
+		as.client = mock
+		as.autoscaleApps()
+
+		if !reflect.DeepEqual(mock.ScaleCalls, test.exp) {
+			t.Fatalf("%d: got %v, expected %v\n%s", i, mock.ScaleCalls, test.exp, buf.String())
+		}
+		if _, found := as.cooldowns["a"]; found != test.scaled {
+			t.Fatalf("%d: wrong cooldown of the driver\n%s", i, buf.String())
+		}
+	}
+}
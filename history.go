@@ -0,0 +1,97 @@
+package main
+
+import (
+	"time"
+)
+
+type sample struct {
+	Time time.Time
+	App  App
+}
+
+func (as *autoscaler) now() time.Time {
+	if as.clock != nil {
+		return as.clock()
+	}
+	return time.Now()
+}
+
+// record adds the current state of the app to its history, discards the
+// samples older than HistoryLength and returns the updated history.
+func (as *autoscaler) record(app App) []sample {
+	if as.history == nil {
+		as.history = make(map[string][]sample)
+	}
+
+	now := as.now()
+	history := as.history[app.Guid]
+	for len(history) > 0 && now.Sub(history[0].Time) > HistoryLength {
+		history = history[1:]
+	}
+	history = append(history, sample{Time: now, App: app})
+
+	as.history[app.Guid] = history
+	return history
+}
+
+// forget discards the per-app state (history, cooldowns, models, controllers,
+// reapers, idlers and resizes) of the apps that do not exist anymore.
+func (as *autoscaler) forget(apps Apps) {
+	for guid := range as.history {
+		if _, found := apps[guid]; !found {
+			delete(as.history, guid)
+		}
+	}
+	for guid := range as.cooldowns {
+		if _, found := apps[guid]; !found {
+			delete(as.cooldowns, guid)
+		}
+	}
+	for guid := range as.predictors {
+		if _, found := apps[guid]; !found {
+			delete(as.predictors, guid)
+		}
+	}
+	for guid := range as.controllers {
+		if _, found := apps[guid]; !found {
+			delete(as.controllers, guid)
+		}
+	}
+	for guid := range as.reapers {
+		if _, found := apps[guid]; !found {
+			delete(as.reapers, guid)
+		}
+	}
+	for guid := range as.idlers {
+		if _, found := apps[guid]; !found {
+			delete(as.idlers, guid)
+		}
+	}
+	for guid, r := range as.resizes {
+		// clones are reconciled even if their app does not exist anymore
+		if _, found := apps[guid]; !found && r.Clone.Guid == "" {
+			delete(as.resizes, guid)
+		}
+	}
+}
+
+// sustained returns true if, for at least the duration of the window, all the
+// samples in the history led to scaling in the direction dir (1 for scale-out,
+// -1 for scale-in).
+func sustained(rule Rule, history []sample, window time.Duration, dir int) bool {
+	if window == 0 {
+		return true
+	}
+
+	last := history[len(history)-1].Time
+	for i := len(history) - 1; i >= 0; i-- {
+		desired, err := decide(rule, history[i].App)
+		if err != nil || (desired-history[i].App.Instances)*dir <= 0 {
+			return false
+		}
+		if last.Sub(history[i].Time) >= window {
+			return true
+		}
+	}
+	return false
+}
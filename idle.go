@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// environment variable holding, on the apps stopped because they were idle,
+// the time they were stopped at
+const IdleMarkerEnv = "SIMPLE_AUTOSCALER_STOPPED_AT"
+
+// Idle configures the idle mode: an app whose cpu load (and request rate, if
+// the firehose is consumed) stays at or below cpu (and rps) for the after
+// period is stopped, and it is started again when the wake-up cron expression
+// matches or when a wake-up is requested via HTTP.
+type Idle struct {
+	After    Duration `json:"after"`
+	Cpu      int      `json:"cpu"`
+	Rps      float64  `json:"rps"`
+	WakeUp   string   `json:"wake_up"`
+	TimeZone string   `json:"time_zone"`
+}
+
+func validateIdle(i Idle) error {
+	switch {
+	case i.After <= 0:
+		return errors.New("idle period should be > 0")
+	case i.Cpu < 0 || i.Cpu > 100:
+		return errors.New("idle cpu load should be in the range 0<=t<=100")
+	case i.Rps < 0:
+		return errors.New("idle request rate should be >= 0")
+	}
+	if i.WakeUp != "" {
+		if _, err := parseCron(i.WakeUp); err != nil {
+			return errors.Wrap(err, "parse idle wake-up cron expression")
+		}
+	}
+	if _, err := time.LoadLocation(i.TimeZone); err != nil {
+		return errors.Wrap(err, "load idle time zone")
+	}
+	return nil
+}
+
+// idler tracks since when an app has been idle, when it was stopped and when
+// it must be woken up
+type idler struct {
+	Since   time.Time
+	Stopped time.Time
+	WakeUp  time.Time
+}
+
+// stopped records that the app was stopped at time t, and computes the next
+// time the wake-up cron expression matches, if any.
+func (i *idler) stopped(idle Idle, t time.Time) {
+	i.Since, i.Stopped, i.WakeUp = time.Time{}, t, time.Time{}
+	if idle.WakeUp == "" {
+		return
+	}
+	c, _ := parseCron(idle.WakeUp)
+	loc, _ := time.LoadLocation(idle.TimeZone)
+	if next, ok := c.next(t.In(loc)); ok {
+		i.WakeUp = next
+	}
+}
+
+func ruleKey(rule Rule) string {
+	return fmt.Sprintf("%s/%s/%s", rule.Org, rule.Space, rule.App)
+}
+
+// requestWakeUp records a wake-up request for the app of the rule; it is safe
+// to call it concurrently with the autoscaler loop.
+func (as *autoscaler) requestWakeUp(rule Rule) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if as.wakeUps == nil {
+		as.wakeUps = make(map[string]bool)
+	}
+	as.wakeUps[ruleKey(rule)] = true
+}
+
+// wakeUpRequested returns true, and forgets the request, if a wake-up was
+// requested for the app of the rule.
+func (as *autoscaler) wakeUpRequested(rule Rule) bool {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	requested := as.wakeUps[ruleKey(rule)]
+	delete(as.wakeUps, ruleKey(rule))
+	return requested
+}
+
+// idle stops the app if it has been idle for long enough, or starts it if it
+// was stopped and it is time to wake it up. If handled is true the app must
+// not be scaled in this iteration.
+//
+// Idleness is based on the cpu load and, if the firehose is consumed, on the
+// request rate.
+func (as *autoscaler) idle(rule Rule, app App) (handled bool, err error) {
+	if as.idlers == nil {
+		as.idlers = make(map[string]*idler)
+	}
+	i := as.idlers[app.Guid]
+	if i == nil {
+		i = &idler{}
+		as.idlers[app.Guid] = i
+	}
+
+	now := as.now()
+	requested := as.wakeUpRequested(rule)
+
+	if app.Stopped {
+		if app.StoppedIdle.IsZero() {
+			// not stopped by simple-autoscaler: left alone
+			delete(as.idlers, app.Guid)
+			if requested {
+				as.log.Printf("autoscale app %v: not waking up app, not stopped because idle", app)
+			}
+			return false, nil
+		}
+		if i.Stopped.IsZero() {
+			// stopped before simple-autoscaler was restarted
+			i.stopped(*rule.Idle, app.StoppedIdle)
+		}
+
+		reason := ""
+		if requested {
+			reason = "wake-up requested"
+		} else if !i.WakeUp.IsZero() && !now.Before(i.WakeUp) {
+			reason = "wake-up schedule matched"
+		}
+		if reason == "" {
+			as.log.Printf("autoscale app %v: stopped since %s", app, i.Stopped.Format(time.RFC3339))
+			return true, nil
+		}
+
+		as.log.Printf("autoscale app %v: starting app, %s", app, reason)
+		if err := as.client.Start(app); err != nil {
+			return true, errors.Wrap(err, "start app")
+		}
+		delete(as.idlers, app.Guid)
+		return true, nil
+	}
+	i.Stopped, i.WakeUp = time.Time{}, time.Time{}
+
+	active := requested || app.Instances != app.InstancesRunning || app.Warming > 0 || app.CpuAvg > rule.Idle.Cpu
+	for _, s := range rule.Schedules {
+		active = active || s.active(now)
+	}
+	if !active && as.traffic != nil {
+		// the app is not idle until the request rate is known
+		rps, ok := as.traffic.rps(app.Guid)
+		active = !ok || rps > rule.Idle.Rps
+	}
+	if active {
+		if !i.Since.IsZero() {
+			as.log.Printf("autoscale app %v: not idle anymore", app)
+			i.Since = time.Time{}
+		}
+		return false, nil
+	}
+
+	if i.Since.IsZero() {
+		as.log.Printf("autoscale app %v: idle, stopping it in %s", app, rule.Idle.After)
+		i.Since = now
+		return false, nil
+	}
+	if now.Sub(i.Since) < time.Duration(rule.Idle.After) {
+		return false, nil
+	}
+
+	as.log.Printf("autoscale app %v: stopping app, idle for %s", app, now.Sub(i.Since))
+	if err := as.client.Stop(app, now); err != nil {
+		return true, errors.Wrap(err, "stop app")
+	}
+	i.stopped(*rule.Idle, now)
+	return true, nil
+}
+
+// wakeUpHandler serves POST /wake-up?org=o&space=s&app=a requests, that must
+// carry the token in an "Authorization: Bearer" header.
+func (as *autoscaler) wakeUpHandler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		q := r.URL.Query()
+		rule, found := ruleFor(as.rules, q.Get("app"), q.Get("space"), q.Get("org"))
+		if !found || rule.Idle == nil {
+			http.Error(w, "no rule with idle mode for the app", http.StatusNotFound)
+			return
+		}
+
+		as.log.Printf("wake-up requested for app %s", ruleKey(rule))
+		as.requestWakeUp(rule)
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
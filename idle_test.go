@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIdle(t *testing.T) {
+	rules := []Rule{
+		Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 10, MinCpu: 20, MaxCpu: 80, Idle: &Idle{After: Duration(2 * time.Minute), WakeUp: "0 8 * * *"}},
+	}
+	if err := validateRules(rules); err != nil {
+		t.Fatalf("validateRules: %s", err)
+	}
+
+	tests := []struct {
+		stopped bool
+		cpu     int
+		wakeUp  bool
+		stop    bool
+		start   bool
+	}{
+		{false, 0, false, false, false},
+		{false, 0, false, false, false},
+		// activity resets the idle period
+		{false, 10, false, false, false},
+		{false, 0, false, false, false},
+		{false, 0, false, false, false},
+		{false, 0, false, false, false},
+		{false, 0, false, false, false},
+		{false, 0, false, true, false},
+		{true, 0, false, false, false},
+		{true, 0, true, false, true},
+		{false, 0, false, false, false},
+		// a wake-up request resets the idle period
+		{false, 0, true, false, false},
+		{false, 0, false, false, false},
+		{false, 0, false, false, false},
+		{false, 0, false, false, false},
+		{false, 0, false, false, false},
+		{false, 0, false, true, false},
+		{true, 0, false, false, false},
+	}
+
+	now := time.Date(2017, 3, 1, 7, 0, 0, 0, time.UTC)
+	buf := &bytes.Buffer{}
+	as := &autoscaler{rules: rules, log: log.New(buf, "", log.Lshortfile), clock: func() time.Time { return now }}
+	var stoppedAt time.Time
+
+	for i, test := range tests {
+		now = now.Add(Interval)
+		app := App{App: "a", Space: "s", Org: "o", Guid: guid, Instances: 3, InstancesRunning: 3, CpuAvg: test.cpu}
+		if test.stopped {
+			app = App{App: "a", Space: "s", Org: "o", Guid: guid, Stopped: true, StoppedIdle: stoppedAt}
+		}
+		if test.wakeUp {
+			as.requestWakeUp(rules[0])
+		}
+		mock := &MockClient{Apps: Apps{guid: app}}
+		as.client = mock
+		as.autoscaleApps()
+
+		if (mock.StopApp != nil) != test.stop || (mock.StartApp != nil) != test.start || mock.ScaleDesired != nil {
+			t.Fatalf("%d: wrong calls: stop %v start %v scale %v\n%s", i, mock.StopApp != nil, mock.StartApp != nil, mock.ScaleDesired, buf.String())
+		}
+		if mock.StopApp != nil {
+			stoppedAt = mock.StopTime
+		}
+	}
+
+	// the wake-up schedule starts the app
+	for i := 0; ; i++ {
+		now = now.Add(Interval)
+		mock := &MockClient{Apps: Apps{guid: App{App: "a", Space: "s", Org: "o", Guid: guid, Stopped: true, StoppedIdle: stoppedAt}}}
+		as.client = mock
+		as.autoscaleApps()
+
+		if mock.StartApp != nil {
+			if now.Before(time.Date(2017, 3, 1, 8, 0, 0, 0, time.UTC)) || now.After(time.Date(2017, 3, 1, 8, 1, 0, 0, time.UTC)) {
+				t.Fatalf("started at %s\n%s", now, buf.String())
+			}
+			break
+		} else if i > 200 {
+			t.Fatalf("not started at %s\n%s", now, buf.String())
+		}
+	}
+}
+
+func TestIdleStoppedApps(t *testing.T) {
+	rules := []Rule{
+		Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 10, MinCpu: 20, MaxCpu: 80, Idle: &Idle{After: Duration(2 * time.Minute), WakeUp: "0 8 * * *"}},
+	}
+	if err := validateRules(rules); err != nil {
+		t.Fatalf("validateRules: %s", err)
+	}
+
+	tests := []struct {
+		stoppedIdle time.Time // zero if the app was not stopped because idle
+		wakeUp      bool
+		start       bool
+	}{
+		// apps stopped by someone else are not woken up
+		{time.Time{}, false, false},
+		{time.Time{}, true, false},
+		// apps stopped because idle are woken up after a restart, when the
+		// wake-up schedule matched since they were stopped
+		{time.Date(2017, 3, 1, 9, 0, 0, 0, time.UTC), false, false},
+		{time.Date(2017, 3, 1, 7, 0, 0, 0, time.UTC), false, true},
+		{time.Date(2017, 3, 1, 9, 0, 0, 0, time.UTC), true, true},
+	}
+
+	for i, test := range tests {
+		now := time.Date(2017, 3, 1, 10, 0, 0, 0, time.UTC)
+		buf := &bytes.Buffer{}
+		as := &autoscaler{rules: rules, log: log.New(buf, "", log.Lshortfile), clock: func() time.Time { return now }}
+		if test.wakeUp {
+			as.requestWakeUp(rules[0])
+		}
+		mock := &MockClient{Apps: Apps{guid: App{App: "a", Space: "s", Org: "o", Guid: guid, Stopped: true, StoppedIdle: test.stoppedIdle}}}
+		as.client = mock
+		as.autoscaleApps()
+
+		if (mock.StartApp != nil) != test.start || mock.StopApp != nil || mock.ScaleDesired != nil {
+			t.Fatalf("%d: wrong calls: stop %v start %v scale %v\n%s", i, mock.StopApp != nil, mock.StartApp != nil, mock.ScaleDesired, buf.String())
+		}
+	}
+}
+
+func TestIdleTraffic(t *testing.T) {
+	rules := []Rule{
+		Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 10, MinCpu: 20, MaxCpu: 80, Idle: &Idle{After: Duration(2 * time.Minute), Rps: 1}},
+	}
+	if err := validateRules(rules); err != nil {
+		t.Fatalf("validateRules: %s", err)
+	}
+
+	now := time.Date(2017, 3, 1, 7, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	buf := &bytes.Buffer{}
+	as := &autoscaler{rules: rules, log: log.New(buf, "", log.Lshortfile), clock: clock, traffic: &firehose{clock: clock}}
+	as.traffic.connected()
+
+	tests := []struct {
+		requests int // received during the previous interval
+		stop     bool
+	}{
+		// the request rate is not known yet
+		{0, false},
+		{90, false},
+		// at most 1 request per second
+		{30, false},
+		{30, false},
+		{30, false},
+		// activity resets the idle period
+		{90, false},
+		{0, false},
+		{0, false},
+		{0, false},
+		{0, false},
+		{0, true},
+	}
+
+	for i, test := range tests {
+		for r := 0; r < test.requests; r++ {
+			as.traffic.record(guid)
+		}
+		now = now.Add(Interval)
+		mock := &MockClient{Apps: Apps{guid: App{App: "a", Space: "s", Org: "o", Guid: guid, Instances: 3, InstancesRunning: 3}}}
+		as.client = mock
+		as.autoscaleApps()
+
+		if (mock.StopApp != nil) != test.stop {
+			t.Fatalf("%d: stopped %v\n%s", i, mock.StopApp != nil, buf.String())
+		}
+	}
+}
+
+func TestWakeUpHandler(t *testing.T) {
+	rules := []Rule{
+		Rule{App: "a", Space: "s", Org: "o", Idle: &Idle{After: Duration(time.Hour)}},
+		Rule{App: "b", Space: "s", Org: "o"},
+	}
+	buf := &bytes.Buffer{}
+	as := &autoscaler{rules: rules, log: log.New(buf, "", log.Lshortfile)}
+	h := as.wakeUpHandler("secret")
+
+	tests := []struct {
+		method string
+		url    string
+		auth   string
+		status int
+	}{
+		{"GET", "/wake-up?org=o&space=s&app=a", "Bearer secret", http.StatusMethodNotAllowed},
+		{"POST", "/wake-up?org=o&space=s&app=a", "", http.StatusUnauthorized},
+		{"POST", "/wake-up?org=o&space=s&app=a", "Bearer secre", http.StatusUnauthorized},
+		{"POST", "/wake-up?org=o&space=s&app=a", "secret", http.StatusUnauthorized},
+		{"POST", "/wake-up?org=o&space=s&app=b", "Bearer secret", http.StatusNotFound},
+		{"POST", "/wake-up?org=o&space=s&app=c", "Bearer secret", http.StatusNotFound},
+		{"POST", "/wake-up?org=o&space=s&app=a", "Bearer secret", http.StatusAccepted},
+	}
+
+	for i, test := range tests {
+		req := httptest.NewRequest(test.method, test.url, nil)
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Fatalf("%d: got status %d, expected %d", i, w.Code, test.status)
+		}
+		if requested := as.wakeUpRequested(rules[0]); requested != (test.status == http.StatusAccepted) {
+			t.Fatalf("%d: wake-up requested: %v", i, requested)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+	"github.com/pkg/errors"
+)
+
+const (
+	// the metrics of the apps are read from the CF API (a snapshot of the
+	// loads) or from log-cache (averages over a time window)
+	MetricsBackendStats    = "stats"
+	MetricsBackendLogCache = "log-cache"
+	// the loads read from log-cache are averaged over this window, unless
+	// configured otherwise
+	DefaultLogCacheWindow = time.Minute
+	// maximum number of envelopes per page of the read endpoint
+	LogCacheReadLimit = 1000
+	// custom metrics can be read from log-cache instead of being scraped
+	SourceLogCache = "log-cache"
+)
+
+// logCache reads the metrics of the apps from the log-cache API at url. It is
+// safe to use it concurrently.
+type logCache struct {
+	url string
+	// token returns the value of the Authorization header, e.g. "bearer ..."
+	token  func() (string, error)
+	client *http.Client
+	// the metrics are averaged over this window
+	window time.Duration
+	// clock returns the current time; if nil, time.Now is used
+	clock func() time.Time
+	// maximum number of envelopes per page; if 0, LogCacheReadLimit is used
+	limit int
+}
+
+func (lc *logCache) now() time.Time {
+	if lc.clock != nil {
+		return lc.clock()
+	}
+	return time.Now()
+}
+
+func (lc *logCache) header() (http.Header, error) {
+	t, err := lc.token()
+	if err != nil {
+		return nil, errors.Wrap(err, "get token")
+	}
+	return http.Header{"Authorization": {t}}, nil
+}
+
+// logCacheEnvelope is the part of the loggregator v2 envelopes used by the
+// autoscaler.
+type logCacheEnvelope struct {
+	Timestamp  json.Number `json:"timestamp"`
+	InstanceId string      `json:"instance_id"`
+	Gauge      *struct {
+		Metrics map[string]struct {
+			Value float64 `json:"value"`
+		} `json:"metrics"`
+	} `json:"gauge"`
+}
+
+// read returns the gauge envelopes of the source id received since start,
+// oldest first.
+func (lc *logCache) read(sourceId string, start, end time.Time) ([]logCacheEnvelope, error) {
+	header, err := lc.header()
+	if err != nil {
+		return nil, err
+	}
+	limit := lc.limit
+	if limit == 0 {
+		limit = LogCacheReadLimit
+	}
+
+	var envelopes []logCacheEnvelope
+	// skip is the number of envelopes at from already read from the previous
+	// page
+	skip := 0
+	for from := start.UnixNano(); ; {
+		q := url.Values{
+			"start_time":     {strconv.FormatInt(from, 10)},
+			"end_time":       {strconv.FormatInt(end.UnixNano(), 10)},
+			"envelope_types": {"GAUGE"},
+			"limit":          {strconv.Itoa(limit)},
+		}
+		req, err := http.NewRequest("GET", lc.url+"/api/v1/read/"+url.PathEscape(sourceId)+"?"+q.Encode(), nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "create request")
+		}
+		req.Header = header
+		res, err := lc.client.Do(req)
+		if err != nil {
+			return nil, errors.Wrap(err, "read")
+		}
+		b, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "read response")
+		}
+		if res.StatusCode != http.StatusOK {
+			return nil, errors.Errorf("read: %s: %s", res.Status, b)
+		}
+
+		var r struct {
+			Envelopes struct {
+				Batch []logCacheEnvelope `json:"batch"`
+			} `json:"envelopes"`
+		}
+		if err := json.Unmarshal(b, &r); err != nil {
+			return nil, errors.Wrap(err, "decode envelopes")
+		}
+		batch := r.Envelopes.Batch
+		timestamps := make([]int64, len(batch))
+		for i, e := range batch {
+			if timestamps[i], err = e.Timestamp.Int64(); err != nil {
+				return nil, errors.Wrap(err, "decode timestamp")
+			}
+		}
+		for i, e := range batch {
+			if i >= skip || timestamps[i] != from {
+				envelopes = append(envelopes, e)
+			}
+		}
+		if len(batch) < limit {
+			return envelopes, nil
+		}
+
+		// several envelopes may have the timestamp of the last one, and
+		// the next page may hold more of them: it starts at that timestamp
+		// and skips the envelopes already read
+		last := timestamps[len(timestamps)-1]
+		if last == from {
+			// the whole page is at from, so the envelopes beyond it can
+			// not be read
+			from, skip = last+1, 0
+			continue
+		}
+		skip = 0
+		for i := len(timestamps) - 1; i >= 0 && timestamps[i] == last; i-- {
+			skip++
+		}
+		from = last
+	}
+}
+
+// containerUsage holds the average container metrics of an instance, in the
+// units of the stats of the CF API.
+type containerUsage struct {
+	Cpu       float64
+	Mem       int
+	MemQuota  int
+	Disk      int
+	DiskQuota int
+}
+
+// containerMetrics returns the container metrics of the instances of the app
+// averaged over the window, by instance index. Instances without metrics in
+// the window are missing.
+func (lc *logCache) containerMetrics(guid string) (map[string]containerUsage, error) {
+	now := lc.now()
+	envelopes, err := lc.read(guid, now.Add(-lc.window), now)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{"cpu", "memory", "memory_quota", "disk", "disk_quota"}
+	sums := map[string][]float64{}
+	counts := map[string]int{}
+	for _, e := range envelopes {
+		if e.Gauge == nil {
+			continue
+		}
+		// container metrics are sent together in the same envelope, while
+		// custom gauges of the app are sent separately
+		if _, found := e.Gauge.Metrics["cpu"]; !found {
+			continue
+		}
+		s := sums[e.InstanceId]
+		if s == nil {
+			s = make([]float64, len(names))
+			sums[e.InstanceId] = s
+		}
+		for i, name := range names {
+			s[i] += e.Gauge.Metrics[name].Value
+		}
+		counts[e.InstanceId]++
+	}
+
+	usage := make(map[string]containerUsage, len(sums))
+	for index, s := range sums {
+		n := float64(counts[index])
+		usage[index] = containerUsage{
+			// the cpu gauge is in percent, the stats are a fraction
+			Cpu:       s[0] / n / 100,
+			Mem:       int(s[1] / n),
+			MemQuota:  int(s[2] / n),
+			Disk:      int(s[3] / n),
+			DiskQuota: int(s[4] / n),
+		}
+	}
+	return usage, nil
+}
+
+// withUsage returns the stats of the instances with the loads replaced by the
+// averages read from log-cache; the instances without averages keep their
+// current loads.
+func withUsage(instances map[string]cfclient.AppStats, usage map[string]containerUsage) map[string]cfclient.AppStats {
+	r := make(map[string]cfclient.AppStats, len(instances))
+	for index, instance := range instances {
+		if u, found := usage[index]; found && u.MemQuota > 0 && u.DiskQuota > 0 {
+			instance.Stats.Usage.CPU = u.Cpu
+			instance.Stats.Usage.Mem = u.Mem
+			instance.Stats.Usage.Disk = u.Disk
+			instance.Stats.MemQuota = u.MemQuota
+			instance.Stats.DiskQuota = u.DiskQuota
+		}
+		r[index] = instance
+	}
+	return r
+}
+
+// gauge returns the averages over the window of the custom metric emitted by
+// each running instance of the app (excluding those warming up).
+func (lc *logCache) gauge(m CustomMetric, app App) ([]float64, error) {
+	header, err := lc.header()
+	if err != nil {
+		return nil, err
+	}
+	series, err := promQuery(lc.client, lc.url, gaugeQuery(m, app.Guid, lc.window), header)
+	if err != nil {
+		return nil, err
+	}
+
+	running := map[string]bool{}
+	for _, s := range app.Stats {
+		running[s.Index] = true
+	}
+	var values []float64
+	for _, s := range series {
+		if running[s.Labels["instance_id"]] {
+			values = append(values, s.Value)
+		}
+	}
+	return values, nil
+}
+
+// gaugeQuery returns the PromQL query of the average of the custom metric over
+// the window, per instance of the app.
+func gaugeQuery(m CustomMetric, guid string, window time.Duration) string {
+	selectors := []string{fmt.Sprintf("source_id=%s", strconv.Quote(guid))}
+	for k, v := range m.Labels {
+		selectors = append(selectors, fmt.Sprintf("%s=%s", k, strconv.Quote(v)))
+	}
+	sort.Strings(selectors[1:])
+	return fmt.Sprintf("avg_over_time(%s{%s}[%ds])", m.Metric, strings.Join(selectors, ","), int(window.Seconds()))
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+)
+
+// gaugeEnvelope returns a loggregator v2 envelope with the gauge metrics, as
+// served by log-cache.
+func gaugeEnvelope(t time.Time, instance string, metrics map[string]float64) map[string]interface{} {
+	m := map[string]interface{}{}
+	for name, value := range metrics {
+		m[name] = map[string]interface{}{"unit": "", "value": value}
+	}
+	return map[string]interface{}{
+		"timestamp":   strconv.FormatInt(t.UnixNano(), 10),
+		"source_id":   guid,
+		"instance_id": instance,
+		"gauge":       map[string]interface{}{"metrics": m},
+	}
+}
+
+// logCacheServer returns a stand-in for log-cache serving the envelopes of
+// the app (sorted by timestamp) and answering PromQL queries with results.
+// The queries received are appended to queries.
+func logCacheServer(envelopes []map[string]interface{}, results map[string]string, queries *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "bearer token" {
+			http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
+			return
+		}
+		q := r.URL.Query()
+		switch r.URL.Path {
+		case "/api/v1/read/" + guid:
+			start, _ := strconv.ParseInt(q.Get("start_time"), 10, 64)
+			end, _ := strconv.ParseInt(q.Get("end_time"), 10, 64)
+			limit, _ := strconv.Atoi(q.Get("limit"))
+			if q.Get("envelope_types") != "GAUGE" || limit <= 0 {
+				http.Error(w, `{"error":"bad request"}`, http.StatusBadRequest)
+				return
+			}
+			batch := []map[string]interface{}{}
+			for _, e := range envelopes {
+				ts, _ := strconv.ParseInt(e["timestamp"].(string), 10, 64)
+				if ts >= start && ts <= end && len(batch) < limit {
+					batch = append(batch, e)
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"envelopes": map[string]interface{}{"batch": batch}})
+		case "/api/v1/query":
+			*queries = append(*queries, q.Get("query"))
+			result, found := results[q.Get("query")]
+			if !found {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"status":"error","errorType":"bad_data","error":"parse error"}`)
+				return
+			}
+			fmt.Fprintf(w, `{"status":"success","data":%s}`, result)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestLogCacheContainerMetrics(t *testing.T) {
+	now := time.Now()
+	container := func(cpu, mem, disk float64) map[string]float64 {
+		return map[string]float64{"cpu": cpu, "memory": mem, "memory_quota": 1000, "disk": disk, "disk_quota": 2000}
+	}
+	envelopes := []map[string]interface{}{
+		// older than the window
+		gaugeEnvelope(now.Add(-2*time.Minute), "0", container(90, 900, 1800)),
+		gaugeEnvelope(now.Add(-55*time.Second), "0", container(20, 100, 200)),
+		// the first page ends between envelopes with the same timestamp
+		gaugeEnvelope(now.Add(-50*time.Second), "0", container(30, 200, 400)),
+		gaugeEnvelope(now.Add(-50*time.Second), "1", container(10, 500, 1000)),
+		// a custom gauge of the app
+		gaugeEnvelope(now.Add(-30*time.Second), "0", map[string]float64{"queue_length": 42}),
+		gaugeEnvelope(now.Add(-20*time.Second), "0", container(40, 300, 600)),
+	}
+	var queries []string
+	server := logCacheServer(envelopes, nil, &queries)
+	defer server.Close()
+
+	lc := &logCache{url: server.URL, token: func() (string, error) { return "bearer token", nil }, client: http.DefaultClient, window: time.Minute, clock: func() time.Time { return now }, limit: 2}
+	usage, err := lc.containerMetrics(guid)
+	if err != nil {
+		t.Fatalf("containerMetrics: %s", err)
+	}
+	exp := map[string]containerUsage{
+		"0": {Cpu: 0.3, Mem: 200, MemQuota: 1000, Disk: 400, DiskQuota: 2000},
+		"1": {Cpu: 0.1, Mem: 500, MemQuota: 1000, Disk: 1000, DiskQuota: 2000},
+	}
+	if len(usage) != len(exp) {
+		t.Fatalf("wrong usage: %+v", usage)
+	}
+	for index, u := range exp {
+		if v := usage[index]; v.Mem != u.Mem || v.MemQuota != u.MemQuota || v.Disk != u.Disk || v.DiskQuota != u.DiskQuota || v.Cpu < u.Cpu-1e-9 || v.Cpu > u.Cpu+1e-9 {
+			t.Fatalf("wrong usage of instance %s: %+v", index, v)
+		}
+	}
+
+	// the instance without metrics in the window keeps its current loads
+	instances := withUsage(map[string]cfclient.AppStats{"0": IS(0.9, 0.9), "1": IS(0.9, 0.9), "2": IS(0.5, 0.3)}, usage)
+	a := processApp(guid, "a", "s", "o", true, 3, 0, instances)
+	if a.CpuAvg != 30 || a.MemAvg != 33 || a.DiskAvg != 23 || a.InstancesRunning != 3 {
+		t.Fatalf("wrong loads: %+v", a)
+	}
+	// without averages, e.g. if log-cache can not be read, all the instances
+	// keep their current loads
+	instances = withUsage(map[string]cfclient.AppStats{"0": IS(0.9, 0.9), "1": IS(0.5, 0.3)}, nil)
+	if a := processApp(guid, "a", "s", "o", true, 2, 0, instances); a.CpuAvg != 70 {
+		t.Fatalf("wrong loads: %+v", a)
+	}
+
+	lc.token = func() (string, error) { return "bearer wrong", nil }
+	if _, err := lc.containerMetrics(guid); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("read with wrong token: %v", err)
+	}
+	lc.token = func() (string, error) { return "", errors.New("uaa down") }
+	if _, err := lc.containerMetrics(guid); err == nil {
+		t.Fatalf("read without token succeeded")
+	}
+}
+
+func TestPromQuery(t *testing.T) {
+	var queries []string
+	server := logCacheServer(nil, map[string]string{
+		"vector": `{"resultType":"vector","result":[{"metric":{"instance_id":"0"},"value":[1500000000.5,"1.5"]},{"metric":{},"value":[1500000000.5,"NaN"]}]}`,
+		"scalar": `{"resultType":"scalar","result":[1500000000.5,"42"]}`,
+		"matrix": `{"resultType":"matrix","result":[]}`,
+		"bad":    `{"resultType":"vector","result":[{"metric":{},"value":[1500000000.5,1.5]}]}`,
+	}, &queries)
+	defer server.Close()
+	header := http.Header{"Authorization": {"bearer token"}}
+
+	series, err := promQuery(http.DefaultClient, server.URL, "vector", header)
+	if err != nil || len(series) != 2 || series[0].Labels["instance_id"] != "0" || series[0].Value != 1.5 || series[1].Value == series[1].Value {
+		t.Fatalf("vector: %+v %v", series, err)
+	}
+	series, err = promQuery(http.DefaultClient, server.URL, "scalar", header)
+	if err != nil || len(series) != 1 || series[0].Value != 42 {
+		t.Fatalf("scalar: %+v %v", series, err)
+	}
+	for _, q := range []string{"matrix", "bad", "unknown"} {
+		if _, err := promQuery(http.DefaultClient, server.URL, q, header); err == nil {
+			t.Fatalf("%s: query succeeded", q)
+		}
+	}
+	if _, err := promQuery(http.DefaultClient, server.URL, "scalar", nil); err == nil {
+		t.Fatalf("query without token succeeded")
+	}
+}
+
+func TestLogCacheCustomMetric(t *testing.T) {
+	rules := []Rule{
+		Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 10, CustomMetric: &CustomMetric{Metric: "queue_length", Labels: map[string]string{"queue": "jobs"}, Aggregation: AggregationSum, Source: SourceLogCache, ScaleIn: 10, ScaleOut: 100}},
+	}
+	if err := validateRules(rules); err != nil {
+		t.Fatalf("validateRules: %s", err)
+	}
+
+	query := `avg_over_time(queue_length{source_id="` + guid + `",queue="jobs"}[60s])`
+	result := `{"resultType":"vector","result":[{"metric":{"instance_id":"0"},"value":[1500000000,"%s"]},{"metric":{"instance_id":"1"},"value":[1500000000,"%s"]},{"metric":{"instance_id":"5"},"value":[1500000000,"1000"]}]}`
+	tests := []struct {
+		values [2]string
+		exp    int // 0 if not scaled
+	}{
+		// the instance that is not running anymore is ignored
+		{[2]string{"40", "50"}, 0},
+		{[2]string{"40", "70"}, 5},
+		{[2]string{"4", "5"}, 3},
+	}
+
+	for i, test := range tests {
+		var queries []string
+		server := logCacheServer(nil, map[string]string{query: fmt.Sprintf(result, test.values[0], test.values[1])}, &queries)
+
+		buf := &bytes.Buffer{}
+		lc := &logCache{url: server.URL, token: func() (string, error) { return "bearer token", nil }, client: http.DefaultClient, window: time.Minute}
+		as := &autoscaler{rules: rules, log: log.New(buf, "", log.Lshortfile), logCache: lc}
+		stats := []InstanceStats{{"0", 50, 50, 0}, {"1", 50, 50, 0}}
+		mock := &MockClient{Apps: Apps{guid: App{App: "a", Space: "s", Org: "o", Guid: guid, Instances: 4, InstancesRunning: 4, Stats: stats}}}
+		as.client = mock
+		as.autoscaleApps()
+		server.Close()
+
+		switch {
+		case len(queries) != 1 || queries[0] != query:
+			t.Fatalf("%d: wrong queries: %q", i, queries)
+		case test.exp == 0 && mock.ScaleDesired != nil:
+			t.Fatalf("%d: scaled to %d\n%s", i, *mock.ScaleDesired, buf.String())
+		case test.exp != 0 && (mock.ScaleDesired == nil || *mock.ScaleDesired != test.exp):
+			t.Fatalf("%d: not scaled to %d\n%s", i, test.exp, buf.String())
+		}
+	}
+}
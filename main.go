@@ -5,6 +5,8 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -20,17 +22,59 @@ func main() {
 	if err != nil {
 		logger.Fatal(errors.Wrap(err, "parse autoscaler rules"))
 	}
+	err = resolveQueues(rules, os.Getenv("VCAP_SERVICES"))
+	if err != nil {
+		logger.Fatal(errors.Wrap(err, "resolve queue services"))
+	}
+
+	firehoseSubscription := os.Getenv("AUTOSCALER_FIREHOSE_SUBSCRIPTION")
+	if firehoseSubscription == "" {
+		firehoseSubscription = "simple-autoscaler"
+	}
+
+	probeRate := float64(DefaultProbeRate)
+	if s := os.Getenv("AUTOSCALER_PROBE_RATE"); s != "" {
+		probeRate, err = strconv.ParseFloat(s, 64)
+		if err != nil || probeRate <= 0 {
+			logger.Fatalf("invalid AUTOSCALER_PROBE_RATE %q", s)
+		}
+	}
+
+	metricsBackend := os.Getenv("AUTOSCALER_METRICS_BACKEND")
+	if metricsBackend == "" {
+		metricsBackend = MetricsBackendStats
+	} else if metricsBackend != MetricsBackendStats && metricsBackend != MetricsBackendLogCache {
+		logger.Fatalf("invalid AUTOSCALER_METRICS_BACKEND %q", metricsBackend)
+	}
+	logCacheWindow := DefaultLogCacheWindow
+	if s := os.Getenv("AUTOSCALER_LOG_CACHE_WINDOW"); s != "" {
+		logCacheWindow, err = time.ParseDuration(s)
+		if err != nil || logCacheWindow < time.Second {
+			logger.Fatalf("invalid AUTOSCALER_LOG_CACHE_WINDOW %q", s)
+		}
+	}
 
 	go func() {
 		http.ListenAndServe(":"+os.Getenv("PORT"), nil)
 	}()
 
 	run(Config{
-		Logger:            logger,
-		ApiUrl:            os.Getenv("CF_API_URL"),
-		ApiUsername:       os.Getenv("CF_USERNAME"),
-		ApiPassword:       os.Getenv("CF_PASSWORD"),
-		SkipSslValidation: os.Getenv("SKIP_SSL_VALIDATION") == "true",
-		Rules:             rules,
+		Logger:               logger,
+		ApiUrl:               os.Getenv("CF_API_URL"),
+		ApiUsername:          os.Getenv("CF_USERNAME"),
+		ApiPassword:          os.Getenv("CF_PASSWORD"),
+		SkipSslValidation:    os.Getenv("SKIP_SSL_VALIDATION") == "true",
+		Rules:                rules,
+		WakeUpToken:          os.Getenv("AUTOSCALER_WAKE_UP_TOKEN"),
+		FirehoseSubscription: firehoseSubscription,
+		SyslogTLSPort:        os.Getenv("AUTOSCALER_SYSLOG_TLS_PORT"),
+		SyslogTLSCert:        os.Getenv("AUTOSCALER_SYSLOG_TLS_CERT"),
+		SyslogTLSKey:         os.Getenv("AUTOSCALER_SYSLOG_TLS_KEY"),
+		SyslogTLSClientCA:    os.Getenv("AUTOSCALER_SYSLOG_TLS_CLIENT_CA"),
+		SyslogToken:          os.Getenv("AUTOSCALER_SYSLOG_TOKEN"),
+		ProbeRate:            probeRate,
+		MetricsBackend:       metricsBackend,
+		LogCacheURL:          os.Getenv("AUTOSCALER_LOG_CACHE_URL"),
+		LogCacheWindow:       logCacheWindow,
 	})
 }
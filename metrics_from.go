@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// AppRef identifies an app by its name, space and org.
+type AppRef struct {
+	App   string `json:"app"`
+	Space string `json:"space"`
+	Org   string `json:"org"`
+}
+
+func (r AppRef) String() string {
+	return fmt.Sprintf("%s/%s/%s", r.Org, r.Space, r.App)
+}
+
+// validateMetricsFrom checks the metrics_from option of a single rule. As the
+// loads of another app say nothing about how they change when the app of the
+// rule is scaled, only the threshold policy is allowed.
+func validateMetricsFrom(rule Rule) error {
+	m := rule.MetricsFrom
+	switch {
+	case m == nil:
+		return nil
+	case m.App == "" || m.Space == "" || m.Org == "":
+		return errors.New("metrics from requires app, space and org")
+	case m.App == rule.App && m.Space == rule.Space && m.Org == rule.Org:
+		return errors.New("metrics from can not refer to the app of the rule")
+	case rule.Policy != "" && rule.Policy != PolicyThreshold:
+		return errors.New("metrics from is only allowed with the threshold policy")
+	case rule.Predictive != nil || len(rule.Trends) > 0:
+		return errors.New("metrics from can not be used with predictive scaling or trends")
+	}
+	return nil
+}
+
+// validateMetricsSources checks that the apps referred to by metrics_from are
+// covered by a rule, and that following the references never leads back to
+// the same app.
+func validateMetricsSources(rules []Rule) error {
+	for idx, rule := range rules {
+		seen := map[string]bool{ruleKey(rule): true}
+		for r := rule; r.MetricsFrom != nil; {
+			next, found := ruleFor(rules, r.MetricsFrom.App, r.MetricsFrom.Space, r.MetricsFrom.Org)
+			switch {
+			case !found:
+				return errors.Errorf("rule %d: no rule for metrics from app %s", idx, r.MetricsFrom)
+			case seen[ruleKey(next)]:
+				return errors.Errorf("rule %d: circular metrics from reference through app %s", idx, r.MetricsFrom)
+			}
+			seen[ruleKey(next)] = true
+			r = next
+		}
+	}
+	return nil
+}
+
+// metricsFrom replaces the loads of the app with the loads of the app the rule
+// takes its metrics from, aggregated as required by the rule of that app. The
+// number of instances of the app is not changed.
+func (as *autoscaler) metricsFrom(rule Rule, app App, apps Apps) (App, error) {
+	var src App
+	found := false
+	for _, a := range apps {
+		if a.App == rule.MetricsFrom.App && a.Space == rule.MetricsFrom.Space && a.Org == rule.MetricsFrom.Org {
+			src, found = a, true
+			break
+		}
+	}
+	switch {
+	case !found:
+		return app, errors.Errorf("metrics from app %s not found", rule.MetricsFrom)
+	case src.Stopped || src.InstancesRunning == 0 || src.Warming == src.InstancesRunning:
+		return app, errors.Errorf("metrics from app %s: no running instances", rule.MetricsFrom)
+	case src.Instances != src.InstancesRunning:
+		return app, errors.Errorf("metrics from app %s: number of running instances differs from desired: %d/%d", rule.MetricsFrom, src.InstancesRunning, src.Instances)
+	}
+
+	srcRule, _ := ruleFor(as.rules, src.App, src.Space, src.Org)
+	src = aggregate(srcRule, src)
+	as.log.Printf("autoscale app %v: using loads of app %s: cpu %d%%, mem %d%%, disk %d%%", app, rule.MetricsFrom, src.CpuAvg, src.MemAvg, src.DiskAvg)
+	app.CpuAvg, app.MemAvg, app.DiskAvg = src.CpuAvg, src.MemAvg, src.DiskAvg
+	return app, nil
+}
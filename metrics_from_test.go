@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestValidateMetricsSources(t *testing.T) {
+	api := Rule{App: "api", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 10, MinCpu: 20, MaxCpu: 80}
+	consumer := Rule{App: "consumer", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 10, MinCpu: 20, MaxCpu: 80, MetricsFrom: &AppRef{App: "api", Space: "s", Org: "o"}}
+	cycle := api
+	cycle.MetricsFrom = &AppRef{App: "consumer", Space: "s", Org: "o"}
+	chain := Rule{App: "batch", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 10, MinCpu: 20, MaxCpu: 80, MetricsFrom: &AppRef{App: "consumer", Space: "s", Org: "o"}}
+
+	tests := []struct {
+		rules []Rule
+		ok    bool
+	}{
+		{[]Rule{api, consumer}, true},
+		{[]Rule{consumer, api}, true},
+		{[]Rule{api, consumer, chain}, true},
+		{[]Rule{consumer}, false},
+		{[]Rule{cycle, consumer}, false},
+		{[]Rule{cycle, consumer, chain}, false},
+	}
+
+	for idx, test := range tests {
+		if err := validateRules(test.rules); (err == nil) != test.ok {
+			t.Fatalf("test %d: got %v", idx, err)
+		}
+	}
+}
+
+func TestMetricsFrom(t *testing.T) {
+	rules := []Rule{
+		Rule{App: "api", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 10, MinCpu: 20, MaxCpu: 80, CpuAggregation: AggregationMax},
+		Rule{App: "consumer", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 10, MinCpu: 40, MaxCpu: 60, MetricsFrom: &AppRef{App: "api", Space: "s", Org: "o"}},
+	}
+	if err := validateRules(rules); err != nil {
+		t.Fatalf("validateRules: %s", err)
+	}
+
+	tests := []struct {
+		cpu     int // load of the consumer
+		api     []float64
+		running int // running instances of the api app
+		exp     int // 0 if not scaled
+	}{
+		{50, []float64{50, 50, 50}, 3, 0},
+		// the own load of the consumer is ignored
+		{90, []float64{50, 50, 50}, 3, 0},
+		// the aggregation of the rule of the api app is used
+		{50, []float64{50, 50, 70}, 3, 5},
+		{50, []float64{10, 20, 30}, 3, 3},
+		// no decision while the api app is not stable
+		{50, []float64{90, 90}, 2, 0},
+	}
+
+	for i, test := range tests {
+		buf := &bytes.Buffer{}
+		as := &autoscaler{rules: rules, log: log.New(buf, "", log.Lshortfile), clock: time.Now}
+		api := App{App: "api", Space: "s", Org: "o", Guid: "api", Instances: 3, InstancesRunning: test.running, CpuAvg: 50, MemAvg: 50}
+		for idx, cpu := range test.api {
+			api.Stats = append(api.Stats, InstanceStats{strconv.Itoa(idx), cpu, 50, 0})
+		}
+		mock := &MockClient{Apps: Apps{
+			"api":      api,
+			"consumer": App{App: "consumer", Space: "s", Org: "o", Guid: "consumer", Instances: 4, InstancesRunning: 4, CpuAvg: test.cpu},
+		}}
+		as.client = mock
+		as.autoscaleApps()
+
+		switch {
+		case test.exp == 0 && mock.ScaleDesired != nil && mock.ScaleApp.Guid == "consumer":
+			t.Fatalf("%d: scaled to %d\n%s", i, *mock.ScaleDesired, buf.String())
+		case test.exp != 0 && (mock.ScaleDesired == nil || mock.ScaleApp.Guid != "consumer" || *mock.ScaleDesired != test.exp):
+			t.Fatalf("%d: not scaled to %d\n%s", i, test.exp, buf.String())
+		}
+	}
+}
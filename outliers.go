@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+const (
+	// minimum number of running instances required to look for outliers
+	MinOutlierInstances = 3
+	// loads closer than this many percentage points to the median are never outliers
+	MinOutlierDeviation = 10.0
+	// modified z-score above which a load is an outlier
+	OutlierScore = 3.5
+)
+
+// Outlier is an instance whose load for a metric is excluded from the
+// aggregated loads of the app
+type Outlier struct {
+	Index  string
+	Metric string
+	Load   float64
+	Median float64
+	Score  float64
+}
+
+func (o Outlier) String() string {
+	if math.IsInf(o.Score, 0) {
+		return fmt.Sprintf("instance %s: %s load %.0f%%, median %.0f%% shared by most instances", o.Index, o.Metric, o.Load, o.Median)
+	}
+	return fmt.Sprintf("instance %s: %s load %.0f%%, median %.0f%%, modified z-score %.1f", o.Index, o.Metric, o.Load, o.Median, o.Score)
+}
+
+// findOutliers looks for outliers among the cpu and mem loads of the instances.
+func findOutliers(stats []InstanceStats) []Outlier {
+	if len(stats) < MinOutlierInstances {
+		return nil
+	}
+
+	cpu, mem := make([]float64, len(stats)), make([]float64, len(stats))
+	for i, s := range stats {
+		cpu[i], mem[i] = s.Cpu, s.Mem
+	}
+
+	var r []Outlier
+	for _, m := range []struct {
+		metric string
+		loads  []float64
+	}{{MetricCpu, cpu}, {MetricMem, mem}} {
+		median, scores := modifiedZScores(m.loads)
+		for i, score := range scores {
+			if math.Abs(score) > OutlierScore && math.Abs(m.loads[i]-median) >= MinOutlierDeviation {
+				r = append(r, Outlier{Index: stats[i].Index, Metric: m.metric, Load: m.loads[i], Median: median, Score: score})
+			}
+		}
+	}
+	return r
+}
+
+// modifiedZScores returns the median of the values and the modified z-score of
+// each value, computed using the median absolute deviation (MAD). If the MAD
+// is 0 (i.e. most values are equal to the median), the score of the values
+// different from the median is infinite.
+func modifiedZScores(values []float64) (median float64, scores []float64) {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	median = percentile(sorted, 50)
+
+	deviations := make([]float64, len(values))
+	for i, v := range values {
+		deviations[i] = math.Abs(v - median)
+	}
+	sort.Float64s(deviations)
+	mad := percentile(deviations, 50)
+
+	scores = make([]float64, len(values))
+	for i, v := range values {
+		switch {
+		case v == median:
+			scores[i] = 0
+		case mad == 0:
+			scores[i] = math.Copysign(math.Inf(1), v-median)
+		default:
+			scores[i] = 0.6745 * (v - median) / mad
+		}
+	}
+	return
+}
+
+// isOutlier returns true if the load for the metric of the instance is an outlier.
+func (a App) isOutlier(index, metric string) bool {
+	for _, o := range a.Outliers {
+		if o.Index == index && o.Metric == metric {
+			return true
+		}
+	}
+	return false
+}
+
+// loads returns the loads for the metric of the instances that are not outliers.
+func (a App) loads(metric string) []float64 {
+	var r []float64
+	for _, s := range a.Stats {
+		if a.isOutlier(s.Index, metric) {
+			continue
+		}
+		switch metric {
+		case MetricCpu:
+			r = append(r, s.Cpu)
+		case MetricMem:
+			r = append(r, s.Mem)
+		case MetricDisk:
+			r = append(r, s.Disk)
+		}
+	}
+	return r
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	cfclient "github.com/cloudfoundry-community/go-cfclient"
+)
+
+func TestFindOutliers(t *testing.T) {
+	stats := func(cpu ...float64) []InstanceStats {
+		r := make([]InstanceStats, len(cpu))
+		for i, c := range cpu {
+			r[i] = InstanceStats{Index: string('0' + rune(i)), Cpu: c, Mem: 50}
+		}
+		return r
+	}
+
+	tests := []struct {
+		stats []InstanceStats
+		exp   []string
+	}{
+		// not enough instances
+		{stats(40, 0), nil},
+		// no outliers
+		{stats(40, 40, 40), nil},
+		{stats(40, 45, 35, 50, 30), nil},
+		{stats(40, 41, 40, 40, 40), nil},
+		{stats(10, 50, 90), nil},
+		// hung instance
+		{stats(40, 45, 0), []string{"2"}},
+		{stats(40, 40, 0, 40), []string{"2"}},
+		{stats(40, 45, 35, 50, 0, 42), []string{"4"}},
+		// spinning instance
+		{stats(100, 40, 45, 35), []string{"0"}},
+		// both
+		{stats(100, 40, 45, 35, 0, 42, 38), []string{"0", "4"}},
+	}
+
+	for i, test := range tests {
+		var indexes []string
+		for _, o := range findOutliers(test.stats) {
+			if o.Metric != MetricCpu {
+				t.Fatalf("%d: wrong metric: %v", i, o)
+			}
+			indexes = append(indexes, o.Index)
+		}
+		if !reflect.DeepEqual(indexes, test.exp) {
+			t.Fatalf("%d: outliers %v, expected %v", i, indexes, test.exp)
+		}
+	}
+}
+
+func TestProcessAppOutliers(t *testing.T) {
+	a := processApp(guid, "a", "s", "o", true, 4, 0, map[string]cfclient.AppStats{"0": IS(0.4, 0.5), "1": IS(0.45, 0.55), "2": IS(0.35, 0.45), "3": IS(0, 0.5)})
+	if a.CpuAvg != 40 || a.MemAvg != 50 || a.Instances != 4 || a.InstancesRunning != 4 {
+		t.Fatalf("processApp fail: %+v", a)
+	}
+	if len(a.Outliers) != 1 || a.Outliers[0].Index != "3" || a.Outliers[0].Metric != MetricCpu || !a.isOutlier("3", MetricCpu) || a.isOutlier("3", MetricMem) {
+		t.Fatalf("wrong outliers: %+v", a.Outliers)
+	}
+
+	// outliers are not included in the aggregated loads either
+	if a := aggregate(Rule{CpuAggregation: AggregationMedian}, a); a.CpuAvg != 40 {
+		t.Fatalf("outlier included in aggregation: %+v", a)
+	}
+}
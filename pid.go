@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math"
+)
+
+// pid holds the state of a PID controller across iterations
+type pid struct {
+	// Output is the unrounded output of the last iteration
+	Output float64
+	// PrevError and PrevError2 are the errors of the last two iterations
+	PrevError  float64
+	PrevError2 float64
+	Iterations int
+}
+
+// controllers holds the PID controllers of an app, one per metric
+type controllers struct {
+	Cpu pid
+	Mem pid
+}
+
+// control implements the pid policy: for each metric, the error is the number
+// of instances missing (or in excess) to bring the load to the target, assuming
+// that load is spread uniformly across instances, and the controller (in
+// velocity form) returns the change to apply to the number of instances. The
+// largest result is returned.
+func (as *autoscaler) control(rule Rule, app App) int {
+	if as.controllers == nil {
+		as.controllers = make(map[string]*controllers)
+	}
+	c := as.controllers[app.Guid]
+	if c == nil {
+		c = &controllers{}
+		as.controllers[app.Guid] = c
+	}
+
+	desired := rule.MinInstances
+	if rule.TargetCpu > 0 {
+		if i := c.Cpu.update(rule, app.Instances, app.CpuAvg, rule.TargetCpu); i > desired {
+			desired = i
+		}
+	}
+	if rule.TargetMem > 0 {
+		if i := c.Mem.update(rule, app.Instances, app.MemAvg, rule.TargetMem); i > desired {
+			desired = i
+		}
+	}
+	return desired
+}
+
+// update feeds the current load to the controller and returns the number of
+// instances, within the rule bounds, the app should have. As the error is
+// already a number of instances, the controller computes the change of the
+// number of instances: Kp*Δe + Ki*e + Kd*Δ²e.
+func (c *pid) update(rule Rule, instances, load, target int) int {
+	// the fractional part of the previous output is kept, unless the number
+	// of instances was changed by something else, and the error is relative
+	// to it: otherwise the rounding would keep the app oscillating around the
+	// target
+	output := float64(instances)
+	if c.Iterations > 0 && int(math.Floor(c.Output+0.5)) == instances {
+		output = c.Output
+	}
+	e := float64(instances)*float64(load)/float64(target) - output
+
+	output += rule.Ki * e
+	if c.Iterations > 0 {
+		output += rule.Kp * (e - c.PrevError)
+	}
+	if c.Iterations > 1 {
+		output += rule.Kd * (e - 2*c.PrevError + c.PrevError2)
+	}
+
+	// the output is clamped, so that it does not wind up while the number of
+	// instances is held at the bounds
+	output = math.Max(float64(rule.MinInstances), math.Min(float64(rule.MaxInstances), output))
+	c.Output = output
+	c.PrevError, c.PrevError2 = e, c.PrevError
+	c.Iterations++
+	return int(math.Floor(output + 0.5))
+}
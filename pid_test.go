@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"testing"
+)
+
+// simulatePID runs the autoscaler on an app with the given demand (average cpu
+// load multiplied by the number of instances) at each iteration, and returns
+// the number of instances after each iteration.
+func simulatePID(t *testing.T, rule Rule, demand func(k int) float64, iterations int) []int {
+	rules := []Rule{rule}
+	if err := validateRules(rules); err != nil {
+		t.Fatalf("validateRules: %s", err)
+	}
+
+	buf := &bytes.Buffer{}
+	as := &autoscaler{rules: rules, log: log.New(buf, "", log.Lshortfile)}
+
+	instances := rule.MinInstances
+	r := make([]int, 0, iterations)
+	for k := 0; k < iterations; k++ {
+		cpu := int(demand(k)/float64(instances) + 0.5)
+		if cpu > 100 {
+			cpu = 100
+		}
+		app := App{App: rule.App, Space: rule.Space, Org: rule.Org, Guid: guid, Instances: instances, InstancesRunning: instances, CpuAvg: cpu}
+		mock := &MockClient{Apps: Apps{guid: app}}
+		as.client = mock
+		as.autoscaleApps()
+		if mock.ScaleDesired != nil {
+			instances = *mock.ScaleDesired
+		}
+		r = append(r, instances)
+	}
+	return r
+}
+
+func TestPIDConvergence(t *testing.T) {
+	// step from 3 to 18 instances worth of demand
+	step := func(k int) float64 {
+		if k < 10 {
+			return 150
+		}
+		return 900
+	}
+	// linear ramp from 3 to 24 instances worth of demand, and back
+	ramp := func(k int) float64 {
+		switch {
+		case k < 40:
+			return 150 + float64(k)*26.25
+		case k < 80:
+			return 1200 - float64(k-40)*26.25
+		}
+		return 150
+	}
+
+	tests := []struct {
+		kp, ki, kd float64
+	}{
+		{0.2, 0.6, 0.05},
+		// integral only, with a low and a high gain
+		{0, 0.3, 0},
+		{0, 1.5, 0},
+		{0.6, 0.3, 0},
+		{0.4, 1, 0},
+	}
+	for _, test := range tests {
+		rule := Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 30, MinCpu: 20, MaxCpu: 80, Policy: PolicyPID, TargetCpu: 50, Kp: test.kp, Ki: test.ki, Kd: test.kd}
+
+		instances := simulatePID(t, rule, step, 40)
+		for k, i := range instances {
+			switch {
+			case k < 10 && i != 3:
+				t.Fatalf("%+v: step: iteration %d: %d instances: %v", test, k, i, instances)
+			case i > 20:
+				t.Fatalf("%+v: step: iteration %d: overshoot %d instances: %v", test, k, i, instances)
+			case k >= 30 && i != 18:
+				t.Fatalf("%+v: step: iteration %d: not converged %d instances: %v", test, k, i, instances)
+			}
+		}
+
+		instances = simulatePID(t, rule, ramp, 100)
+		for k, i := range instances {
+			ideal := ramp(k) / 50
+			if k < 80 && (float64(i) < ideal-4 || float64(i) > ideal+4) {
+				t.Fatalf("%+v: ramp: iteration %d: %d instances, expected ~%.1f: %v", test, k, i, ideal, instances)
+			} else if k >= 95 && i != 3 {
+				t.Fatalf("%+v: ramp: iteration %d: not converged %d instances: %v", test, k, i, instances)
+			}
+		}
+	}
+}
+
+func TestPIDAntiWindup(t *testing.T) {
+	rule := Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 10, MinCpu: 20, MaxCpu: 80, Policy: PolicyPID, TargetCpu: 50, Kp: 0.5, Ki: 0.2}
+
+	// demand far above what max instances can serve for a long time, then
+	// back to normal: without anti-windup the controller would keep the app at
+	// max instances for many iterations
+	demand := func(k int) float64 {
+		if k < 50 {
+			return 2000
+		}
+		return 250
+	}
+	instances := simulatePID(t, rule, demand, 70)
+	for k, i := range instances {
+		if k >= 20 && k < 50 && i != 10 {
+			t.Fatalf("iteration %d: %d instances: %v", k, i, instances)
+		} else if k >= 60 && i != 5 {
+			t.Fatalf("iteration %d: not converged %d instances: %v", k, i, instances)
+		}
+	}
+}
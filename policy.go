@@ -0,0 +1,48 @@
+package main
+
+import (
+	"math"
+)
+
+// targetInstances implements the target policy: assuming that load is spread
+// uniformly across instances, it finds for each metric the number of instances
+// that brings the load closest to the target and returns the largest of them.
+func targetInstances(rule Rule, app App) int {
+	desired := rule.MinInstances
+	if rule.TargetCpu > 0 {
+		if i := targetInstancesFor(rule, app.Instances, app.CpuAvg, rule.MinCpu, rule.MaxCpu, rule.TargetCpu); i > desired {
+			desired = i
+		}
+	}
+	if rule.TargetMem > 0 {
+		if i := targetInstancesFor(rule, app.Instances, app.MemAvg, rule.MinMem, rule.MaxMem, rule.TargetMem); i > desired {
+			desired = i
+		}
+	}
+	return desired
+}
+
+// targetInstancesFor returns the number of instances in the min/max range of
+// the rule that brings load closest to target, preferring the ones that keep
+// load between the scale-in and scale-out thresholds.
+func targetInstancesFor(rule Rule, instances, load, min, max, target int) int {
+	demand := float64(load) * float64(instances)
+
+	desired, diffmin, inRangeMin := rule.MaxInstances, math.Inf(1), false
+	for i := rule.MinInstances; i <= rule.MaxInstances; i++ {
+		l := demand / float64(i)
+		diff := math.Abs(l - float64(target))
+		inRange := l >= float64(min) && l <= float64(max)
+		if (inRange && !inRangeMin) || (inRange == inRangeMin && diff < diffmin) {
+			desired, diffmin, inRangeMin = i, diff, inRange
+		}
+	}
+
+	// hysteresis: scale in only if load would still not exceed the target after
+	// removing one instance, otherwise the app would flap between two sizes
+	if tgtdiff := demand/float64(target) - float64(instances); tgtdiff > -1 && tgtdiff < 0 && desired < instances {
+		desired = instances
+	}
+
+	return desired
+}
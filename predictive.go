@@ -0,0 +1,215 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// samples are averaged over buckets of this size before being fed to the model
+	PredictiveResolution = 5 * time.Minute
+	// default length of the season of the model
+	PredictiveSeason = 24 * time.Hour
+	// smoothing factors of the level, trend and seasonal components
+	hwAlpha = 0.3
+	hwBeta  = 0.01
+	hwGamma = 0.3
+)
+
+// Predictive configures predictive scaling: a seasonal model of the demand
+// (average load multiplied by the number of instances) is used to forecast the
+// number of instances required to keep the average load at the target during
+// the next horizon.
+type Predictive struct {
+	Season    Duration `json:"season"`
+	Horizon   Duration `json:"horizon"`
+	TargetCpu int      `json:"target_cpu"`
+	TargetMem int      `json:"target_mem"`
+}
+
+func validatePredictive(p Predictive) (Predictive, error) {
+	if p.Season == 0 {
+		p.Season = Duration(PredictiveSeason)
+	}
+
+	switch {
+	case p.Season < Duration(2*PredictiveResolution) || p.Season%Duration(PredictiveResolution) != 0:
+		return p, errors.Errorf("predictive season should be a multiple of %s", PredictiveResolution)
+	case p.Horizon <= 0 || p.Horizon > p.Season:
+		return p, errors.New("predictive horizon should be in the range 0<h<=season")
+	case p.TargetCpu < 0 || p.TargetCpu > 100:
+		return p, errors.New("predictive target cpu load should be in the range 0<=t<=100")
+	case p.TargetMem < 0 || p.TargetMem > 100:
+		return p, errors.New("predictive target mem load should be in the range 0<=t<=100")
+	case p.TargetCpu == 0 && p.TargetMem == 0:
+		return p, errors.New("no predictive cpu/mem targets defined")
+	}
+	return p, nil
+}
+
+// predictor holds the models of the demand of an app
+type predictor struct {
+	Cpu *holtWinters
+	Mem *holtWinters
+}
+
+// predict records the current demand of the app and returns the number of
+// instances required to serve the demand forecast for the rule horizon. If the
+// models have not yet observed enough data, ok is false.
+func (as *autoscaler) predict(rule Rule, app App) (desired int, ok bool) {
+	if as.predictors == nil {
+		as.predictors = make(map[string]*predictor)
+	}
+
+	season := int(time.Duration(rule.Predictive.Season) / PredictiveResolution)
+	p := as.predictors[app.Guid]
+	if p == nil || p.Cpu.season != season {
+		p = &predictor{Cpu: newHoltWinters(season), Mem: newHoltWinters(season)}
+		as.predictors[app.Guid] = p
+	}
+
+	now := as.now()
+	if app.Instances > 0 && app.Instances == app.InstancesRunning {
+		p.Cpu.observe(now, float64(app.CpuAvg*app.Instances))
+		p.Mem.observe(now, float64(app.MemAvg*app.Instances))
+	}
+
+	desired = rule.MinInstances
+	for _, m := range []struct {
+		model  *holtWinters
+		target int
+	}{{p.Cpu, rule.Predictive.TargetCpu}, {p.Mem, rule.Predictive.TargetMem}} {
+		if m.target == 0 {
+			continue
+		}
+		demand, ready := m.model.peak(now, now.Add(time.Duration(rule.Predictive.Horizon)))
+		if !ready {
+			return 0, false
+		}
+		if i := int(math.Ceil(demand / float64(m.target))); i > desired {
+			desired = i
+		}
+	}
+
+	if desired > rule.MaxInstances {
+		desired = rule.MaxInstances
+	}
+	return desired, true
+}
+
+// holtWinters is an additive Holt-Winters model that is updated online with the
+// averages of the values observed in each bucket of PredictiveResolution.
+type holtWinters struct {
+	season      int
+	initialized bool
+	updates     int
+	level       float64
+	trend       float64
+	seasonal    []float64
+	// last bucket fed to the model
+	fed int64
+
+	// bucket being accumulated
+	bucket int64
+	sum    float64
+	n      int
+}
+
+func newHoltWinters(season int) *holtWinters {
+	return &holtWinters{season: season, seasonal: make([]float64, 0, season)}
+}
+
+func bucketOf(t time.Time) int64 {
+	return t.UnixNano() / int64(PredictiveResolution)
+}
+
+// observe adds a value observed at time t; values must be observed in order.
+func (hw *holtWinters) observe(t time.Time, v float64) {
+	b := bucketOf(t)
+	if hw.n > 0 && b != hw.bucket {
+		hw.update(hw.bucket, hw.sum/float64(hw.n))
+
+		switch {
+		case b-hw.bucket > int64(hw.season):
+			// the model is too old to be useful
+			*hw = *newHoltWinters(hw.season)
+		case b-hw.bucket > 1 && !hw.initialized:
+			// the first season must be complete to initialize the model
+			hw.seasonal = hw.seasonal[:0]
+		case b-hw.bucket > 1:
+			// fill the buckets without observations with the forecast
+			for i := hw.bucket + 1; i < b; i++ {
+				hw.update(i, hw.forecast(i))
+			}
+		}
+	}
+	if b != hw.bucket || hw.n == 0 {
+		hw.bucket, hw.sum, hw.n = b, 0, 0
+	}
+	hw.sum += v
+	hw.n++
+}
+
+// update feeds the average value y of bucket b to the model.
+func (hw *holtWinters) update(b int64, y float64) {
+	hw.fed = b
+
+	if !hw.initialized {
+		// during the first season the values are stored as they are and, at
+		// the end, the level is set to their average and the seasonal
+		// components to the differences from the average
+		hw.seasonal = append(hw.seasonal, y)
+		if len(hw.seasonal) < hw.season {
+			return
+		}
+		for _, s := range hw.seasonal {
+			hw.level += s / float64(hw.season)
+		}
+		// rotate the seasonal components so that they are indexed by bucket
+		first := int((b + 1) % int64(hw.season))
+		seasonal := make([]float64, hw.season)
+		for i, s := range hw.seasonal {
+			seasonal[(first+i)%hw.season] = s - hw.level
+		}
+		hw.seasonal, hw.initialized = seasonal, true
+		return
+	}
+
+	pos := int(b % int64(hw.season))
+	level, s := hw.level, hw.seasonal[pos]
+	hw.level = hwAlpha*(y-s) + (1-hwAlpha)*(hw.level+hw.trend)
+	hw.trend = hwBeta*(hw.level-level) + (1-hwBeta)*hw.trend
+	hw.seasonal[pos] = hwGamma*(y-hw.level) + (1-hwGamma)*s
+	hw.updates++
+}
+
+// forecast returns the value forecast for a bucket after the last one fed to
+// the model.
+func (hw *holtWinters) forecast(b int64) float64 {
+	return hw.level + float64(b-hw.fed)*hw.trend + hw.seasonal[b%int64(hw.season)]
+}
+
+// ready returns true if the model has observed at least two seasons of data.
+func (hw *holtWinters) ready() bool {
+	return hw.initialized && hw.updates >= hw.season
+}
+
+// peak returns the highest value forecast between from and to.
+func (hw *holtWinters) peak(from, to time.Time) (peak float64, ready bool) {
+	if !hw.ready() {
+		return 0, false
+	}
+	first := bucketOf(from)
+	if first <= hw.fed {
+		first = hw.fed + 1
+	}
+	peak = math.Inf(-1)
+	for b := first; b <= bucketOf(to) || b == first; b++ {
+		if f := hw.forecast(b); f > peak {
+			peak = f
+		}
+	}
+	return peak, true
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"math"
+	"testing"
+	"time"
+)
+
+// demand is a synthetic daily load curve with a slow upwards trend
+func demand(t time.Time) float64 {
+	day := float64(t.Unix()%86400) / 86400
+	return 400 + 300*math.Sin(2*math.Pi*day) + float64(t.Unix()%(86400*7))/86400
+}
+
+func TestHoltWinters(t *testing.T) {
+	hw := newHoltWinters(int(PredictiveSeason / PredictiveResolution))
+	start := time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+
+	for ; now.Sub(start) < 2*PredictiveSeason; now = now.Add(Interval) {
+		if hw.ready() {
+			t.Fatalf("model ready after %s", now.Sub(start))
+		}
+		hw.observe(now, demand(now))
+	}
+
+	// the model must tolerate gaps in the observations
+	for end := now.Add(3 * 24 * time.Hour); now.Before(end); now = now.Add(Interval) {
+		if now.Hour() == 12 {
+			continue
+		}
+		hw.observe(now, demand(now))
+	}
+
+	if !hw.ready() {
+		t.Fatalf("model not ready after %s", now.Sub(start))
+	}
+
+	for h := time.Duration(0); h < 6*time.Hour; h += PredictiveResolution {
+		f, _ := hw.peak(now.Add(h), now.Add(h))
+		if d := demand(now.Add(h)); math.Abs(f-d) > 0.05*d {
+			t.Fatalf("forecast for %s: %f, expected %f", now.Add(h), f, d)
+		}
+	}
+
+	f, _ := hw.peak(now, now.Add(24*time.Hour))
+	if f < 650 || f > 750 {
+		t.Fatalf("wrong peak forecast: %f", f)
+	}
+
+	// after a gap longer than a season the model starts over
+	now = now.Add(2 * PredictiveSeason)
+	hw.observe(now, demand(now))
+	hw.observe(now.Add(PredictiveResolution), demand(now))
+	if hw.ready() || hw.initialized {
+		t.Fatalf("model ready after gap")
+	}
+}
+
+func TestPredictiveScaling(t *testing.T) {
+	rules := []Rule{
+		Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 20, MinCpu: 5, MaxCpu: 90, Predictive: &Predictive{Horizon: Duration(time.Hour), TargetCpu: 50}},
+	}
+	if err := validateRules(rules); err != nil {
+		t.Fatalf("validateRules: %s", err)
+	}
+
+	start := time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	buf := &bytes.Buffer{}
+	as := &autoscaler{rules: rules, log: log.New(buf, "", log.Lshortfile), clock: func() time.Time { return now }}
+
+	scaled := false
+	for ; now.Sub(start) < 3*PredictiveSeason; now = now.Add(Interval) {
+		buf.Reset()
+		app := App{App: "a", Space: "s", Org: "o", Guid: guid, Instances: 10, InstancesRunning: 10, CpuAvg: int(demand(now)/10 + 0.5)}
+		mock := &MockClient{Apps: Apps{guid: app}}
+		as.client = mock
+		as.autoscaleApps()
+
+		if now.Sub(start) < 2*PredictiveSeason {
+			if mock.ScaleDesired != nil {
+				t.Fatalf("%s: Scale called: %d\n%s", now, *mock.ScaleDesired, buf.String())
+			}
+			continue
+		}
+
+		// the reactive policy never scales this app, so the app must be
+		// scaled ahead of the forecast demand
+		peak := 0.0
+		for h := time.Duration(0); h <= time.Hour; h += time.Minute {
+			if d := demand(now.Add(h)); d > peak {
+				peak = d
+			}
+		}
+		expected := int(math.Ceil(peak / 50))
+		if expected <= 10 {
+			expected = 0
+		}
+		if mock.ScaleDesired != nil {
+			scaled = true
+		}
+		if expected == 0 && mock.ScaleDesired != nil && *mock.ScaleDesired > 11 {
+			t.Fatalf("%s: Scale called: %d\n%s", now, *mock.ScaleDesired, buf.String())
+		} else if expected != 0 && (mock.ScaleDesired == nil || math.Abs(float64(*mock.ScaleDesired-expected)) > 1) {
+			t.Fatalf("%s: Scale not called with %d\n%s", now, expected, buf.String())
+		}
+	}
+	if !scaled {
+		t.Fatalf("Scale never called")
+	}
+}
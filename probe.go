@@ -0,0 +1,366 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// the prober looks for apps to probe this often
+	ProbeTick = time.Second
+	// the routes of the apps are looked up again this often
+	ProbeRoutesInterval = 5 * time.Minute
+	// apps not analyzed for this long (e.g. stopped or deleted) are not probed
+	// anymore
+	ProbeExpiry = 2 * Interval
+	// at most this many probes per second are sent, across all apps, unless
+	// configured otherwise
+	DefaultProbeRate = 10
+	// at most this much of the response bodies is read
+	ProbeMaxBodySize = 1024 * 1024
+)
+
+// Probe configures the synthetic requests sent to each route of an app: the
+// app is scaled out when the chosen percentile of the response times over
+// window is at or above scale out, and it can be scaled in when it is at or
+// below scale in and no probe failed.
+type Probe struct {
+	Scheme     string   `json:"scheme"`
+	Path       string   `json:"path"`
+	Interval   Duration `json:"interval"`
+	Timeout    Duration `json:"timeout"`
+	Window     Duration `json:"window"`
+	Percentile float64  `json:"percentile"`
+	ScaleIn    Duration `json:"scale_in"`
+	ScaleOut   Duration `json:"scale_out"`
+}
+
+func (p Probe) scheme() string {
+	if p.Scheme == "" {
+		return "https"
+	}
+	return p.Scheme
+}
+
+func (p Probe) path() string {
+	if p.Path == "" {
+		return "/"
+	}
+	return p.Path
+}
+
+func (p Probe) interval() time.Duration {
+	if p.Interval == 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(p.Interval)
+}
+
+func (p Probe) timeout() time.Duration {
+	if p.Timeout == 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(p.Timeout)
+}
+
+func (p Probe) window() time.Duration {
+	if p.Window == 0 {
+		return time.Minute
+	}
+	return time.Duration(p.Window)
+}
+
+func (p Probe) percentile() float64 {
+	if p.Percentile == 0 {
+		return 95
+	}
+	return p.Percentile
+}
+
+func validateProbe(p Probe) error {
+	switch {
+	case p.Scheme != "" && p.Scheme != "http" && p.Scheme != "https":
+		return errors.New("probe scheme should be http or https")
+	case p.Path != "" && !strings.HasPrefix(p.Path, "/"):
+		return errors.New("probe path should start with /")
+	case p.Interval < 0 || p.Timeout < 0 || p.Window < 0:
+		return errors.New("probe interval, timeout and window should be >= 0")
+	case p.timeout() >= p.interval():
+		return errors.New("probe timeout should be less than probe interval")
+	case p.window() < p.interval():
+		return errors.New("probe window should be at least the probe interval")
+	case p.Percentile < 0 || p.Percentile > 100:
+		return errors.New("probe percentile should be in the range 0<p<=100")
+	case p.ScaleOut <= 0:
+		return errors.New("probe scale out threshold should be > 0")
+	case p.ScaleIn < 0 || p.ScaleIn >= p.ScaleOut:
+		return errors.New("probe scale in threshold should be >= 0 and less than scale out threshold")
+	}
+	return nil
+}
+
+type probeResult struct {
+	Time    time.Time
+	Latency time.Duration
+	Failed  bool
+	// the request could not be sent (e.g. the connection was refused), so
+	// Latency is not a response time
+	Unreachable bool
+}
+
+// probeTarget is an app being probed.
+type probeTarget struct {
+	app   App
+	probe Probe
+	// when the app was last analyzed
+	watched time.Time
+	// routes of the app, as host.domain/path, and when they were looked up
+	routes   []string
+	routesAt time.Time
+	// when the first round of probes started, and when the next one is due
+	since time.Time
+	next  time.Time
+	// a round of probes is in progress
+	running bool
+	results []probeResult
+}
+
+// prober sends synthetic requests to the routes of the apps and keeps their
+// response times. The probes run in the background, so that slow routes do
+// not delay autoscaleApps, and are rate limited across all apps. It is safe to
+// use it concurrently.
+type prober struct {
+	// clock returns the current time; if nil, time.Now is used
+	clock  func() time.Time
+	client Client
+	// transport sends the probes; if nil, http.DefaultTransport is used
+	transport http.RoundTripper
+	// minimum time between two probes; 0 means no limit
+	gap time.Duration
+
+	// limitMu protects nextSlot, the time at which the next probe may be sent
+	limitMu  sync.Mutex
+	nextSlot time.Time
+
+	mu      sync.Mutex
+	targets map[string]*probeTarget
+}
+
+// newProber returns a prober sending at most rate probes per second.
+func newProber(client Client, rate float64, transport http.RoundTripper) *prober {
+	return &prober{client: client, transport: transport, gap: time.Duration(float64(time.Second) / rate)}
+}
+
+func (pr *prober) now() time.Time {
+	if pr.clock != nil {
+		return pr.clock()
+	}
+	return time.Now()
+}
+
+// watch requests the app to be probed; apps not watched for ProbeExpiry are
+// not probed anymore.
+func (pr *prober) watch(app App, probe Probe) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	if pr.targets == nil {
+		pr.targets = make(map[string]*probeTarget)
+	}
+	t := pr.targets[app.Guid]
+	if t == nil {
+		t = &probeTarget{}
+		pr.targets[app.Guid] = t
+	}
+	t.app, t.probe, t.watched = app, probe, pr.now()
+}
+
+// due returns the guids of the apps whose next round of probes is due, and
+// forgets the apps not watched anymore.
+func (pr *prober) due() []string {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	now := pr.now()
+	var guids []string
+	for guid, t := range pr.targets {
+		if now.Sub(t.watched) >= ProbeExpiry {
+			delete(pr.targets, guid)
+			continue
+		}
+		if !t.running && !now.Before(t.next) {
+			t.running = true
+			t.next = now.Add(t.probe.interval())
+			guids = append(guids, guid)
+		}
+	}
+	sort.Strings(guids)
+	return guids
+}
+
+// run probes the apps as they become due, forever.
+func (pr *prober) run(logger *log.Logger) {
+	for range time.Tick(ProbeTick) {
+		for _, guid := range pr.due() {
+			go pr.probeApp(guid, logger)
+		}
+	}
+}
+
+// wait blocks until the next probe may be sent.
+func (pr *prober) wait() {
+	if pr.gap <= 0 {
+		return
+	}
+	pr.limitMu.Lock()
+	now := time.Now()
+	slot := pr.nextSlot
+	if slot.Before(now) {
+		slot = now
+	}
+	pr.nextSlot = slot.Add(pr.gap)
+	pr.limitMu.Unlock()
+	time.Sleep(slot.Sub(now))
+}
+
+// probeApp sends a round of probes, one per route of the app, concurrently.
+func (pr *prober) probeApp(guid string, logger *log.Logger) {
+	pr.mu.Lock()
+	t := pr.targets[guid]
+	if t == nil {
+		pr.mu.Unlock()
+		return
+	}
+	app, probe, routes, routesAt := t.app, t.probe, t.routes, t.routesAt
+	pr.mu.Unlock()
+
+	defer func() {
+		pr.mu.Lock()
+		t.running = false
+		pr.mu.Unlock()
+	}()
+
+	start := pr.now()
+	if routesAt.IsZero() || start.Sub(routesAt) >= ProbeRoutesInterval {
+		r, err := pr.client.AppRoutes(app)
+		if err != nil {
+			logger.Print(errors.Wrapf(err, "probe app %v: get routes", app))
+			return
+		}
+		routes = r
+		pr.mu.Lock()
+		t.routes, t.routesAt = routes, start
+		pr.mu.Unlock()
+	}
+
+	results := make([]probeResult, len(routes))
+	var wg sync.WaitGroup
+	for i, route := range routes {
+		wg.Add(1)
+		go func(i int, url string) {
+			defer wg.Done()
+			pr.wait()
+			results[i] = pr.probe(url, probe.timeout())
+		}(i, probe.scheme()+"://"+strings.TrimSuffix(route, "/")+probe.path())
+	}
+	wg.Wait()
+
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	if t.since.IsZero() {
+		t.since = start
+	}
+	r := append(t.results, results...)
+	now := pr.now()
+	i := 0
+	for i < len(r) && now.Sub(r[i].Time) >= probe.window() {
+		i++
+	}
+	t.results = r[i:]
+}
+
+// probe sends a GET request to url. Requests that fail, time out or get a 5xx
+// response are failed; those that time out or get a 5xx response count as
+// taking the full timeout, while the others have no response time.
+func (pr *prober) probe(url string, timeout time.Duration) probeResult {
+	client := &http.Client{Transport: pr.transport, Timeout: timeout}
+	start := time.Now()
+	res, err := client.Get(url)
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, io.LimitReader(res.Body, ProbeMaxBodySize))
+		res.Body.Close()
+	}
+	r := probeResult{Time: pr.now(), Latency: time.Since(start)}
+	if e, ok := err.(net.Error); err != nil && (!ok || !e.Timeout()) {
+		r.Latency, r.Failed, r.Unreachable = 0, true, true
+	} else if err != nil || res.StatusCode >= 500 {
+		r.Latency, r.Failed = timeout, true
+	}
+	return r
+}
+
+// stats returns the percentile of the response times of the probes of the app
+// over the window of its probe (0 if no probe got a response or timed out),
+// the percentage of failed probes and the number of probes. An error is
+// returned if the app has not been probed for a full window.
+func (pr *prober) stats(guid string) (latency time.Duration, failures float64, n int, err error) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	t := pr.targets[guid]
+	if t == nil || t.since.IsZero() {
+		return 0, 0, 0, errors.New("not probed yet")
+	}
+	if len(t.routes) == 0 {
+		return 0, 0, 0, errors.New("no routes to probe")
+	}
+	now := pr.now()
+	if now.Sub(t.since) < t.probe.window() {
+		return 0, 0, 0, errors.Errorf("probed for less than %s", t.probe.window())
+	}
+
+	var latencies []float64
+	for _, r := range t.results {
+		if now.Sub(r.Time) >= t.probe.window() {
+			continue
+		}
+		n++
+		if r.Failed {
+			failures++
+		}
+		if !r.Unreachable {
+			latencies = append(latencies, float64(r.Latency))
+		}
+	}
+	if n == 0 {
+		return 0, 0, 0, errors.Errorf("no probes in the last %s", t.probe.window())
+	}
+	if len(latencies) > 0 {
+		sort.Float64s(latencies)
+		latency = time.Duration(math.Ceil(percentile(latencies, t.probe.percentile())))
+	}
+	return latency, failures / float64(n) * 100, n, nil
+}
+
+// probeLatency returns the app with ProbeLatency and ProbeFailures set from
+// the probes sent to its routes.
+func (as *autoscaler) probeLatency(rule Rule, app App) (App, error) {
+	if as.probes == nil {
+		return app, errors.New("prober not running")
+	}
+	as.probes.watch(app, *rule.Probe)
+	latency, failures, n, err := as.probes.stats(app.Guid)
+	if err != nil {
+		return app, errors.Wrap(err, "probe")
+	}
+	app.ProbeLatency, app.ProbeFailures = latency, failures
+	as.log.Printf("autoscale app %v: %d probes, p%g latency %s, %.1f%% failed", app, n, rule.Probe.percentile(), latency, failures)
+	return app, nil
+}
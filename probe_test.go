@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// probedApp returns a stand-in for an app answering probes at /app/health
+// after delay with status, and recording the times of the requests.
+func probedApp(delay *time.Duration, status *int, times *[]time.Time) *httptest.Server {
+	var mu sync.Mutex
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/app/health" {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		*times = append(*times, time.Now())
+		d, s := *delay, *status
+		mu.Unlock()
+		time.Sleep(d)
+		w.WriteHeader(s)
+	}))
+}
+
+var insecureTransport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+
+func TestProberRateLimit(t *testing.T) {
+	delay, status, times := time.Duration(0), http.StatusOK, []time.Time{}
+	server := probedApp(&delay, &status, &times)
+	defer server.Close()
+	route := strings.TrimPrefix(server.URL, "https://") + "/app"
+
+	mock := &MockClient{Routes: map[string][]string{guid: {route, route, route, route, route}}}
+	pr := newProber(mock, 100, insecureTransport)
+	pr.watch(App{Guid: guid}, Probe{Path: "/health", ScaleOut: Duration(time.Second)})
+	guids := pr.due()
+	if len(guids) != 1 || guids[0] != guid {
+		t.Fatalf("wrong due apps: %v", guids)
+	}
+	// the round is still in progress
+	if guids := pr.due(); len(guids) != 0 {
+		t.Fatalf("wrong due apps: %v", guids)
+	}
+
+	// 100 probes per second: the last one is sent 40ms after the first one
+	start := time.Now()
+	pr.probeApp(guid, log.New(ioutil.Discard, "", 0))
+	if len(times) != 5 {
+		t.Fatalf("%d probes sent", len(times))
+	}
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Fatalf("probes sent within %s", d)
+	}
+	if len(pr.targets[guid].results) != 5 || pr.targets[guid].running {
+		t.Fatalf("wrong target: %+v", pr.targets[guid])
+	}
+}
+
+func TestProberRoutes(t *testing.T) {
+	now := time.Now()
+	buf := &bytes.Buffer{}
+	logger := log.New(buf, "", 0)
+	mock := &MockClient{Routes: map[string][]string{guid: {}}}
+	pr := &prober{client: mock, clock: func() time.Time { return now }}
+	app := App{Guid: guid, App: "a", Space: "s", Org: "o"}
+
+	if _, _, _, err := pr.stats(guid); err == nil {
+		t.Fatalf("stats of an app not probed")
+	}
+
+	pr.watch(app, Probe{ScaleOut: Duration(time.Second)})
+	for _, guid := range pr.due() {
+		pr.probeApp(guid, logger)
+	}
+	now = now.Add(2 * time.Minute)
+	if _, _, _, err := pr.stats(guid); err == nil || err.Error() != "no routes to probe" {
+		t.Fatalf("stats of an app without routes: %v", err)
+	}
+
+	// not looked up again yet
+	mock.Routes[guid] = []string{"a.example.com"}
+	pr.watch(app, Probe{ScaleOut: Duration(time.Second)})
+	for _, guid := range pr.due() {
+		pr.probeApp(guid, logger)
+	}
+	if len(pr.targets[guid].routes) != 0 {
+		t.Fatalf("routes looked up again: %v", pr.targets[guid].routes)
+	}
+
+	mock.RoutesError = errors.New("api down")
+	now = now.Add(ProbeRoutesInterval)
+	pr.watch(app, Probe{ScaleOut: Duration(time.Second)})
+	for _, guid := range pr.due() {
+		pr.probeApp(guid, logger)
+	}
+	if !strings.Contains(buf.String(), "get routes: api down") {
+		t.Fatalf("error not logged: %s", buf.String())
+	}
+
+	// apps not analyzed anymore are not probed
+	now = now.Add(ProbeExpiry)
+	if guids := pr.due(); len(guids) != 0 || len(pr.targets) != 0 {
+		t.Fatalf("expired app still probed: %v", guids)
+	}
+}
+
+func TestProbeUnreachable(t *testing.T) {
+	delay, status, times := time.Duration(0), http.StatusOK, []time.Time{}
+	server := probedApp(&delay, &status, &times)
+	defer server.Close()
+	plain := httptest.NewServer(server.Config.Handler)
+	defer plain.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	now := time.Now()
+	logger := log.New(ioutil.Discard, "", 0)
+	tests := []struct {
+		url       string
+		probe     Probe
+		responded bool
+		failures  float64
+	}{
+		{plain.URL, Probe{Scheme: "http", Path: "/health", ScaleOut: Duration(time.Second)}, true, 0},
+		// the route does not serve https, or does not accept connections:
+		// the probes failed without a response time
+		{plain.URL, Probe{Path: "/health", ScaleOut: Duration(time.Second)}, false, 100},
+		{closed.URL, Probe{Scheme: "http", Path: "/health", ScaleOut: Duration(time.Second)}, false, 100},
+	}
+	for i, test := range tests {
+		mock := &MockClient{Routes: map[string][]string{guid: {strings.TrimPrefix(test.url, "http://") + "/app"}}}
+		pr := &prober{client: mock, clock: func() time.Time { return now }, transport: insecureTransport}
+		// probed for a full window, the first probe is out of the window
+		for r := 0; r < 2; r++ {
+			pr.watch(App{Guid: guid}, test.probe)
+			for _, guid := range pr.due() {
+				pr.probeApp(guid, logger)
+			}
+			now = now.Add(time.Minute)
+		}
+		now = now.Add(-time.Minute)
+		latency, failures, n, err := pr.stats(guid)
+		if err != nil || n != 1 || failures != test.failures || (latency > 0) != test.responded || latency >= time.Second {
+			t.Fatalf("%d: got %s %g%% %d %v", i, latency, failures, n, err)
+		}
+	}
+}
+
+func TestProbeScaling(t *testing.T) {
+	probe := &Probe{Path: "/health", Timeout: Duration(500 * time.Millisecond), ScaleIn: Duration(30 * time.Millisecond), ScaleOut: Duration(50 * time.Millisecond)}
+	rules := []Rule{
+		Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 10, Probe: probe},
+	}
+	if err := validateRules(rules); err != nil {
+		t.Fatalf("validateRules: %s", err)
+	}
+
+	delay, status, times := time.Duration(0), http.StatusOK, []time.Time{}
+	server := probedApp(&delay, &status, &times)
+	defer server.Close()
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+	mock := &MockClient{Routes: map[string][]string{guid: {strings.TrimPrefix(server.URL, "https://") + "/app"}}}
+	pr := &prober{clock: clock, client: mock, transport: insecureTransport}
+	logger := log.New(ioutil.Discard, "", 0)
+
+	tests := []struct {
+		delay  time.Duration
+		status int
+		exp    int // 0 if not scaled
+	}{
+		// the app is probed only after it has been analyzed
+		{0, http.StatusOK, 0},
+		// not probed for a full window yet
+		{60 * time.Millisecond, http.StatusOK, 0},
+		{60 * time.Millisecond, http.StatusOK, 0},
+		{60 * time.Millisecond, http.StatusOK, 5},
+		// the slow probes are still in the window
+		{0, http.StatusOK, 5},
+		{0, http.StatusOK, 3},
+		// failed probes count as taking the full timeout
+		{0, http.StatusServiceUnavailable, 5},
+	}
+
+	for i, test := range tests {
+		delay, status = test.delay, test.status
+		// the app is analyzed every 30 seconds and probed every 10
+		for s := 0; s < 3; s++ {
+			now = now.Add(10 * time.Second)
+			for _, guid := range pr.due() {
+				pr.probeApp(guid, logger)
+			}
+		}
+
+		buf := &bytes.Buffer{}
+		as := &autoscaler{rules: rules, log: log.New(buf, "", log.Lshortfile), clock: clock, probes: pr}
+		mock.Apps = Apps{guid: App{App: "a", Space: "s", Org: "o", Guid: guid, Instances: 4, InstancesRunning: 4}}
+		mock.ScaleDesired = nil
+		as.client = mock
+		as.autoscaleApps()
+
+		switch {
+		case test.exp == 0 && mock.ScaleDesired != nil:
+			t.Fatalf("%d: scaled to %d\n%s", i, *mock.ScaleDesired, buf.String())
+		case test.exp != 0 && (mock.ScaleDesired == nil || *mock.ScaleDesired != test.exp):
+			t.Fatalf("%d: not scaled to %d\n%s", i, test.exp, buf.String())
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// promSample is a sample of the Prometheus text exposition format.
+type promSample struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+}
+
+// parsePrometheus parses metrics in the Prometheus text exposition format.
+// Comments, type hints and timestamps are ignored.
+func parsePrometheus(r io.Reader) ([]promSample, error) {
+	var samples []promSample
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		s, err := parsePrometheusLine(line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", n)
+		}
+		samples = append(samples, s)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "read metrics")
+	}
+	return samples, nil
+}
+
+func parsePrometheusLine(line string) (promSample, error) {
+	s := promSample{Labels: map[string]string{}}
+
+	i := strings.IndexAny(line, "{ \t")
+	if i <= 0 {
+		return s, errors.New("missing value")
+	}
+	s.Name, line = line[:i], line[i:]
+
+	if line[0] == '{' {
+		line = line[1:]
+		for {
+			line = strings.TrimLeft(line, " \t,")
+			if line == "" {
+				return s, errors.New("unterminated labels")
+			}
+			if line[0] == '}' {
+				line = line[1:]
+				break
+			}
+			eq := strings.IndexByte(line, '=')
+			if eq <= 0 || len(line) < eq+2 || line[eq+1] != '"' {
+				return s, errors.New("invalid label")
+			}
+			name := strings.TrimSpace(line[:eq])
+			value, rest, err := unquoteLabel(line[eq+2:])
+			if err != nil {
+				return s, err
+			}
+			s.Labels[name], line = value, rest
+		}
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 || len(fields) > 2 {
+		return s, errors.New("invalid value")
+	}
+	v, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return s, errors.Wrap(err, "parse value")
+	}
+	s.Value = v
+	return s, nil
+}
+
+// unquoteLabel returns the label value at the start of s, that must be
+// terminated by a double quote, and the rest of s after the quote.
+func unquoteLabel(s string) (value, rest string, err error) {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"':
+			return string(b), s[i+1:], nil
+		case c == '\\' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case 'n':
+				b = append(b, '\n')
+			default:
+				b = append(b, s[i])
+			}
+		default:
+			b = append(b, c)
+		}
+	}
+	return "", "", errors.New("unterminated label value")
+}
+
+// matches returns true if the sample is named name and has all the labels.
+func (s promSample) matches(name string, labels map[string]string) bool {
+	if s.Name != name {
+		return false
+	}
+	for k, v := range labels {
+		if s.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// scrape returns the values of the samples of the metric matching the labels
+// exposed at url. If instance is not empty, the request is routed by the
+// gorouter to that instance ("guid:index").
+func scrape(client *http.Client, url, instance, metric string, labels map[string]string) ([]float64, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "create request")
+	}
+	req.Header.Set("Accept", "text/plain")
+	if instance != "" {
+		req.Header.Set("X-CF-APP-INSTANCE", instance)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "get metrics")
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("get metrics: unexpected status %s", res.Status)
+	}
+
+	samples, err := parsePrometheus(res.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse metrics")
+	}
+	var values []float64
+	for _, s := range samples {
+		if s.matches(metric, labels) {
+			values = append(values, s.Value)
+		}
+	}
+	return values, nil
+}
+
+// scrapeApp returns the values of the samples of the metric of the custom
+// metric, scraped from each running instance of the app (excluding those
+// warming up) or from the aggregate endpoint.
+func scrapeApp(client *http.Client, m CustomMetric, app App) ([]float64, error) {
+	if !m.PerInstance {
+		return scrape(client, m.URL, "", m.Metric, m.Labels)
+	}
+
+	if len(app.Stats) == 0 {
+		return nil, errors.New("no running instances to scrape")
+	}
+	values := make([][]float64, len(app.Stats))
+	errs := make([]error, len(app.Stats))
+	var wg sync.WaitGroup
+	for i, s := range app.Stats {
+		wg.Add(1)
+		go func(i int, index string) {
+			defer wg.Done()
+			values[i], errs[i] = scrape(client, m.URL, app.Guid+":"+index, m.Metric, m.Labels)
+		}(i, s.Index)
+	}
+	wg.Wait()
+
+	var r []float64
+	for i, s := range app.Stats {
+		if errs[i] != nil {
+			return nil, errors.Wrapf(errs[i], "instance %s", s.Index)
+		}
+		r = append(r, values[i]...)
+	}
+	return r, nil
+}
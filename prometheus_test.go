@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePrometheus(t *testing.T) {
+	text := `# HELP http_requests_in_flight Requests being served.
+# TYPE http_requests_in_flight gauge
+http_requests_in_flight 3
+http_requests_total{method="GET",code="200"} 1027 1395066363000
+http_requests_total{method="POST", code="500",} 3
+escaped{path="C:\\dir\\",msg="say \"hi\"\n"} +Inf
+
+queue_length{} -1.5e2
+`
+	samples, err := parsePrometheus(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("parsePrometheus: %s", err)
+	}
+	exp := []promSample{
+		{"http_requests_in_flight", map[string]string{}, 3},
+		{"http_requests_total", map[string]string{"method": "GET", "code": "200"}, 1027},
+		{"http_requests_total", map[string]string{"method": "POST", "code": "500"}, 3},
+		{"escaped", map[string]string{"path": `C:\dir\`, "msg": "say \"hi\"\n"}, math.Inf(1)},
+		{"queue_length", map[string]string{}, -150},
+	}
+	if !reflect.DeepEqual(samples, exp) {
+		t.Fatalf("got %+v, expected %+v", samples, exp)
+	}
+
+	for _, text := range []string{"metric", `metric{a="b" 1`, `metric{a=b} 1`, `metric{a="b} 1`, "metric one", "metric 1 2 3"} {
+		if _, err := parsePrometheus(strings.NewReader(text)); err == nil {
+			t.Fatalf("parsed %q", text)
+		}
+	}
+}
+
+func TestCustomMetricScaling(t *testing.T) {
+	// jobs pending in each instance, keyed by "guid:index"
+	pending := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		instance := r.Header.Get("X-CF-APP-INSTANCE")
+		if _, found := pending[instance]; !found {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, "# TYPE jobs_pending gauge\njobs_pending{queue=\"default\"} %d\njobs_pending{queue=\"low\"} 1000\n", pending[instance])
+	}))
+	defer server.Close()
+
+	rules := []Rule{
+		Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 10, CustomMetric: &CustomMetric{Metric: "jobs_pending", Labels: map[string]string{"queue": "default"}, Aggregation: AggregationSum, URL: server.URL + "/metrics", PerInstance: true, ScaleIn: 10, ScaleOut: 100}},
+	}
+	if err := validateRules(rules); err != nil {
+		t.Fatalf("validateRules: %s", err)
+	}
+
+	tests := []struct {
+		pending []int
+		exp     int // 0 if not scaled
+	}{
+		{[]int{10, 20, 30, 0}, 0},
+		{[]int{40, 30, 30, 0}, 5},
+		{[]int{1, 2, 3, 4}, 3},
+		// the instance can not be scraped
+		{[]int{40, 30, 30, -1}, 0},
+	}
+
+	for i, test := range tests {
+		app := App{App: "a", Space: "s", Org: "o", Guid: guid, Instances: 4, InstancesRunning: 4, CpuAvg: 50}
+		for idx, n := range test.pending {
+			instance := fmt.Sprintf("%s:%d", guid, idx)
+			app.Stats = append(app.Stats, InstanceStats{fmt.Sprint(idx), 50, 50, 0})
+			if n >= 0 {
+				pending[instance] = n
+			} else {
+				delete(pending, instance)
+			}
+		}
+
+		buf := &bytes.Buffer{}
+		as := &autoscaler{rules: rules, log: log.New(buf, "", log.Lshortfile), clock: time.Now}
+		mock := &MockClient{Apps: Apps{guid: app}}
+		as.client = mock
+		as.autoscaleApps()
+
+		switch {
+		case test.exp == 0 && mock.ScaleDesired != nil:
+			t.Fatalf("%d: scaled to %d\n%s", i, *mock.ScaleDesired, buf.String())
+		case test.exp != 0 && (mock.ScaleDesired == nil || *mock.ScaleDesired != test.exp):
+			t.Fatalf("%d: not scaled to %d\n%s", i, test.exp, buf.String())
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// custom metrics can be the result of a PromQL query
+const SourcePromQL = "promql"
+
+// promSeries is an element of the result of an instant PromQL query.
+type promSeries struct {
+	Labels map[string]string
+	Value  float64
+}
+
+// promQuery runs an instant PromQL query against the Prometheus HTTP API at
+// base (e.g. https://prometheus.example.com), sending the headers, and
+// returns the resulting series. Scalar results are returned as one series
+// without labels.
+func promQuery(client *http.Client, base, query string, header http.Header) ([]promSeries, error) {
+	req, err := http.NewRequest("GET", base+"/api/v1/query?"+url.Values{"query": {query}}.Encode(), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "create request")
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "query")
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "read response")
+	}
+
+	var r struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+		Data   struct {
+			ResultType string          `json:"resultType"`
+			Result     json.RawMessage `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, errors.Errorf("query: %s: %s", res.Status, b)
+	}
+	if r.Status != "success" {
+		return nil, errors.Errorf("query: %s: %s", res.Status, r.Error)
+	}
+
+	switch r.Data.ResultType {
+	case "vector":
+		var vector []struct {
+			Metric map[string]string `json:"metric"`
+			Value  [2]interface{}    `json:"value"`
+		}
+		if err := json.Unmarshal(r.Data.Result, &vector); err != nil {
+			return nil, errors.Wrap(err, "decode vector")
+		}
+		series := make([]promSeries, len(vector))
+		for i, v := range vector {
+			value, err := promValue(v.Value)
+			if err != nil {
+				return nil, err
+			}
+			series[i] = promSeries{Labels: v.Metric, Value: value}
+		}
+		return series, nil
+	case "scalar":
+		var scalar [2]interface{}
+		if err := json.Unmarshal(r.Data.Result, &scalar); err != nil {
+			return nil, errors.Wrap(err, "decode scalar")
+		}
+		value, err := promValue(scalar)
+		if err != nil {
+			return nil, err
+		}
+		return []promSeries{{Value: value}}, nil
+	}
+	return nil, errors.Errorf("unsupported result type %q", r.Data.ResultType)
+}
+
+// promValue decodes a [timestamp, "value"] pair.
+func promValue(v [2]interface{}) (float64, error) {
+	s, ok := v[1].(string)
+	if !ok {
+		return 0, errors.Errorf("invalid value %v", v[1])
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid value %q", s)
+	}
+	return f, nil
+}
+
+// queryData holds the values of the placeholders of query templates.
+type queryData struct {
+	App   string
+	Space string
+	Org   string
+	Guid  string
+}
+
+// promEscaper escapes strings for use in double-quoted PromQL strings.
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// expandQuery expands the query template for the app; the values are escaped
+// for use in double-quoted label values.
+func expandQuery(query string, app App) (string, error) {
+	t, err := template.New("query").Parse(query)
+	if err != nil {
+		return "", err
+	}
+	data := queryData{
+		App:   promEscaper.Replace(app.App),
+		Space: promEscaper.Replace(app.Space),
+		Org:   promEscaper.Replace(app.Org),
+		Guid:  promEscaper.Replace(app.Guid),
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// queryApp returns the values of the series resulting from the query of the
+// custom metric for the app.
+func queryApp(client *http.Client, m CustomMetric, app App) ([]float64, error) {
+	q, err := expandQuery(m.Query, app)
+	if err != nil {
+		return nil, errors.Wrap(err, "expand query")
+	}
+	series, err := promQuery(client, strings.TrimSuffix(m.URL, "/"), q, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%q", q)
+	}
+	values := make([]float64, len(series))
+	for i, s := range series {
+		if math.IsNaN(s.Value) {
+			return nil, errors.Errorf("%q: NaN result", q)
+		}
+		values[i] = s.Value
+	}
+	return values, nil
+}
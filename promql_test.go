@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExpandQuery(t *testing.T) {
+	app := App{Guid: guid, App: `my"app`, Space: "s", Org: "o"}
+	q, err := expandQuery(`sum(rate(http_requests_total{app="{{.App}}",space="{{.Space}}",org="{{.Org}}"}[1m])) / count(up{guid="{{.Guid}}"})`, app)
+	if err != nil {
+		t.Fatalf("expandQuery: %s", err)
+	}
+	if exp := `sum(rate(http_requests_total{app="my\"app",space="s",org="o"}[1m])) / count(up{guid="` + guid + `"})`; q != exp {
+		t.Fatalf("got %s, expected %s", q, exp)
+	}
+
+	for _, query := range []string{`up{app="{{.App}"}`, `up{app="{{.Name}}"}`} {
+		if _, err := expandQuery(query, app); err == nil {
+			t.Fatalf("expanded %s", query)
+		}
+	}
+}
+
+func TestPromQLMetric(t *testing.T) {
+	query := `avg(queue_depth{app="{{.App}}",space="{{.Space}}"})`
+	expanded := `avg(queue_depth{app="a",space="s"})`
+
+	var result string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "user" || password != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/api/v1/query" || r.URL.Query().Get("query") != expanded || result == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"status":"error","errorType":"bad_data","error":"unexpected query"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"status":"success","data":%s}`, result)
+	}))
+	defer server.Close()
+	u := strings.Replace(server.URL, "http://", "http://user:secret@", 1) + "/"
+
+	rules := []Rule{
+		Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 10, CustomMetric: &CustomMetric{Source: SourcePromQL, Query: query, URL: u, ScaleIn: 10, ScaleOut: 100}},
+	}
+	if err := validateRules(rules); err != nil {
+		t.Fatalf("validateRules: %s", err)
+	}
+
+	vector := `{"resultType":"vector","result":[{"metric":{},"value":[1500000000,"%s"]}]}`
+	tests := []struct {
+		result string
+		exp    int // 0 if not scaled
+	}{
+		{fmt.Sprintf(vector, "50"), 0},
+		{fmt.Sprintf(vector, "150"), 5},
+		{`{"resultType":"scalar","result":[1500000000,"5"]}`, 3},
+		// query failures, empty or NaN results are not decisions
+		{"", 0},
+		{`{"resultType":"vector","result":[]}`, 0},
+		{fmt.Sprintf(vector, "NaN"), 0},
+	}
+
+	for i, test := range tests {
+		result = test.result
+		buf := &bytes.Buffer{}
+		as := &autoscaler{rules: rules, log: log.New(buf, "", log.Lshortfile)}
+		mock := &MockClient{Apps: Apps{guid: App{App: "a", Space: "s", Org: "o", Guid: guid, Instances: 4, InstancesRunning: 4}}}
+		as.client = mock
+		as.autoscaleApps()
+
+		switch {
+		case test.exp == 0 && mock.ScaleDesired != nil:
+			t.Fatalf("%d: scaled to %d\n%s", i, *mock.ScaleDesired, buf.String())
+		case test.exp != 0 && (mock.ScaleDesired == nil || *mock.ScaleDesired != test.exp):
+			t.Fatalf("%d: not scaled to %d\n%s", i, test.exp, buf.String())
+		case test.exp == 0 && test.result != fmt.Sprintf(vector, "50") && !strings.Contains(buf.String(), "read query"):
+			t.Fatalf("%d: failure not logged\n%s", i, buf.String())
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Queue scales an app so that each instance has at most messages per instance
+// messages waiting in a RabbitMQ queue. The management API is reached at
+// management url, or at the URL in the credentials of the service with that
+// name in VCAP_SERVICES.
+type Queue struct {
+	Name                string `json:"name"`
+	Vhost               string `json:"vhost"`
+	MessagesPerInstance int    `json:"messages_per_instance"`
+	Service             string `json:"service"`
+	ManagementURL       string `json:"management_url"`
+	Username            string `json:"username"`
+	Password            string `json:"password"`
+}
+
+func validateQueue(q Queue) error {
+	switch {
+	case q.Name == "":
+		return errors.New("queue name is required")
+	case q.MessagesPerInstance <= 0:
+		return errors.New("queue messages per instance should be > 0")
+	case q.ManagementURL == "":
+		return errors.New("queue management url or service is required")
+	}
+	if _, err := url.Parse(q.ManagementURL); err != nil {
+		return errors.Wrap(err, "parse queue management url")
+	}
+	return nil
+}
+
+// resolveQueues sets the management URL and credentials of the queues of the
+// rules that refer to a service, from the credentials of that service in
+// vcapServices (the content of VCAP_SERVICES). It must be called before the
+// rules are validated.
+func resolveQueues(rules []Rule, vcapServices string) error {
+	var services map[string][]struct {
+		Name        string `json:"name"`
+		Credentials struct {
+			HttpApiUri string `json:"http_api_uri"`
+			Protocols  struct {
+				Management struct {
+					Uri string `json:"uri"`
+				} `json:"management"`
+			} `json:"protocols"`
+		} `json:"credentials"`
+	}
+
+	for idx := range rules {
+		q := rules[idx].Queue
+		if q == nil || q.Service == "" {
+			continue
+		}
+		if services == nil && vcapServices != "" {
+			if err := json.Unmarshal([]byte(vcapServices), &services); err != nil {
+				return errors.Wrap(err, "parse VCAP_SERVICES")
+			}
+		}
+
+		uri := ""
+		for _, instances := range services {
+			for _, s := range instances {
+				if s.Name != q.Service {
+					continue
+				}
+				uri = s.Credentials.HttpApiUri
+				if uri == "" {
+					uri = s.Credentials.Protocols.Management.Uri
+				}
+			}
+		}
+		if uri == "" {
+			return errors.Errorf("rule %d: no management api uri for service %q in VCAP_SERVICES", idx, q.Service)
+		}
+
+		u, err := url.Parse(uri)
+		if err != nil {
+			return errors.Wrapf(err, "rule %d: parse management api uri of service %q", idx, q.Service)
+		}
+		if u.User != nil {
+			q.Username = u.User.Username()
+			q.Password, _ = u.User.Password()
+			u.User = nil
+		}
+		q.ManagementURL = u.String()
+	}
+	return nil
+}
+
+// QueueStats are the statistics of a queue returned by the management API.
+type QueueStats struct {
+	Messages     int `json:"messages"`
+	Consumers    int `json:"consumers"`
+	MessageStats struct {
+		PublishDetails struct {
+			Rate float64 `json:"rate"`
+		} `json:"publish_details"`
+		AckDetails struct {
+			Rate float64 `json:"rate"`
+		} `json:"ack_details"`
+	} `json:"message_stats"`
+}
+
+// readQueue returns the statistics of the queue from the management API.
+func readQueue(client *http.Client, q Queue) (QueueStats, error) {
+	var stats QueueStats
+	vhost := q.Vhost
+	if vhost == "" {
+		vhost = "/"
+	}
+	u := strings.TrimRight(q.ManagementURL, "/") + "/queues/" + url.PathEscape(vhost) + "/" + url.PathEscape(q.Name)
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return stats, errors.Wrap(err, "create request")
+	}
+	if q.Username != "" {
+		req.SetBasicAuth(q.Username, q.Password)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return stats, errors.Wrap(err, "get queue")
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return stats, errors.Errorf("get queue: unexpected status %s", res.Status)
+	}
+	if err := json.NewDecoder(res.Body).Decode(&stats); err != nil {
+		return stats, errors.Wrap(err, "decode queue")
+	}
+	return stats, nil
+}
+
+// queueInstances returns the number of instances required to have at most
+// messages per instance messages waiting for each instance and, if messages
+// are published faster than the running instances acknowledge them, to keep
+// up with the publish rate before the queue grows.
+func queueInstances(rule Rule, stats QueueStats, running int) int {
+	n := int(math.Ceil(float64(stats.Messages) / float64(rule.Queue.MessagesPerInstance)))
+	publish, ack := stats.MessageStats.PublishDetails.Rate, stats.MessageStats.AckDetails.Rate
+	if running > 0 && ack > 0 && publish > ack {
+		// each running instance acknowledges ack/running messages per second
+		if r := int(math.Ceil(publish / ack * float64(running))); r > n {
+			n = r
+		}
+	}
+	switch {
+	case n < rule.MinInstances:
+		n = rule.MinInstances
+	case n > rule.MaxInstances:
+		n = rule.MaxInstances
+	}
+	return n
+}
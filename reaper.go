@@ -0,0 +1,74 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// reaper tracks the outlier instances of an app and their restarts
+type reaper struct {
+	// number of consecutive iterations each instance has been an outlier for
+	Counts   map[string]int
+	Restarts []time.Time
+}
+
+// trackOutliers updates the number of consecutive iterations each instance of
+// the app has been an outlier for.
+func (as *autoscaler) trackOutliers(app App) *reaper {
+	if as.reapers == nil {
+		as.reapers = make(map[string]*reaper)
+	}
+	r := as.reapers[app.Guid]
+	if r == nil {
+		r = &reaper{}
+		as.reapers[app.Guid] = r
+	}
+
+	counts := make(map[string]int)
+	for _, o := range app.Outliers {
+		if _, found := counts[o.Index]; !found {
+			// an instance can be an outlier for multiple metrics
+			counts[o.Index] = r.Counts[o.Index] + 1
+		}
+	}
+	r.Counts = counts
+	return r
+}
+
+// reapApp restarts an instance of the app that has been an outlier for at
+// least restart_outliers_after consecutive iterations, unless the app has
+// crashed, restarting or warming up instances or the hourly restart budget is
+// exhausted.
+func (as *autoscaler) reapApp(rule Rule, app App) error {
+	r := as.reapers[app.Guid]
+	if rule.RestartOutliersAfter == 0 || r == nil || app.InstancesRunning < app.Instances || app.Warming > 0 {
+		return nil
+	}
+
+	now := as.now()
+	for len(r.Restarts) > 0 && now.Sub(r.Restarts[0]) >= time.Hour {
+		r.Restarts = r.Restarts[1:]
+	}
+
+	for _, s := range app.Stats {
+		count := r.Counts[s.Index]
+		if count < rule.RestartOutliersAfter {
+			continue
+		}
+		if len(r.Restarts) >= rule.MaxRestartsPerHour {
+			as.log.Printf("autoscale app %v: not restarting outlier instance %s: %d restarts in the last hour", app, s.Index, len(r.Restarts))
+			return nil
+		}
+
+		as.log.Printf("autoscale app %v: restarting instance %s, outlier for %d iterations", app, s.Index, count)
+		if err := as.client.RestartInstance(app, s.Index); err != nil {
+			return errors.Wrapf(err, "restart instance %s", s.Index)
+		}
+		r.Restarts = append(r.Restarts, now)
+		delete(r.Counts, s.Index)
+		// at most one instance at a time
+		return nil
+	}
+	return nil
+}
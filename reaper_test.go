@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestReaper(t *testing.T) {
+	rules := []Rule{
+		Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 10, MinCpu: 20, MaxCpu: 80, RestartOutliersAfter: 3, MaxRestartsPerHour: 2},
+	}
+	if err := validateRules(rules); err != nil {
+		t.Fatalf("validateRules: %s", err)
+	}
+
+	stats := []InstanceStats{{"0", 50, 50, 0}, {"1", 50, 50, 0}, {"2", 50, 50, 0}, {"3", 0, 50, 0}}
+	outlier := func(index ...string) []Outlier {
+		var r []Outlier
+		for _, i := range index {
+			r = append(r, Outlier{Index: i, Metric: MetricCpu})
+		}
+		return r
+	}
+
+	tests := []struct {
+		running  int
+		warming  int
+		cpu      int
+		outliers []Outlier
+		restart  string
+	}{
+		{4, 0, 50, outlier("3"), ""},
+		{4, 0, 50, outlier("3"), ""},
+		{4, 0, 50, outlier("3"), "3"},
+		// instance restarting
+		{3, 0, 50, nil, ""},
+		{4, 0, 50, outlier("3"), ""},
+		// not consecutive
+		{4, 0, 50, nil, ""},
+		{4, 0, 50, outlier("3"), ""},
+		{4, 0, 50, outlier("3"), ""},
+		// app crashing
+		{3, 0, 50, outlier("3"), ""},
+		// app scaling
+		{4, 0, 90, outlier("3"), ""},
+		{4, 0, 50, outlier("3"), "3"},
+		// budget exhausted
+		{4, 0, 50, outlier("2"), ""},
+		{4, 0, 50, outlier("2"), ""},
+		{4, 0, 50, outlier("2"), ""},
+		{4, 0, 50, outlier("2", "3"), ""},
+		// budget available again after an hour
+		{-1, 0, 0, nil, ""},
+		{4, 0, 50, outlier("2", "3"), "2"},
+		{3, 0, 50, outlier("3"), ""},
+		{4, 0, 50, outlier("3"), "3"},
+		// instance warming up
+		{-1, 0, 0, nil, ""},
+		{4, 0, 50, outlier("3"), ""},
+		{4, 0, 50, outlier("3"), ""},
+		{4, 1, 50, outlier("3"), ""},
+		{4, 0, 50, outlier("3"), "3"},
+	}
+
+	now := time.Now()
+	buf := &bytes.Buffer{}
+	as := &autoscaler{rules: rules, log: log.New(buf, "", log.Lshortfile), clock: func() time.Time { return now }}
+
+	for i, test := range tests {
+		if test.running < 0 {
+			now = now.Add(time.Hour)
+			continue
+		}
+		now = now.Add(Interval)
+		app := App{App: "a", Space: "s", Org: "o", Guid: guid, Instances: 4, InstancesRunning: test.running, Warming: test.warming, CpuAvg: test.cpu, MemAvg: 50, Stats: stats, Outliers: test.outliers}
+		mock := &MockClient{Apps: Apps{guid: app}}
+		as.client = mock
+		as.autoscaleApps()
+
+		if test.restart == "" && mock.RestartIndex != nil {
+			t.Fatalf("%d: RestartInstance called: %s\n%s", i, *mock.RestartIndex, buf.String())
+		} else if test.restart != "" && (mock.RestartIndex == nil || *mock.RestartIndex != test.restart || mock.RestartApp.Guid != guid) {
+			t.Fatalf("%d: RestartInstance not called with %s\n%s", i, test.restart, buf.String())
+		}
+	}
+}
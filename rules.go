@@ -1,21 +1,97 @@
 package main
 
 import (
+	"encoding/json"
 	"math"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
+const (
+	// scale out/in by one instance at a time when the thresholds are crossed
+	PolicyThreshold = "threshold"
+	// scale to the number of instances that brings the load closest to the target
+	PolicyTarget = "target"
+	// scale with a PID controller that keeps the load at the target
+	PolicyPID = "pid"
+)
+
 type Rule struct {
-	App          string `json:"app"`
-	Space        string `json:"space"`
-	Org          string `json:"org"`
-	MinInstances int    `json:"min_instances"`
-	MaxInstances int    `json:"max_instances"`
-	MinCpu       int    `json:"scale_in_cpu"`
-	MaxCpu       int    `json:"scale_out_cpu"`
-	MinMem       int    `json:"scale_in_mem"`
-	MaxMem       int    `json:"scale_out_mem"`
+	App                  string        `json:"app"`
+	Space                string        `json:"space"`
+	Org                  string        `json:"org"`
+	MinInstances         int           `json:"min_instances"`
+	MaxInstances         int           `json:"max_instances"`
+	MinCpu               int           `json:"scale_in_cpu"`
+	MaxCpu               int           `json:"scale_out_cpu"`
+	MinMem               int           `json:"scale_in_mem"`
+	MaxMem               int           `json:"scale_out_mem"`
+	MinDisk              int           `json:"scale_in_disk"`
+	MaxDisk              int           `json:"scale_out_disk"`
+	Policy               string        `json:"policy"`
+	TargetCpu            int           `json:"target_cpu"`
+	TargetMem            int           `json:"target_mem"`
+	Kp                   float64       `json:"pid_kp"`
+	Ki                   float64       `json:"pid_ki"`
+	Kd                   float64       `json:"pid_kd"`
+	Steps                []Step        `json:"steps"`
+	ScaleOutAfter        Duration      `json:"scale_out_after"`
+	ScaleInAfter         Duration      `json:"scale_in_after"`
+	ScaleOutCooldown     Duration      `json:"scale_out_cooldown"`
+	ScaleInCooldown      Duration      `json:"scale_in_cooldown"`
+	Predictive           *Predictive   `json:"predictive"`
+	Schedules            []Schedule    `json:"schedules"`
+	CpuAggregation       string        `json:"cpu_aggregation"`
+	MemAggregation       string        `json:"mem_aggregation"`
+	RestartOutliersAfter int           `json:"restart_outliers_after"`
+	MaxRestartsPerHour   int           `json:"max_restarts_per_hour"`
+	Trends               []Trend       `json:"trends"`
+	ScaleOutWhen         string        `json:"scale_out_when"`
+	ScaleInWhen          string        `json:"scale_in_when"`
+	Warmup               Duration      `json:"warmup"`
+	Idle                 *Idle         `json:"idle"`
+	MinMemoryMB          int           `json:"min_memory_mb"`
+	MaxMemoryMB          int           `json:"max_memory_mb"`
+	ScaleDownMem         int           `json:"scale_down_mem"`
+	ScaleUpMem           int           `json:"scale_up_mem"`
+	MemoryScalingTimeout Duration      `json:"memory_scaling_timeout"`
+	Group                string        `json:"group"`
+	Ratio                float64       `json:"ratio"`
+	Rounding             string        `json:"rounding"`
+	MetricsFrom          *AppRef       `json:"metrics_from"`
+	Queue                *Queue        `json:"queue"`
+	CustomMetric         *CustomMetric `json:"custom_metric"`
+	ScaleInRps           float64       `json:"scale_in_rps"`
+	ScaleOutRps          float64       `json:"scale_out_rps"`
+	ScaleInLatency       Duration      `json:"scale_in_latency"`
+	ScaleOutLatency      Duration      `json:"scale_out_latency"`
+	MaxErrorRate         float64       `json:"max_error_rate"`
+	Probe                *Probe        `json:"probe"`
+
+	// parsed ScaleOutWhen and ScaleInWhen, set by validateRule
+	scaleOutWhen expr
+	scaleInWhen  expr
+}
+
+// Duration is a time.Duration that is specified in JSON as a string like "1m30s"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.Wrap(err, "duration should be a string")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return errors.Wrap(err, "parse duration")
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
 }
 
 func validateRules(rules []Rule) error {
@@ -26,7 +102,10 @@ func validateRules(rules []Rule) error {
 			rules[idx] = rule
 		}
 	}
-	return nil
+	if err := validateGroups(rules); err != nil {
+		return err
+	}
+	return validateMetricsSources(rules)
 }
 
 func validateRule(rule Rule) (Rule, error) {
@@ -53,18 +132,174 @@ func validateRule(rule Rule) (Rule, error) {
 		return rule, errors.New("min mem threshold should be in the range 0<=t<=100")
 	case rule.MinMem >= rule.MaxMem && !(rule.MinMem == 0 && rule.MaxMem == 0):
 		return rule, errors.New("min mem threshold should be less than max mem threshold")
-	case rule.MinMem == 0 && rule.MaxMem == 0 && rule.MinCpu == 0 && rule.MaxCpu == 0:
-		return rule, errors.New("no cpu/mem thresholds defined")
+	case rule.MaxDisk < 0 || rule.MaxDisk > 100:
+		return rule, errors.New("max disk threshold should be in the range 0<=t<=100")
+	case rule.MinDisk < 0 || rule.MinDisk > 100:
+		return rule, errors.New("min disk threshold should be in the range 0<=t<=100")
+	case rule.MinDisk >= rule.MaxDisk && !(rule.MinDisk == 0 && rule.MaxDisk == 0):
+		return rule, errors.New("min disk threshold should be less than max disk threshold")
+	case rule.ScaleInRps < 0 || rule.ScaleOutRps < 0:
+		return rule, errors.New("rps thresholds should be >= 0")
+	case (rule.ScaleInRps != 0 || rule.ScaleOutRps != 0) && rule.ScaleInRps >= rule.ScaleOutRps:
+		return rule, errors.New("scale in rps should be less than scale out rps")
+	case rule.ScaleInLatency < 0 || rule.ScaleOutLatency < 0:
+		return rule, errors.New("latency thresholds should be >= 0")
+	case rule.ScaleInLatency != 0 && rule.ScaleInLatency >= rule.ScaleOutLatency:
+		return rule, errors.New("scale in latency should be less than scale out latency")
+	case rule.MaxErrorRate < 0 || rule.MaxErrorRate > 100:
+		return rule, errors.New("max error rate should be in the range 0<=r<=100")
+	case rule.Ratio < 0:
+		return rule, errors.New("ratio should be >= 0")
+	case rule.Ratio > 0 && rule.Group == "":
+		return rule, errors.New("ratio requires group")
+	case rule.Ratio > 0 && (rule.MinMem != 0 || rule.MaxMem != 0 || rule.MinCpu != 0 || rule.MaxCpu != 0 || rule.MinDisk != 0 || rule.MaxDisk != 0 || rule.ScaleOutWhen != "" || rule.ScaleInWhen != ""):
+		return rule, errors.New("rules with ratio follow the driver of their group and can not define thresholds or conditions")
+	case rule.Ratio > 0 && (rule.Policy != "" || rule.Steps != nil || rule.ScaleOutAfter != 0 || rule.ScaleInAfter != 0 || rule.ScaleOutCooldown != 0 || rule.ScaleInCooldown != 0 ||
+		rule.Predictive != nil || rule.Schedules != nil || rule.Trends != nil || rule.RestartOutliersAfter != 0 || rule.Idle != nil || rule.MinMemoryMB != 0 || rule.MaxMemoryMB != 0 ||
+		rule.MetricsFrom != nil || rule.Queue != nil || rule.CustomMetric != nil || rule.ScaleOutRps != 0 || rule.ScaleOutLatency != 0 || rule.MaxErrorRate != 0 || rule.Probe != nil):
+		return rule, errors.New("rules with ratio follow the driver of their group and can not define policies, delays, cooldowns, metrics, schedules, trends, outliers restarts, idle mode, memory scaling or predictive scaling")
+	case rule.Rounding != "" && (rule.Ratio == 0 || rule.Rounding != RoundingUp && rule.Rounding != RoundingDown && rule.Rounding != RoundingNearest):
+		return rule, errors.Errorf("rounding should be %q, %q or %q and requires ratio", RoundingUp, RoundingDown, RoundingNearest)
+	case rule.Ratio == 0 && rule.Queue == nil && rule.CustomMetric == nil && rule.ScaleOutRps == 0 && rule.ScaleOutLatency == 0 && rule.Probe == nil && rule.MinMem == 0 && rule.MaxMem == 0 && rule.MinCpu == 0 && rule.MaxCpu == 0 && rule.MinDisk == 0 && rule.MaxDisk == 0 && (rule.ScaleOutWhen == "" || rule.ScaleInWhen == ""):
+		return rule, errors.New("no cpu/mem/disk thresholds or scale out/in conditions defined")
+	case rule.Policy != "" && rule.Policy != PolicyThreshold && rule.Policy != PolicyTarget && rule.Policy != PolicyPID:
+		return rule, errors.Errorf("unknown policy %q", rule.Policy)
+	case rule.Policy != PolicyTarget && rule.Policy != PolicyPID && (rule.TargetCpu != 0 || rule.TargetMem != 0):
+		return rule, errors.New("target cpu/mem loads are only allowed with the target and pid policies")
+	case rule.MaxCpu == 0 && rule.TargetCpu != 0:
+		return rule, errors.New("target cpu load requires cpu thresholds")
+	case rule.MaxCpu != 0 && (rule.Policy == PolicyTarget || rule.Policy == PolicyPID) && (rule.TargetCpu <= 0 || rule.TargetCpu < rule.MinCpu || rule.TargetCpu > rule.MaxCpu):
+		return rule, errors.New("target cpu load should be in the range scale_in_cpu<=t<=scale_out_cpu")
+	case rule.MaxMem == 0 && rule.TargetMem != 0:
+		return rule, errors.New("target mem load requires mem thresholds")
+	case rule.MaxMem != 0 && (rule.Policy == PolicyTarget || rule.Policy == PolicyPID) && (rule.TargetMem <= 0 || rule.TargetMem < rule.MinMem || rule.TargetMem > rule.MaxMem):
+		return rule, errors.New("target mem load should be in the range scale_in_mem<=t<=scale_out_mem")
+	case (rule.Policy == PolicyTarget || rule.Policy == PolicyPID) && rule.MaxDisk != 0:
+		return rule, errors.New("disk thresholds are only allowed with the threshold policy")
+	case rule.Policy != "" && rule.Policy != PolicyThreshold && (rule.ScaleOutWhen != "" || rule.ScaleInWhen != ""):
+		return rule, errors.New("scale out/in conditions are only allowed with the threshold policy")
+	case rule.Policy != "" && rule.Policy != PolicyThreshold && rule.Queue != nil:
+		return rule, errors.New("queue is only allowed with the threshold policy")
+	case rule.Policy != "" && rule.Policy != PolicyThreshold && rule.CustomMetric != nil:
+		return rule, errors.New("custom metric is only allowed with the threshold policy")
+	case rule.Policy != "" && rule.Policy != PolicyThreshold && rule.ScaleOutRps != 0:
+		return rule, errors.New("rps thresholds are only allowed with the threshold policy")
+	case rule.Policy != "" && rule.Policy != PolicyThreshold && (rule.ScaleOutLatency != 0 || rule.MaxErrorRate != 0):
+		return rule, errors.New("latency thresholds and max error rate are only allowed with the threshold policy")
+	case rule.Policy != "" && rule.Policy != PolicyThreshold && rule.Probe != nil:
+		return rule, errors.New("probe is only allowed with the threshold policy")
+	case rule.Policy != PolicyPID && (rule.Kp != 0 || rule.Ki != 0 || rule.Kd != 0):
+		return rule, errors.New("pid gains are only allowed with the pid policy")
+	case rule.Policy == PolicyPID && (rule.Kp < 0 || rule.Ki <= 0 || rule.Kd < 0):
+		return rule, errors.New("pid gains should be >= 0, and the integral gain > 0")
+	case rule.Policy == PolicyPID && rule.Ki+2*rule.Kp+4*rule.Kd >= 2:
+		// beyond this, the number of instances oscillates without converging
+		return rule, errors.New("pid gains should be such that pid_ki + 2*pid_kp + 4*pid_kd < 2")
+	case rule.Policy == PolicyPID && (rule.ScaleOutAfter != 0 || rule.ScaleInAfter != 0):
+		return rule, errors.New("scale out/in windows are not allowed with the pid policy")
+	case rule.ScaleOutAfter < 0 || time.Duration(rule.ScaleOutAfter) > HistoryLength:
+		return rule, errors.Errorf("scale out window should be in the range 0<=w<=%s", HistoryLength)
+	case rule.ScaleInAfter < 0 || time.Duration(rule.ScaleInAfter) > HistoryLength:
+		return rule, errors.Errorf("scale in window should be in the range 0<=w<=%s", HistoryLength)
+	case rule.RestartOutliersAfter < 0:
+		return rule, errors.New("restart outliers after should be >= 0")
+	case rule.RestartOutliersAfter > 0 && rule.MaxRestartsPerHour <= 0:
+		return rule, errors.New("max restarts per hour should be > 0")
+	case rule.RestartOutliersAfter == 0 && rule.MaxRestartsPerHour != 0:
+		return rule, errors.New("max restarts per hour requires restart outliers after")
+	case rule.Warmup < 0:
+		return rule, errors.New("warmup should be >= 0")
+	case rule.ScaleOutCooldown < 0:
+		return rule, errors.New("scale out cooldown should be >= 0")
+	case rule.ScaleInCooldown < 0:
+		return rule, errors.New("scale in cooldown should be >= 0")
 	}
 
-	switch {
-	case rule.MinMem == 0 && rule.MaxMem == 0:
-		// disable the memory thresholds
-		rule.MinMem, rule.MaxMem = math.MaxInt32, math.MaxInt32
-	case rule.MinCpu == 0 && rule.MaxCpu == 0:
+	if err := validateAggregation(rule.CpuAggregation); err != nil {
+		return rule, errors.Wrap(err, "cpu aggregation")
+	}
+	if err := validateAggregation(rule.MemAggregation); err != nil {
+		return rule, errors.Wrap(err, "mem aggregation")
+	}
+
+	if err := validateSteps(rule); err != nil {
+		return rule, err
+	}
+	if err := validateMetricsFrom(rule); err != nil {
+		return rule, err
+	}
+	if rule.Queue != nil {
+		if err := validateQueue(*rule.Queue); err != nil {
+			return rule, err
+		}
+	}
+	if rule.CustomMetric != nil {
+		if err := validateCustomMetric(*rule.CustomMetric); err != nil {
+			return rule, err
+		}
+	}
+	if rule.Probe != nil {
+		if err := validateProbe(*rule.Probe); err != nil {
+			return rule, err
+		}
+	}
+
+	if rule.ScaleOutWhen != "" {
+		e, err := parseCondition(rule.ScaleOutWhen, unavailableVars(rule))
+		if err != nil {
+			return rule, errors.Wrap(err, "scale out condition")
+		}
+		rule.scaleOutWhen = e
+	}
+	if rule.ScaleInWhen != "" {
+		e, err := parseCondition(rule.ScaleInWhen, unavailableVars(rule))
+		if err != nil {
+			return rule, errors.Wrap(err, "scale in condition")
+		}
+		rule.scaleInWhen = e
+	}
+
+	if err := validateTrends(rule); err != nil {
+		return rule, err
+	}
+
+	schedules, err := validateSchedules(rule)
+	if err != nil {
+		return rule, err
+	}
+	rule.Schedules = schedules
+
+	rule, err = validateVertical(rule)
+	if err != nil {
+		return rule, err
+	}
+
+	if rule.Idle != nil {
+		if err := validateIdle(*rule.Idle); err != nil {
+			return rule, err
+		}
+	}
+
+	if rule.Predictive != nil {
+		p, err := validatePredictive(*rule.Predictive)
+		if err != nil {
+			return rule, err
+		}
+		rule.Predictive = &p
+	}
+
+	if rule.MinCpu == 0 && rule.MaxCpu == 0 {
 		// disable the cpu thresholds
 		rule.MinCpu, rule.MaxCpu = math.MaxInt32, math.MaxInt32
 	}
+	if rule.MinMem == 0 && rule.MaxMem == 0 {
+		// disable the memory thresholds
+		rule.MinMem, rule.MaxMem = math.MaxInt32, math.MaxInt32
+	}
+	if rule.MinDisk == 0 && rule.MaxDisk == 0 {
+		// disable the disk thresholds
+		rule.MinDisk, rule.MaxDisk = math.MaxInt32, math.MaxInt32
+	}
 
 	return rule, nil
 }
@@ -77,3 +312,24 @@ func ruleFor(rules []Rule, app, space, org string) (Rule, bool) {
 	}
 	return Rule{}, false
 }
+
+// unavailableVars returns the variables of the conditions whose metric is not
+// read for the rule, with the reason.
+func unavailableVars(rule Rule) map[string]string {
+	vars := make(map[string]string)
+	if rule.CustomMetric == nil {
+		vars["custom"] = "requires custom_metric"
+	}
+	if rule.ScaleOutRps == 0 {
+		vars["rps"] = "requires scale_out_rps"
+	}
+	if rule.ScaleOutLatency == 0 && rule.MaxErrorRate == 0 {
+		vars["latency"] = "requires scale_out_latency or max_error_rate"
+		vars["error_rate"] = "requires scale_out_latency or max_error_rate"
+	}
+	if rule.Probe == nil {
+		vars["probe_latency"] = "requires probe"
+		vars["probe_failures"] = "requires probe"
+	}
+	return vars
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"encoding/json"
 	"math"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestValidateRules(t *testing.T) {
@@ -28,7 +31,7 @@ func TestValidateRules(t *testing.T) {
 
 		{
 			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60},
-			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMem: math.MaxInt32, MaxMem: math.MaxInt32},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMem: math.MaxInt32, MaxMem: math.MaxInt32, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32},
 		},
 		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 60, MaxCpu: 60}, nil},
 		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 80, MaxCpu: 60}, nil},
@@ -45,17 +48,300 @@ func TestValidateRules(t *testing.T) {
 
 		{
 			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinMem: 50, MaxMem: 70},
-			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: math.MaxInt32, MaxCpu: math.MaxInt32, MinMem: 50, MaxMem: 70},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: math.MaxInt32, MaxCpu: math.MaxInt32, MinMem: 50, MaxMem: 70, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32},
 		},
 		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinMem: 70, MaxMem: 70}, nil},
 		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinMem: 90, MaxMem: 70}, nil},
 		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinMem: 50, MaxMem: -70}, nil},
 		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinMem: -50, MaxMem: 70}, nil},
 
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinDisk: 60, MaxDisk: 80},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: math.MaxInt32, MaxCpu: math.MaxInt32, MinMem: math.MaxInt32, MaxMem: math.MaxInt32, MinDisk: 60, MaxDisk: 80},
+		},
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MaxDisk: 90},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMem: math.MaxInt32, MaxMem: math.MaxInt32, MaxDisk: 90},
+		},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinDisk: 80, MaxDisk: 80}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinDisk: 90, MaxDisk: 80}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinDisk: 60, MaxDisk: 180}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinDisk: -60, MaxDisk: 80}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinDisk: 60, MaxDisk: 80, Policy: PolicyTarget, TargetCpu: 50}, nil},
+
 		{
 			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMem: 50, MaxMem: 70},
-			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMem: 50, MaxMem: 70},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMem: 50, MaxMem: 70, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32},
+		},
+
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Policy: PolicyThreshold},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMem: math.MaxInt32, MaxMem: math.MaxInt32, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32, Policy: PolicyThreshold},
+		},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Policy: "linear"}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, TargetCpu: 50}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Policy: PolicyThreshold, TargetCpu: 50}, nil},
+
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Policy: PolicyTarget, TargetCpu: 50},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMem: math.MaxInt32, MaxMem: math.MaxInt32, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32, Policy: PolicyTarget, TargetCpu: 50},
+		},
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Policy: PolicyTarget, TargetCpu: 40},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMem: math.MaxInt32, MaxMem: math.MaxInt32, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32, Policy: PolicyTarget, TargetCpu: 40},
+		},
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinMem: 50, MaxMem: 70, Policy: PolicyTarget, TargetMem: 70},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: math.MaxInt32, MaxCpu: math.MaxInt32, MinMem: 50, MaxMem: 70, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32, Policy: PolicyTarget, TargetMem: 70},
+		},
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMem: 50, MaxMem: 70, Policy: PolicyTarget, TargetCpu: 50, TargetMem: 60},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMem: 50, MaxMem: 70, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32, Policy: PolicyTarget, TargetCpu: 50, TargetMem: 60},
+		},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Policy: PolicyTarget}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Policy: PolicyTarget, TargetCpu: 30}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Policy: PolicyTarget, TargetCpu: 70}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Policy: PolicyTarget, TargetCpu: 50, TargetMem: 60}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMem: 50, MaxMem: 70, Policy: PolicyTarget, TargetCpu: 50}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 0, MaxCpu: 60, Policy: PolicyTarget, TargetCpu: 0}, nil},
+
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Policy: PolicyPID, TargetCpu: 50, Kp: 0.5, Ki: 0.1},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMem: math.MaxInt32, MaxMem: math.MaxInt32, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32, Policy: PolicyPID, TargetCpu: 50, Kp: 0.5, Ki: 0.1},
+		},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Policy: PolicyPID, TargetCpu: 50}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Policy: PolicyPID, Kp: 0.5}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Policy: PolicyPID, TargetCpu: 50, Kp: 0.5, Kd: -0.1}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Policy: PolicyTarget, TargetCpu: 50, Kp: 0.5}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Policy: PolicyPID, TargetCpu: 50, Kp: 0.5, Ki: 0.1, ScaleOutAfter: Duration(time.Minute)}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Policy: PolicyPID, TargetCpu: 50, Kp: 0.5}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Policy: PolicyPID, TargetCpu: 50, Kp: 0.8, Ki: 0.5, Kd: 0.1}, nil},
+
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, CpuAggregation: AggregationP90, MemAggregation: AggregationTrimmedMean},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMem: math.MaxInt32, MaxMem: math.MaxInt32, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32, CpuAggregation: AggregationP90, MemAggregation: AggregationTrimmedMean},
+		},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, CpuAggregation: "p99"}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MemAggregation: "avg"}, nil},
+
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, RestartOutliersAfter: 10, MaxRestartsPerHour: 2},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMem: math.MaxInt32, MaxMem: math.MaxInt32, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32, RestartOutliersAfter: 10, MaxRestartsPerHour: 2},
+		},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, RestartOutliersAfter: 10}, nil},
+
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Warmup: Duration(2 * time.Minute)},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMem: math.MaxInt32, MaxMem: math.MaxInt32, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32, Warmup: Duration(2 * time.Minute)},
+		},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Warmup: Duration(-time.Minute)}, nil},
+
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Idle: &Idle{After: Duration(time.Hour), Cpu: 2, WakeUp: "0 8 * * 1-5", TimeZone: "Asia/Tokyo"}},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMem: math.MaxInt32, MaxMem: math.MaxInt32, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32, Idle: &Idle{After: Duration(time.Hour), Cpu: 2, WakeUp: "0 8 * * 1-5", TimeZone: "Asia/Tokyo"}},
+		},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Idle: &Idle{}}, nil},
+
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMemoryMB: 256, MaxMemoryMB: 1024, ScaleUpMem: 80},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMem: math.MaxInt32, MaxMem: math.MaxInt32, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32, MinMemoryMB: 256, MaxMemoryMB: 1024, ScaleUpMem: 80, MemoryScalingTimeout: Duration(VerticalScalingTimeout)},
+		},
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMemoryMB: 256, MaxMemoryMB: 1024, ScaleDownMem: 30, ScaleUpMem: 80, MemoryScalingTimeout: Duration(10 * time.Minute)},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMem: math.MaxInt32, MaxMem: math.MaxInt32, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32, MinMemoryMB: 256, MaxMemoryMB: 1024, ScaleDownMem: 30, ScaleUpMem: 80, MemoryScalingTimeout: Duration(10 * time.Minute)},
+		},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, ScaleUpMem: 80}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMemoryMB: 256, ScaleUpMem: 80}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMemoryMB: 1024, MaxMemoryMB: 1024, ScaleUpMem: 80}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMemoryMB: 256, MaxMemoryMB: 1024}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMemoryMB: 256, MaxMemoryMB: 1024, ScaleDownMem: 80, ScaleUpMem: 80}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMemoryMB: 256, MaxMemoryMB: 1024, ScaleUpMem: 80, MemoryScalingTimeout: Duration(-time.Minute)}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Idle: &Idle{After: Duration(time.Hour), Cpu: 101}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Idle: &Idle{After: Duration(time.Hour), Rps: -1}}, nil},
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Group: "g"},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMem: math.MaxInt32, MaxMem: math.MaxInt32, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32, Group: "g"},
+		},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, Group: "g", Ratio: 0.5}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Group: "g", Ratio: -1}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Ratio: 0.5}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Group: "g", Ratio: 0.5}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Group: "g", Rounding: RoundingUp}, nil},
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, Queue: &Queue{Name: "q", MessagesPerInstance: 100, ManagementURL: "https://rabbitmq.example.com/api"}},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: math.MaxInt32, MaxCpu: math.MaxInt32, MinMem: math.MaxInt32, MaxMem: math.MaxInt32, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32, Queue: &Queue{Name: "q", MessagesPerInstance: 100, ManagementURL: "https://rabbitmq.example.com/api"}},
+		},
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, CustomMetric: &CustomMetric{Metric: "m", URL: "https://a.example.com/metrics", Aggregation: AggregationSum, ScaleOut: 10}},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: math.MaxInt32, MaxCpu: math.MaxInt32, MinMem: math.MaxInt32, MaxMem: math.MaxInt32, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32, CustomMetric: &CustomMetric{Metric: "m", URL: "https://a.example.com/metrics", Aggregation: AggregationSum, ScaleOut: 10}},
+		},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, CustomMetric: &CustomMetric{URL: "https://a.example.com/metrics", ScaleOut: 10}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, CustomMetric: &CustomMetric{Metric: "m", ScaleOut: 10}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, CustomMetric: &CustomMetric{Metric: "m", URL: "https://a.example.com/metrics", ScaleIn: 10, ScaleOut: 10}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, CustomMetric: &CustomMetric{Metric: "m", URL: "https://a.example.com/metrics", Aggregation: "min", ScaleOut: 10}}, nil},
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, CustomMetric: &CustomMetric{Metric: "m", Source: SourceLogCache, ScaleOut: 10}},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: math.MaxInt32, MaxCpu: math.MaxInt32, MinMem: math.MaxInt32, MaxMem: math.MaxInt32, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32, CustomMetric: &CustomMetric{Metric: "m", Source: SourceLogCache, ScaleOut: 10}},
+		},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, CustomMetric: &CustomMetric{Metric: "m", Source: "graphite", ScaleOut: 10}}, nil},
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, CustomMetric: &CustomMetric{Source: SourcePromQL, Query: `up{app="{{.App}}"}`, URL: "https://prometheus.example.com", ScaleOut: 10}},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: math.MaxInt32, MaxCpu: math.MaxInt32, MinMem: math.MaxInt32, MaxMem: math.MaxInt32, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32, CustomMetric: &CustomMetric{Source: SourcePromQL, Query: `up{app="{{.App}}"}`, URL: "https://prometheus.example.com", ScaleOut: 10}},
+		},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, CustomMetric: &CustomMetric{Source: SourcePromQL, Query: `up{app="{{.App}}"}`, ScaleOut: 10}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, CustomMetric: &CustomMetric{Source: SourcePromQL, Query: `up{app="{{.Name}}"}`, URL: "https://prometheus.example.com", ScaleOut: 10}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, CustomMetric: &CustomMetric{Source: SourcePromQL, Metric: "up", Query: "up", URL: "https://prometheus.example.com", ScaleOut: 10}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, CustomMetric: &CustomMetric{Metric: "m", Query: "up", URL: "https://a.example.com/metrics", ScaleOut: 10}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, CustomMetric: &CustomMetric{Metric: "m", Source: SourceLogCache, URL: "https://a.example.com/metrics", ScaleOut: 10}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, CustomMetric: &CustomMetric{Metric: "m{x=\"1\"}", Source: SourceLogCache, ScaleOut: 10}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, CustomMetric: &CustomMetric{Metric: "m", Labels: map[string]string{"a b": "c"}, Source: SourceLogCache, ScaleOut: 10}}, nil},
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, ScaleOutRps: 20},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: math.MaxInt32, MaxCpu: math.MaxInt32, MinMem: math.MaxInt32, MaxMem: math.MaxInt32, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32, ScaleOutRps: 20},
 		},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, ScaleInRps: 20}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, ScaleInRps: 20, ScaleOutRps: 10}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, ScaleInRps: -1, ScaleOutRps: 10}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Policy: PolicyTarget, TargetCpu: 50, ScaleOutRps: 10}, nil},
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, ScaleOutLatency: Duration(time.Second), MaxErrorRate: 5},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: math.MaxInt32, MaxCpu: math.MaxInt32, MinMem: math.MaxInt32, MaxMem: math.MaxInt32, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32, ScaleOutLatency: Duration(time.Second), MaxErrorRate: 5},
+		},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, ScaleInLatency: Duration(time.Second), ScaleOutLatency: Duration(time.Second)}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, ScaleOutLatency: Duration(-time.Second)}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MaxErrorRate: 101}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Policy: PolicyTarget, TargetCpu: 50, MaxErrorRate: 5}, nil},
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, Probe: &Probe{Path: "/health", ScaleOut: Duration(time.Second)}},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: math.MaxInt32, MaxCpu: math.MaxInt32, MinMem: math.MaxInt32, MaxMem: math.MaxInt32, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32, Probe: &Probe{Path: "/health", ScaleOut: Duration(time.Second)}},
+		},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, Probe: &Probe{Path: "health", ScaleOut: Duration(time.Second)}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, Probe: &Probe{Scheme: "tcp", ScaleOut: Duration(time.Second)}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, Probe: &Probe{}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, Probe: &Probe{ScaleIn: Duration(time.Second), ScaleOut: Duration(time.Second)}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, Probe: &Probe{Timeout: Duration(10 * time.Second), ScaleOut: Duration(time.Second)}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, Probe: &Probe{Interval: Duration(2 * time.Minute), Timeout: Duration(time.Second), ScaleOut: Duration(time.Second)}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, Probe: &Probe{Percentile: 101, ScaleOut: Duration(time.Second)}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Policy: PolicyTarget, TargetCpu: 50, Probe: &Probe{ScaleOut: Duration(time.Second)}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, Queue: &Queue{MessagesPerInstance: 100, ManagementURL: "https://rabbitmq.example.com/api"}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, Queue: &Queue{Name: "q", ManagementURL: "https://rabbitmq.example.com/api"}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, Queue: &Queue{Name: "q", MessagesPerInstance: 100, Service: "rabbit"}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Policy: PolicyTarget, TargetCpu: 50, Queue: &Queue{Name: "q", MessagesPerInstance: 100, ManagementURL: "https://rabbitmq.example.com/api"}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MetricsFrom: &AppRef{App: "b", Space: "s", Org: "o"}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MetricsFrom: &AppRef{App: "a", Space: "s", Org: "o"}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MetricsFrom: &AppRef{App: "b"}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Policy: PolicyTarget, TargetCpu: 50, MetricsFrom: &AppRef{App: "b", Space: "s", Org: "o"}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Idle: &Idle{After: Duration(time.Hour), WakeUp: "0 25 * * *"}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Idle: &Idle{After: Duration(time.Hour), TimeZone: "Mars/Olympus"}}, nil},
+
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, ScaleOutWhen: "cpu > 70 || (mem > 85 && instances < 6)", ScaleInWhen: "cpu < 30 && mem < 50"},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: math.MaxInt32, MaxCpu: math.MaxInt32, MinMem: math.MaxInt32, MaxMem: math.MaxInt32, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32, ScaleOutWhen: "cpu > 70 || (mem > 85 && instances < 6)", ScaleInWhen: "cpu < 30 && mem < 50", scaleOutWhen: condition("cpu > 70 || (mem > 85 && instances < 6)"), scaleInWhen: condition("cpu < 30 && mem < 50")},
+		},
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, ScaleOutWhen: "cpu > 60 || disk > 90"},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMem: math.MaxInt32, MaxMem: math.MaxInt32, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32, ScaleOutWhen: "cpu > 60 || disk > 90", scaleOutWhen: condition("cpu > 60 || disk > 90")},
+		},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, ScaleOutWhen: "cpu > 70"}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, ScaleOutWhen: "cpu > 70", ScaleInWhen: "cpu <"}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, ScaleOutWhen: "cpu", ScaleInWhen: "cpu < 30"}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Policy: PolicyTarget, TargetCpu: 50, ScaleOutWhen: "cpu > 70"}, nil},
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, ScaleOutRps: 20, Probe: &Probe{Path: "/health", ScaleOut: Duration(time.Second)}, ScaleOutWhen: "rps > 10 && probe_failures > 5"},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: math.MaxInt32, MaxCpu: math.MaxInt32, MinMem: math.MaxInt32, MaxMem: math.MaxInt32, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32, ScaleOutRps: 20, Probe: &Probe{Path: "/health", ScaleOut: Duration(time.Second)}, ScaleOutWhen: "rps > 10 && probe_failures > 5", scaleOutWhen: condition("rps > 10 && probe_failures > 5")},
+		},
+		// variables whose metric is not read for the rule
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, ScaleOutWhen: "custom > 100"}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, ScaleOutWhen: "rps > 10"}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, ScaleOutWhen: "latency > 500"}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, ScaleInWhen: "error_rate < 1 && cpu < 30"}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, ScaleOutWhen: "probe_latency > 500"}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, ScaleOutRps: 20, ScaleOutWhen: "probe_failures > 5"}, nil},
+
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Trends: []Trend{{Metric: MetricCpu, Rate: 15, Window: Duration(time.Minute)}, {Metric: MetricMem, Rate: 5, Window: Duration(5 * time.Minute), Adjustment: 2}}},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMem: math.MaxInt32, MaxMem: math.MaxInt32, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32, Trends: []Trend{{Metric: MetricCpu, Rate: 15, Window: Duration(time.Minute)}, {Metric: MetricMem, Rate: 5, Window: Duration(5 * time.Minute), Adjustment: 2}}},
+		},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Trends: []Trend{{Metric: "net", Rate: 15, Window: Duration(time.Minute)}}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Trends: []Trend{{Metric: MetricCpu, Rate: 0, Window: Duration(time.Minute)}}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Trends: []Trend{{Metric: MetricCpu, Rate: 15}}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Trends: []Trend{{Metric: MetricCpu, Rate: 15, Window: Duration(2 * HistoryLength)}}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Trends: []Trend{{Metric: MetricCpu, Rate: 15, Window: Duration(time.Minute), Adjustment: -1}}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, RestartOutliersAfter: -1, MaxRestartsPerHour: 2}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MaxRestartsPerHour: 2}, nil},
+
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Steps: []Step{{Metric: MetricCpu, Upper: 20, Adjustment: -2}, {Metric: MetricCpu, Lower: 20, Upper: 40, Adjustment: -1}, {Metric: MetricCpu, Lower: 60, Upper: 75, Adjustment: 1}, {Metric: MetricCpu, Lower: 75, Upper: 90, Adjustment: 3}, {Metric: MetricCpu, Lower: 90, Adjustment: 50, Percent: true}}},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMem: math.MaxInt32, MaxMem: math.MaxInt32, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32, Steps: []Step{{Metric: MetricCpu, Upper: 20, Adjustment: -2}, {Metric: MetricCpu, Lower: 20, Upper: 40, Adjustment: -1}, {Metric: MetricCpu, Lower: 60, Upper: 75, Adjustment: 1}, {Metric: MetricCpu, Lower: 75, Upper: 90, Adjustment: 3}, {Metric: MetricCpu, Lower: 90, Adjustment: 50, Percent: true}}},
+		},
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMem: 50, MaxMem: 70, Steps: []Step{{Metric: MetricMem, Lower: 80, Adjustment: 2}, {Metric: MetricCpu, Lower: 80, Adjustment: 3}}},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMem: 50, MaxMem: 70, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32, Steps: []Step{{Metric: MetricMem, Lower: 80, Adjustment: 2}, {Metric: MetricCpu, Lower: 80, Adjustment: 3}}},
+		},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Steps: []Step{{Metric: "disk", Lower: 60, Adjustment: 1}}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Steps: []Step{{Metric: MetricMem, Lower: 80, Adjustment: 1}}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Steps: []Step{{Metric: MetricCpu, Lower: 80, Adjustment: 0}}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Steps: []Step{{Metric: MetricCpu, Lower: 80, Upper: 70, Adjustment: 1}}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Steps: []Step{{Metric: MetricCpu, Lower: -10, Upper: 20, Adjustment: -1}}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Steps: []Step{{Metric: MetricCpu, Lower: 50, Adjustment: 1}}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Steps: []Step{{Metric: MetricCpu, Upper: 50, Adjustment: -1}}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Steps: []Step{{Metric: MetricCpu, Adjustment: -1}}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Steps: []Step{{Metric: MetricCpu, Upper: 30, Adjustment: 1}}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Steps: []Step{{Metric: MetricCpu, Lower: 60, Upper: 80, Adjustment: 1}, {Metric: MetricCpu, Lower: 70, Adjustment: 2}}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Steps: []Step{{Metric: MetricCpu, Lower: 60, Adjustment: 1}, {Metric: MetricCpu, Lower: 80, Adjustment: 2}}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Steps: []Step{{Metric: MetricCpu, Lower: 80, Adjustment: 2}, {Metric: MetricCpu, Lower: 60, Upper: 80, Adjustment: 1}}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Steps: []Step{{Metric: MetricCpu, Lower: 60, Upper: 80, Adjustment: 3}, {Metric: MetricCpu, Lower: 80, Adjustment: 1}}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Steps: []Step{{Metric: MetricCpu, Upper: 20, Adjustment: -1}, {Metric: MetricCpu, Lower: 20, Upper: 40, Adjustment: -2}}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Policy: PolicyTarget, TargetCpu: 50, Steps: []Step{{Metric: MetricCpu, Lower: 80, Adjustment: 2}}}, nil},
+
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, ScaleOutAfter: Duration(time.Minute), ScaleInAfter: Duration(HistoryLength)},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMem: math.MaxInt32, MaxMem: math.MaxInt32, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32, ScaleOutAfter: Duration(time.Minute), ScaleInAfter: Duration(HistoryLength)},
+		},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, ScaleOutAfter: Duration(-time.Minute)}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, ScaleInAfter: Duration(-time.Minute)}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, ScaleOutAfter: Duration(HistoryLength + time.Minute)}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, ScaleInAfter: Duration(HistoryLength + time.Minute)}, nil},
+
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, ScaleOutCooldown: Duration(time.Minute), ScaleInCooldown: Duration(5 * time.Minute)},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMem: math.MaxInt32, MaxMem: math.MaxInt32, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32, ScaleOutCooldown: Duration(time.Minute), ScaleInCooldown: Duration(5 * time.Minute)},
+		},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, ScaleOutCooldown: Duration(-time.Minute)}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, ScaleInCooldown: Duration(-time.Minute)}, nil},
+
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Predictive: &Predictive{Horizon: Duration(time.Hour), TargetCpu: 50}},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMem: math.MaxInt32, MaxMem: math.MaxInt32, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32, Predictive: &Predictive{Season: Duration(PredictiveSeason), Horizon: Duration(time.Hour), TargetCpu: 50}},
+		},
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Predictive: &Predictive{Season: Duration(7 * 24 * time.Hour), Horizon: Duration(time.Hour), TargetMem: 50}},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMem: math.MaxInt32, MaxMem: math.MaxInt32, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32, Predictive: &Predictive{Season: Duration(7 * 24 * time.Hour), Horizon: Duration(time.Hour), TargetMem: 50}},
+		},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Predictive: &Predictive{Horizon: Duration(time.Hour)}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Predictive: &Predictive{TargetCpu: 50}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Predictive: &Predictive{Horizon: Duration(48 * time.Hour), TargetCpu: 50}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Predictive: &Predictive{Season: Duration(time.Hour + time.Minute), Horizon: Duration(time.Hour), TargetCpu: 50}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Predictive: &Predictive{Horizon: Duration(time.Hour), TargetCpu: 150}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Predictive: &Predictive{Horizon: Duration(time.Hour), TargetMem: -50}}, nil},
+
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Schedules: []Schedule{{Cron: "0 8 * * 1-5", TimeZone: "Asia/Tokyo", Duration: Duration(12 * time.Hour), MinInstances: 10, MaxInstances: 20}}},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMem: math.MaxInt32, MaxMem: math.MaxInt32, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32, Schedules: schedules(Schedule{Cron: "0 8 * * 1-5", TimeZone: "Asia/Tokyo", Duration: Duration(12 * time.Hour), MinInstances: 10, MaxInstances: 20})},
+		},
+		{
+			Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Schedules: []Schedule{{Cron: "0 0 * * *", Duration: Duration(time.Hour), MinMem: 50, MaxMem: 70}}},
+			&Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, MinMem: math.MaxInt32, MaxMem: math.MaxInt32, MinDisk: math.MaxInt32, MaxDisk: math.MaxInt32, Schedules: schedules(Schedule{Cron: "0 0 * * *", Duration: Duration(time.Hour), MinMem: 50, MaxMem: 70})},
+		},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Schedules: []Schedule{{Cron: "0 8 * *", Duration: Duration(time.Hour), MinInstances: 4}}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Schedules: []Schedule{{Cron: "0 8 * * *", TimeZone: "Mars/Olympus", Duration: Duration(time.Hour), MinInstances: 4}}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Schedules: []Schedule{{Cron: "0 8 * * *", MinInstances: 4}}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Schedules: []Schedule{{Cron: "0 8 * * *", Duration: Duration(8 * 24 * time.Hour), MinInstances: 4}}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Schedules: []Schedule{{Cron: "0 8 * * *", Duration: Duration(time.Hour)}}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Schedules: []Schedule{{Cron: "0 8 * * *", Duration: Duration(time.Hour), MinInstances: 10}}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Schedules: []Schedule{{Cron: "0 8 * * *", Duration: Duration(time.Hour), MinInstances: 2}}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Schedules: []Schedule{{Cron: "0 8 * * *", Duration: Duration(time.Hour), MaxCpu: 80}}}, nil},
+		{Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 5, MinCpu: 40, MaxCpu: 60, Schedules: []Schedule{{Cron: "0 8 * * *", Duration: Duration(time.Hour), MinCpu: 80, MaxCpu: 70}}}, nil},
 	}
 
 	for idx, test := range tests {
@@ -63,8 +349,48 @@ func TestValidateRules(t *testing.T) {
 		err := validateRules(rules)
 		if err != nil && test.exp != nil {
 			t.Fatalf("test %d: failed: %s", idx, err)
-		} else if err == nil && (test.exp == nil || rules[0] != *test.exp) {
-			t.Fatalf("test %d: succeeded: %s", idx)
+		} else if err == nil && (test.exp == nil || !reflect.DeepEqual(rules[0], *test.exp)) {
+			t.Fatalf("test %d: succeeded: %+v", idx, rules[0])
+		}
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	var rules []Rule
+	err := json.Unmarshal([]byte(`[{"app":"a","space":"s","org":"o","scale_out_after":"1m30s","scale_in_after":"5m"}]`), &rules)
+	if err != nil {
+		t.Fatalf("unmarshal: %s", err)
+	} else if rules[0].ScaleOutAfter != Duration(90*time.Second) || rules[0].ScaleInAfter != Duration(5*time.Minute) {
+		t.Fatalf("wrong durations: %+v", rules[0])
+	}
+
+	err = json.Unmarshal([]byte(`[{"app":"a","space":"s","org":"o","scale_out_after":90}]`), &rules)
+	if err == nil {
+		t.Fatalf("unmarshal succeeded: %+v", rules[0])
+	}
+}
+
+func condition(s string) expr {
+	e, err := parseCondition(s, nil)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+// schedules returns the schedules with their cron expressions and time zones
+// parsed, as done by validateSchedules.
+func schedules(schedules ...Schedule) []Schedule {
+	for i, s := range schedules {
+		c, err := parseCron(s.Cron)
+		if err != nil {
+			panic(err)
+		}
+		loc, err := time.LoadLocation(s.TimeZone)
+		if err != nil {
+			panic(err)
 		}
+		schedules[i].cron, schedules[i].loc = c, loc
 	}
+	return schedules
 }
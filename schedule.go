@@ -0,0 +1,123 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// maximum duration of a schedule
+	MaxScheduleDuration = 7 * 24 * time.Hour
+)
+
+// Schedule overrides the bounds (and optionally the thresholds) of a rule for
+// duration every time the cron expression matches in the time zone.
+type Schedule struct {
+	Cron         string   `json:"cron"`
+	TimeZone     string   `json:"time_zone"`
+	Duration     Duration `json:"duration"`
+	MinInstances int      `json:"min_instances"`
+	MaxInstances int      `json:"max_instances"`
+	MinCpu       int      `json:"scale_in_cpu"`
+	MaxCpu       int      `json:"scale_out_cpu"`
+	MinMem       int      `json:"scale_in_mem"`
+	MaxMem       int      `json:"scale_out_mem"`
+
+	// parsed cron expression and time zone, set by validateSchedules
+	cron *cron
+	loc  *time.Location
+}
+
+// validateSchedules returns the schedules of the rule with their cron
+// expressions and time zones parsed. It must be called before the disabled
+// thresholds are set to math.MaxInt32.
+func validateSchedules(rule Rule) ([]Schedule, error) {
+	if rule.Schedules == nil {
+		return nil, nil
+	}
+	schedules := make([]Schedule, len(rule.Schedules))
+	for idx, s := range rule.Schedules {
+		c, err := parseCron(s.Cron)
+		if err != nil {
+			return nil, errors.Wrapf(err, "schedule %d: parse cron expression", idx)
+		}
+		loc, err := time.LoadLocation(s.TimeZone)
+		if err != nil {
+			return nil, errors.Wrapf(err, "schedule %d: load time zone", idx)
+		}
+		s.cron, s.loc = c, loc
+
+		switch {
+		case s.Duration <= 0 || time.Duration(s.Duration) > MaxScheduleDuration:
+			return nil, errors.Errorf("schedule %d: duration should be in the range 0<d<=%s", idx, MaxScheduleDuration)
+		case s.MinInstances == 0 && s.MaxInstances == 0 && s.MinCpu == 0 && s.MaxCpu == 0 && s.MinMem == 0 && s.MaxMem == 0:
+			return nil, errors.Errorf("schedule %d: no instances/thresholds overrides defined", idx)
+		case (s.MinCpu == 0) != (s.MaxCpu == 0):
+			return nil, errors.Errorf("schedule %d: cpu thresholds should be defined together", idx)
+		case (s.MinMem == 0) != (s.MaxMem == 0):
+			return nil, errors.Errorf("schedule %d: mem thresholds should be defined together", idx)
+		}
+
+		// the rule resulting from the schedule must be valid as well
+		r := s.apply(rule)
+		r.Schedules = nil
+		if _, err := validateRule(r); err != nil {
+			return nil, errors.Wrapf(err, "schedule %d", idx)
+		}
+		schedules[idx] = s
+	}
+	return schedules, nil
+}
+
+// apply returns the rule with the overrides of the schedule.
+func (s Schedule) apply(rule Rule) Rule {
+	if s.MinInstances != 0 {
+		rule.MinInstances = s.MinInstances
+	}
+	if s.MaxInstances != 0 {
+		rule.MaxInstances = s.MaxInstances
+	}
+	if s.MinCpu != 0 || s.MaxCpu != 0 {
+		rule.MinCpu, rule.MaxCpu = s.MinCpu, s.MaxCpu
+	}
+	if s.MinMem != 0 || s.MaxMem != 0 {
+		rule.MinMem, rule.MaxMem = s.MinMem, s.MaxMem
+	}
+	return rule
+}
+
+// active returns true if the schedule matched during the last duration. The
+// schedule must have been validated.
+func (s Schedule) active(now time.Time) bool {
+	now = now.In(s.loc)
+	_, ok := s.cron.last(now, now.Add(-time.Duration(s.Duration)+time.Nanosecond))
+	return ok
+}
+
+// scheduledRule returns the rule with the overrides of the first schedule
+// active at time now, if any.
+func scheduledRule(rule Rule, now time.Time) Rule {
+	for _, s := range rule.Schedules {
+		if s.active(now) {
+			return s.apply(rule)
+		}
+	}
+	return rule
+}
+
+// instancesRange returns the minimum and maximum number of instances that the
+// rule allows, considering all its schedules.
+func instancesRange(rule Rule) (min, max int) {
+	min, max = rule.MinInstances, rule.MaxInstances
+	for _, s := range rule.Schedules {
+		r := s.apply(rule)
+		if r.MinInstances < min {
+			min = r.MinInstances
+		}
+		if r.MaxInstances > max {
+			max = r.MaxInstances
+		}
+	}
+	return
+}
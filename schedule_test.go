@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestSchedules(t *testing.T) {
+	rules := []Rule{
+		Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 8, MinCpu: 40, MaxCpu: 60, Schedules: []Schedule{
+			// weekdays 08:00-20:00 JST
+			{Cron: "0 8 * * 1-5", TimeZone: "Asia/Tokyo", Duration: Duration(12 * time.Hour), MinInstances: 10, MaxInstances: 20},
+			// sundays 00:00-06:00 UTC
+			{Cron: "0 0 * * sun", Duration: Duration(6 * time.Hour), MaxInstances: 4, MinCpu: 20, MaxCpu: 80},
+		}},
+	}
+	if err := validateRules(rules); err != nil {
+		t.Fatalf("validateRules: %s", err)
+	}
+
+	tests := []struct {
+		time      string
+		instances int
+		cpu       int
+		desired   int
+	}{
+		// thursday before 08:00 JST
+		{"2017-06-01T07:59:00+09:00", 5, 50, 0},
+		{"2017-06-01T07:59:00+09:00", 5, 70, 6},
+		{"2017-06-01T07:59:00+09:00", 8, 70, 0},
+		// schedule started
+		{"2017-06-01T08:00:00+09:00", 5, 50, 10},
+		{"2017-06-01T08:00:00+09:00", 3, 0, 10},
+		{"2017-06-01T12:00:00+09:00", 10, 50, 0},
+		{"2017-06-01T12:00:00+09:00", 10, 70, 11},
+		{"2017-06-01T12:00:00+09:00", 11, 0, 10},
+		{"2017-06-01T19:59:00+09:00", 20, 70, 0},
+		// outside of all bounds
+		{"2017-06-01T12:00:00+09:00", 2, 50, 0},
+		{"2017-06-01T12:00:00+09:00", 21, 50, 0},
+		// schedule ended
+		{"2017-06-01T20:00:00+09:00", 20, 50, 8},
+		{"2017-06-01T20:00:00+09:00", 8, 50, 0},
+		// saturday
+		{"2017-06-03T12:00:00+09:00", 5, 50, 0},
+		// sunday, with different thresholds
+		{"2017-06-04T05:00:00Z", 8, 50, 4},
+		{"2017-06-04T05:00:00Z", 4, 70, 0},
+		{"2017-06-04T05:00:00Z", 4, 30, 0},
+		{"2017-06-04T05:00:00Z", 4, 10, 3},
+		{"2017-06-04T06:00:00Z", 4, 70, 5},
+		{"2017-06-04T06:00:00Z", 4, 30, 3},
+	}
+
+	for i, test := range tests {
+		now, err := time.Parse(time.RFC3339, test.time)
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+
+		app := App{App: "a", Space: "s", Org: "o", Guid: guid, Instances: test.instances, InstancesRunning: test.instances, CpuAvg: test.cpu}
+		mock := &MockClient{Apps: Apps{guid: app}}
+		buf := &bytes.Buffer{}
+		as := &autoscaler{client: mock, rules: rules, log: log.New(buf, "", log.Lshortfile), clock: func() time.Time { return now }}
+		as.autoscaleApps()
+
+		if test.desired == 0 && mock.ScaleDesired != nil {
+			t.Fatalf("%d: Scale called: %d\n%s", i, *mock.ScaleDesired, buf.String())
+		} else if test.desired != 0 && (mock.ScaleDesired == nil || *mock.ScaleDesired != test.desired) {
+			t.Fatalf("%d: Scale not called with %d\n%s", i, test.desired, buf.String())
+		}
+	}
+}
+
+func TestSchedulesIgnoreDelaysAndCooldowns(t *testing.T) {
+	rules := []Rule{
+		Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 8, MinCpu: 40, MaxCpu: 60,
+			ScaleOutAfter: Duration(5 * time.Minute), ScaleInAfter: Duration(5 * time.Minute), ScaleOutCooldown: Duration(time.Hour), ScaleInCooldown: Duration(time.Hour),
+			Schedules: []Schedule{
+				// weekdays 08:00-20:00 UTC
+				{Cron: "0 8 * * 1-5", Duration: Duration(12 * time.Hour), MinInstances: 10, MaxInstances: 20},
+			}},
+	}
+	if err := validateRules(rules); err != nil {
+		t.Fatalf("validateRules: %s", err)
+	}
+
+	tests := []struct {
+		time      string
+		instances int
+		cpu       int
+		desired   int
+	}{
+		// the loads are held back by scale_out_after and the cooldown, but
+		// not the new minimum
+		{"2017-06-01T07:59:00Z", 5, 70, 0},
+		{"2017-06-01T08:00:00Z", 5, 50, 10},
+		// the same for scale_in_after and the new maximum
+		{"2017-06-01T19:59:00Z", 20, 30, 0},
+		{"2017-06-01T20:00:00Z", 20, 50, 8},
+	}
+
+	for i, test := range tests {
+		now, err := time.Parse(time.RFC3339, test.time)
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+
+		app := App{App: "a", Space: "s", Org: "o", Guid: guid, Instances: test.instances, InstancesRunning: test.instances, CpuAvg: test.cpu}
+		mock := &MockClient{Apps: Apps{guid: app}}
+		buf := &bytes.Buffer{}
+		as := &autoscaler{client: mock, rules: rules, log: log.New(buf, "", log.Lshortfile), clock: func() time.Time { return now }}
+		// scaled out and in a minute ago
+		as.cooldowns = map[string]cooldown{guid: cooldown{Out: now.Add(-time.Minute), In: now.Add(-time.Minute)}}
+		as.autoscaleApps()
+
+		if test.desired == 0 && mock.ScaleDesired != nil {
+			t.Fatalf("%d: Scale called: %d\n%s", i, *mock.ScaleDesired, buf.String())
+		} else if test.desired != 0 && (mock.ScaleDesired == nil || *mock.ScaleDesired != test.desired) {
+			t.Fatalf("%d: Scale not called with %d\n%s", i, test.desired, buf.String())
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	MetricCpu  = "cpu"
+	MetricMem  = "mem"
+	MetricDisk = "disk"
+)
+
+// Step defines by how many instances the threshold policy scales an app when
+// the load of a metric is in the band lower<=load<upper (if upper is 0 the band
+// has no upper bound). Positive adjustments are used when scaling out, negative
+// ones when scaling in; if percent is set, the adjustment is a percentage of
+// the current number of instances.
+type Step struct {
+	Metric     string `json:"metric"`
+	Lower      int    `json:"lower"`
+	Upper      int    `json:"upper"`
+	Adjustment int    `json:"adjustment"`
+	Percent    bool   `json:"percent"`
+}
+
+func (s Step) contains(load int) bool {
+	return load >= s.Lower && (s.Upper == 0 || load < s.Upper)
+}
+
+// instances returns the absolute number of instances to add/remove when
+// applying the step to an app with the given number of instances.
+func (s Step) instances(instances int) int {
+	n := s.Adjustment
+	if n < 0 {
+		n = -n
+	}
+	if s.Percent {
+		n = int(math.Ceil(float64(instances) * float64(n) / 100))
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// validateSteps must be called before the disabled thresholds are set to
+// math.MaxInt32.
+func validateSteps(rule Rule) error {
+	prev := map[string]Step{}
+	for idx, step := range rule.Steps {
+		var min, max int
+		switch step.Metric {
+		case MetricCpu:
+			min, max = rule.MinCpu, rule.MaxCpu
+		case MetricMem:
+			min, max = rule.MinMem, rule.MaxMem
+		case MetricDisk:
+			min, max = rule.MinDisk, rule.MaxDisk
+		default:
+			return errors.Errorf("step %d: unknown metric %q", idx, step.Metric)
+		}
+
+		p, found := prev[step.Metric]
+		switch {
+		case rule.Policy != "" && rule.Policy != PolicyThreshold:
+			return errors.Errorf("step %d: steps are only allowed with the threshold policy", idx)
+		case min == 0 && max == 0:
+			return errors.Errorf("step %d: no %s thresholds defined", idx, step.Metric)
+		case step.Lower < 0:
+			return errors.Errorf("step %d: lower bound should be >= 0", idx)
+		case step.Upper != 0 && step.Upper <= step.Lower:
+			return errors.Errorf("step %d: upper bound should be more than lower bound", idx)
+		case step.Adjustment == 0:
+			return errors.Errorf("step %d: adjustment should not be 0", idx)
+		case step.Adjustment > 0 && step.Lower < max:
+			return errors.Errorf("step %d: scale-out steps should start at or above the scale-out threshold", idx)
+		case step.Adjustment < 0 && (step.Upper == 0 || step.Upper > min):
+			return errors.Errorf("step %d: scale-in steps should end at or below the scale-in threshold", idx)
+		case found && (p.Upper == 0 || p.Upper > step.Lower):
+			return errors.Errorf("step %d: overlaps with previous %s step", idx, step.Metric)
+		case found && p.Percent == step.Percent && p.Adjustment > step.Adjustment:
+			return errors.Errorf("step %d: adjustment should not decrease as load increases", idx)
+		}
+
+		prev[step.Metric] = step
+	}
+	return nil
+}
+
+// stepFor returns the number of instances to add (if scaling out) or remove
+// (if scaling in) according to the rule step matching the load of the metric.
+// If no step matches, the app is scaled by one instance.
+func stepFor(rule Rule, metric string, load, instances int, out bool) int {
+	for _, step := range rule.Steps {
+		if step.Metric == metric && (step.Adjustment > 0) == out && step.contains(load) {
+			return step.instances(instances)
+		}
+	}
+	return 1
+}
+
+// scaleOutStep returns how many instances to add to an app: each metric above
+// its scale-out threshold suggests a step, and the largest one is used.
+func scaleOutStep(rule Rule, app App) int {
+	step := 1
+	if rule.MaxCpu <= app.CpuAvg {
+		if s := stepFor(rule, MetricCpu, app.CpuAvg, app.Instances, true); s > step {
+			step = s
+		}
+	}
+	if rule.MaxMem <= app.MemAvg {
+		if s := stepFor(rule, MetricMem, app.MemAvg, app.Instances, true); s > step {
+			step = s
+		}
+	}
+	if rule.MaxDisk <= app.DiskAvg {
+		if s := stepFor(rule, MetricDisk, app.DiskAvg, app.Instances, true); s > step {
+			step = s
+		}
+	}
+	return step
+}
+
+// scaleInStep returns how many instances to remove from an app: all enabled
+// metrics are below their scale-in thresholds, and the most conservative step
+// is used.
+func scaleInStep(rule Rule, app App) int {
+	step := math.MaxInt32
+	if rule.MinCpu != math.MaxInt32 {
+		if s := stepFor(rule, MetricCpu, app.CpuAvg, app.Instances, false); s < step {
+			step = s
+		}
+	}
+	if rule.MinMem != math.MaxInt32 {
+		if s := stepFor(rule, MetricMem, app.MemAvg, app.Instances, false); s < step {
+			step = s
+		}
+	}
+	if rule.MinDisk != math.MaxInt32 {
+		if s := stepFor(rule, MetricDisk, app.DiskAvg, app.Instances, false); s < step {
+			step = s
+		}
+	}
+	if step == math.MaxInt32 {
+		// no thresholds, the app is scaled in by its scale in condition
+		step = 1
+	}
+	return step
+}
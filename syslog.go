@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// syslog messages larger than this are rejected
+const SyslogMaxMessageSize = 64 * 1024
+
+// syslogMessage holds the fields of a RFC 5424 syslog message used by the
+// drain.
+type syslogMessage struct {
+	Hostname string
+	AppName  string
+	ProcID   string
+	Msg      string
+}
+
+// parseSyslog parses a RFC 5424 syslog message.
+func parseSyslog(s string) (syslogMessage, error) {
+	var m syslogMessage
+	// PRI VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]
+	fields := strings.SplitN(s, " ", 7)
+	if len(fields) < 7 {
+		return m, errors.New("missing header fields")
+	}
+	if !strings.HasPrefix(fields[0], "<") || !strings.HasSuffix(fields[0], ">1") {
+		return m, errors.Errorf("invalid priority or version %q", fields[0])
+	}
+	m.Hostname, m.AppName, m.ProcID = fields[2], fields[3], fields[4]
+
+	rest := fields[6]
+	if strings.HasPrefix(rest, "-") {
+		rest = rest[1:]
+	} else {
+		// skip the structured data elements, whose values may contain
+		// escaped brackets and quotes
+		for strings.HasPrefix(rest, "[") {
+			i, quoted := 1, false
+			for ; i < len(rest); i++ {
+				c := rest[i]
+				if c == '\\' {
+					i++
+				} else if c == '"' {
+					quoted = !quoted
+				} else if c == ']' && !quoted {
+					break
+				}
+			}
+			if i >= len(rest) {
+				return m, errors.New("unterminated structured data")
+			}
+			rest = rest[i+1:]
+		}
+	}
+	if rest != "" && rest[0] != ' ' {
+		return m, errors.New("invalid structured data")
+	}
+	m.Msg = strings.TrimPrefix(strings.TrimPrefix(rest, " "), "\xef\xbb\xbf")
+	m.Msg = strings.TrimRight(m.Msg, "\r\n")
+	return m, nil
+}
+
+// readSyslogFrame reads a syslog message sent over a stream (RFC 6587), either
+// with octet counting ("LEN MSG") or terminated by a newline.
+func readSyslogFrame(r *bufio.Reader) (string, error) {
+	c, err := r.Peek(1)
+	if err != nil {
+		return "", err
+	}
+	if c[0] < '0' || c[0] > '9' {
+		line, err := r.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		if len(line) > SyslogMaxMessageSize {
+			return "", errors.New("message too large")
+		}
+		return line, err
+	}
+
+	l, err := r.ReadString(' ')
+	if err != nil {
+		return "", errors.Wrap(err, "read length")
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(l, " "))
+	if err != nil || n <= 0 || n > SyslogMaxMessageSize {
+		return "", errors.Errorf("invalid length %q", l)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", errors.Wrap(err, "read message")
+	}
+	return string(b), nil
+}
+
+// serveSyslog receives syslog messages on the connection until it is closed.
+func (d *drain) serveSyslog(conn net.Conn, logger *log.Logger) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		s, err := readSyslogFrame(r)
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			logger.Print(errors.Wrapf(err, "syslog drain: connection from %s", conn.RemoteAddr()))
+			return
+		}
+		d.receive(s)
+	}
+}
+
+// listenSyslog accepts syslog connections over TLS on addr, until the
+// returned listener is closed.
+func (d *drain) listenSyslog(addr string, tlsConfig *tls.Config, logger *log.Logger) (net.Listener, error) {
+	l, err := tls.Listen("tcp", addr, tlsConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "listen")
+	}
+	go func() {
+		defer l.Close()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				logger.Print(errors.Wrap(err, "syslog drain: accept"))
+				return
+			}
+			go d.serveSyslog(conn, logger)
+		}
+	}()
+	return l, nil
+}
+
+// syslogHandler receives syslog messages sent by HTTPS drains, one per
+// request. The drain URL must carry the token in the token query parameter.
+func (d *drain) syslogHandler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if token == "" || subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		b, err := ioutil.ReadAll(io.LimitReader(r.Body, SyslogMaxMessageSize+1))
+		if err != nil || len(b) > SyslogMaxMessageSize {
+			http.Error(w, "invalid message", http.StatusBadRequest)
+			return
+		}
+		d.receive(string(b))
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// listen starts receiving syslog messages over HTTPS (on the port of the
+// autoscaler, at /syslog) and, if configured, over TLS. Anyone able to send
+// messages could make the apps scale, so the senders must authenticate: HTTPS
+// drains with the token, TLS drains with a client certificate.
+func (d *drain) listen(cfg Config) error {
+	if cfg.SyslogToken == "" {
+		return errors.New("AUTOSCALER_SYSLOG_TOKEN is required by the syslog drain")
+	}
+	if cfg.SyslogTLSPort != "" {
+		tlsConfig, err := syslogTLSConfig(cfg)
+		if err != nil {
+			return err
+		}
+		if _, err := d.listenSyslog(":"+cfg.SyslogTLSPort, tlsConfig, cfg.Logger); err != nil {
+			return errors.Wrap(err, "syslog tls")
+		}
+	}
+	d.start()
+	http.Handle("/syslog", d.syslogHandler(cfg.SyslogToken))
+	return nil
+}
+
+// syslogTLSConfig returns the configuration of the TLS listener, which
+// requires client certificates signed by SyslogTLSClientCA.
+func syslogTLSConfig(cfg Config) (*tls.Config, error) {
+	cert, err := tls.X509KeyPair([]byte(cfg.SyslogTLSCert), []byte(cfg.SyslogTLSKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "load syslog tls certificate")
+	}
+	if cfg.SyslogTLSClientCA == "" {
+		return nil, errors.New("AUTOSCALER_SYSLOG_TLS_CLIENT_CA is required by the syslog tls drain")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(cfg.SyslogTLSClientCA)) {
+		return nil, errors.New("load syslog tls client ca: no certificates found")
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Trend scales out an app when the load of a metric rises faster than rate
+// percentage points per minute over the window, regardless of the thresholds.
+// If adjustment is 0 the app is scaled out by one instance.
+type Trend struct {
+	Metric     string   `json:"metric"`
+	Rate       float64  `json:"rate"`
+	Window     Duration `json:"window"`
+	Adjustment int      `json:"adjustment"`
+}
+
+func validateTrends(rule Rule) error {
+	for idx, trend := range rule.Trends {
+		switch {
+		case trend.Metric != MetricCpu && trend.Metric != MetricMem && trend.Metric != MetricDisk:
+			return errors.Errorf("trend %d: unknown metric %q", idx, trend.Metric)
+		case trend.Rate <= 0:
+			return errors.Errorf("trend %d: rate should be > 0", idx)
+		case trend.Window < Duration(Interval) || time.Duration(trend.Window) > HistoryLength:
+			return errors.Errorf("trend %d: window should be in the range %s<=w<=%s", idx, Interval, HistoryLength)
+		case trend.Adjustment < 0:
+			return errors.Errorf("trend %d: adjustment should be >= 0", idx)
+		}
+	}
+	return nil
+}
+
+// avg returns the average load of the metric.
+func (a App) avg(metric string) int {
+	switch metric {
+	case MetricCpu:
+		return a.CpuAvg
+	case MetricMem:
+		return a.MemAvg
+	case MetricDisk:
+		return a.DiskAvg
+	}
+	return 0
+}
+
+// rate returns by how many percentage points per minute the load of the metric
+// changed over the window, using the most recent sample that is at least as
+// old as the window. The past load is rescaled to the current number of
+// instances, so that scaling the app does not look like a change in load.
+// If the history does not cover the window, ok is false.
+func rate(history []sample, metric string, window time.Duration) (r float64, ok bool) {
+	last := history[len(history)-1]
+	for i := len(history) - 2; i >= 0; i-- {
+		s := history[i]
+		elapsed := last.Time.Sub(s.Time)
+		if elapsed < window {
+			continue
+		}
+		if s.App.Instances <= 0 || last.App.Instances <= 0 {
+			return 0, false
+		}
+		past := float64(s.App.avg(metric)*s.App.Instances) / float64(last.App.Instances)
+		return (float64(last.App.avg(metric)) - past) / elapsed.Minutes(), true
+	}
+	return 0, false
+}
+
+// trending returns the number of instances required by the trends of the rule
+// whose load is rising fast enough, or 0 if none is.
+func (as *autoscaler) trending(rule Rule, app App, history []sample) int {
+	desired := 0
+	for _, trend := range rule.Trends {
+		r, ok := rate(history, trend.Metric, time.Duration(trend.Window))
+		if !ok || r <= trend.Rate {
+			continue
+		}
+
+		n := trend.Adjustment
+		if n < 1 {
+			n = 1
+		}
+		if app.Instances+n > rule.MaxInstances {
+			n = rule.MaxInstances - app.Instances
+		}
+		as.log.Printf("autoscale app %v: %s rising by %.1f points per minute over %s", app, trend.Metric, r, trend.Window)
+		if n > 0 && app.Instances+n > desired {
+			desired = app.Instances + n
+		}
+	}
+	return desired
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRate(t *testing.T) {
+	now := time.Now()
+	s := func(ago time.Duration, instances, cpu int) sample {
+		return sample{Time: now.Add(-ago), App: App{Instances: instances, CpuAvg: cpu}}
+	}
+
+	tests := []struct {
+		history []sample
+		window  time.Duration
+		rate    float64
+		ok      bool
+	}{
+		{[]sample{s(0, 4, 50)}, time.Minute, 0, false},
+		{[]sample{s(30*time.Second, 4, 20), s(0, 4, 50)}, time.Minute, 0, false},
+		{[]sample{s(time.Minute, 4, 20), s(30*time.Second, 4, 30), s(0, 4, 55)}, time.Minute, 35, true},
+		{[]sample{s(2*time.Minute, 4, 20), s(90*time.Second, 4, 30), s(time.Minute, 4, 40), s(0, 4, 60)}, time.Minute, 20, true},
+		{[]sample{s(2*time.Minute, 4, 20), s(0, 4, 60)}, time.Minute, 20, true},
+		{[]sample{s(time.Minute, 4, 80), s(0, 4, 40)}, time.Minute, -40, true},
+		// scaling in raises the load per instance, but not the demand
+		{[]sample{s(time.Minute, 4, 30), s(0, 3, 40)}, time.Minute, 0, true},
+	}
+
+	for i, test := range tests {
+		r, ok := rate(test.history, MetricCpu, test.window)
+		if ok != test.ok || math.Abs(r-test.rate) > 1e-6 {
+			t.Fatalf("%d: got %f %v, expected %f %v", i, r, ok, test.rate, test.ok)
+		}
+	}
+}
+
+func TestTrends(t *testing.T) {
+	rules := []Rule{
+		Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 10, MinCpu: 10, MaxCpu: 80, Trends: []Trend{{Metric: MetricCpu, Rate: 15, Window: Duration(time.Minute), Adjustment: 2}}},
+	}
+	if err := validateRules(rules); err != nil {
+		t.Fatalf("validateRules: %s", err)
+	}
+
+	tests := []struct {
+		cpu     int
+		desired int
+	}{
+		{20, 0},
+		{25, 0},
+		// +15 points in a minute
+		{35, 0},
+		// +25 points in a minute
+		{50, 6},
+		// the scale-out lowers the load per instance
+		{35, 0},
+		{45, 0},
+		{70, 8},
+		// the trend adds more instances than the threshold
+		{90, 10},
+		{90, 0},
+	}
+
+	now := time.Now()
+	buf := &bytes.Buffer{}
+	as := &autoscaler{rules: rules, log: log.New(buf, "", log.Lshortfile), clock: func() time.Time { return now }}
+	instances := 4
+
+	for i, test := range tests {
+		now = now.Add(Interval)
+		app := App{App: "a", Space: "s", Org: "o", Guid: guid, Instances: instances, InstancesRunning: instances, CpuAvg: test.cpu}
+		mock := &MockClient{Apps: Apps{guid: app}}
+		as.client = mock
+		as.autoscaleApps()
+
+		if test.desired == 0 && mock.ScaleDesired != nil {
+			t.Fatalf("%d: Scale called: %d\n%s", i, *mock.ScaleDesired, buf.String())
+		} else if test.desired != 0 && (mock.ScaleDesired == nil || *mock.ScaleDesired != test.desired) {
+			t.Fatalf("%d: Scale not called with %d\n%s", i, test.desired, buf.String())
+		}
+		if mock.ScaleDesired != nil {
+			instances = *mock.ScaleDesired
+		}
+	}
+}
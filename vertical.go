@@ -0,0 +1,265 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// default time allowed to the instances of a clone to start
+	VerticalScalingTimeout = 5 * time.Minute
+	// after a rollback, the memory of the app is not changed for this long
+	VerticalScalingBackoff = time.Hour
+	// memory sizes are multiples of this many MB
+	MemoryGranularityMB = 64
+	// maximum time allowed to the job copying the bits of an app to its clone
+	JobTimeout = 10 * time.Minute
+	// suffix of the name of the clones
+	CloneSuffix = "_scaled"
+	// environment variable holding, on the clones, the guid of their app
+	CloneMarkerEnv = "SIMPLE_AUTOSCALER_CLONE_OF"
+)
+
+// validateVertical must be called before the disabled thresholds are set to
+// math.MaxInt32.
+func validateVertical(rule Rule) (Rule, error) {
+	if rule.MinMemoryMB == 0 && rule.MaxMemoryMB == 0 {
+		if rule.ScaleUpMem != 0 || rule.ScaleDownMem != 0 || rule.MemoryScalingTimeout != 0 {
+			return rule, errors.New("memory scaling requires min/max memory")
+		}
+		return rule, nil
+	}
+
+	if rule.MemoryScalingTimeout == 0 {
+		rule.MemoryScalingTimeout = Duration(VerticalScalingTimeout)
+	}
+
+	switch {
+	case rule.MinMemoryMB <= 0:
+		return rule, errors.New("min memory should be > 0")
+	case rule.MaxMemoryMB <= rule.MinMemoryMB:
+		return rule, errors.New("max memory should be more than min memory")
+	case rule.ScaleUpMem <= 0 || rule.ScaleUpMem > 100:
+		return rule, errors.New("scale up mem threshold should be in the range 0<t<=100")
+	case rule.ScaleDownMem < 0 || rule.ScaleDownMem >= rule.ScaleUpMem:
+		return rule, errors.New("scale down mem threshold should be in the range 0<=t<scale_up_mem")
+	case rule.MemoryScalingTimeout < 0:
+		return rule, errors.New("memory scaling timeout should be > 0")
+	}
+	return rule, nil
+}
+
+// resize tracks the clone of an app whose memory is being changed, the job
+// copying the bits of the app to the clone until it is finished, and whether
+// the app is being replaced by the clone
+type resize struct {
+	Clone    App
+	Job      string
+	Started  time.Time
+	Failed   time.Time
+	Swapping bool
+}
+
+// memoryFor returns the memory (in MB) that brings the memory usage of the app
+// between the scale up and scale down thresholds of the rule, or the current
+// memory if no change is required.
+func memoryFor(rule Rule, app App) int {
+	mem := app.MemAvg
+	up, down := mem >= rule.ScaleUpMem, rule.ScaleDownMem > 0 && mem <= rule.ScaleDownMem
+	if !up && !down {
+		return app.MemoryMB
+	}
+
+	// aim for the middle of the thresholds
+	target := float64(rule.ScaleUpMem+rule.ScaleDownMem) / 2
+	memory := int(math.Ceil(float64(app.MemoryMB)*float64(mem)/target/MemoryGranularityMB)) * MemoryGranularityMB
+	switch {
+	case memory < rule.MinMemoryMB:
+		memory = rule.MinMemoryMB
+	case memory > rule.MaxMemoryMB:
+		memory = rule.MaxMemoryMB
+	}
+	if up && memory < app.MemoryMB || down && memory > app.MemoryMB {
+		return app.MemoryMB
+	}
+	return memory
+}
+
+// cloneOf returns the name of the app of which the app is a clone. Clones are
+// named after their app and carry its guid in CloneMarkerEnv: apps only named
+// like clones, or whose marker is not the guid of the app they are named
+// after, are not clones.
+func cloneOf(app App, apps Apps) (string, bool) {
+	name := strings.TrimSuffix(app.App, CloneSuffix)
+	if name == app.App || app.CloneOf == "" {
+		return "", false
+	}
+	if original, found := appFor(apps, Rule{App: name, Space: app.Space, Org: app.Org}); found && original.Guid != app.CloneOf {
+		return "", false
+	}
+	return name, true
+}
+
+// resizeOf returns the guid and the resize of the app of which the app is a
+// clone, if it is being tracked.
+func (as *autoscaler) resizeOf(clone App) (string, *resize) {
+	for guid, r := range as.resizes {
+		if r.Clone.Guid == clone.Guid {
+			return guid, r
+		}
+	}
+	return "", nil
+}
+
+// reconcileClones handles the clones whose app does not exist anymore (e.g.
+// because the swap failed after deleting the app) and the clones that are not
+// tracked (e.g. left over by a restart of simple-autoscaler in the middle of
+// a resize): if the app of the clone exists the clone is deleted, if the app
+// was deleted while swapping it with the clone the clone is renamed to the
+// name of the app, otherwise the clone is deleted.
+func (as *autoscaler) reconcileClones(apps Apps) {
+	if as.resizes == nil {
+		as.resizes = make(map[string]*resize)
+	}
+	for _, clone := range apps {
+		name, ok := cloneOf(clone, apps)
+		if !ok {
+			continue
+		}
+		guid, r := as.resizeOf(clone)
+		if _, found := apps[guid]; r != nil && found {
+			// handled together with the app
+			continue
+		}
+
+		var err error
+		app, found := appFor(apps, Rule{App: name, Space: clone.Space, Org: clone.Org})
+		switch {
+		case found:
+			as.log.Printf("autoscale app %v: deleting leftover clone %v", app, clone)
+			if err = as.client.DeleteApp(clone); err == nil {
+				as.resizes[app.Guid] = &resize{Failed: as.now()}
+			}
+		case r == nil || r.Swapping:
+			as.log.Printf("autoscale app %v: app was replaced by the clone, renaming clone to %s", clone, name)
+			err = as.client.RenameApp(clone, name)
+		default:
+			as.log.Printf("autoscale app %v: app was deleted, deleting clone", clone)
+			err = as.client.DeleteApp(clone)
+		}
+		if err != nil {
+			as.log.Print(errors.Wrapf(err, "autoscale app %v: reconcile clone", clone))
+		} else if r != nil {
+			delete(as.resizes, guid)
+		}
+	}
+}
+
+// resizeApp changes the memory of the app by cloning it with the new memory
+// size, and replacing the app with the clone once all the instances of the
+// clone are running. If the instances do not start in time, the clone is
+// deleted. If handled is true the app must not be scaled in this iteration.
+func (as *autoscaler) resizeApp(rule Rule, app App, apps Apps) (handled bool, err error) {
+	if as.resizes == nil {
+		as.resizes = make(map[string]*resize)
+	}
+	now := as.now()
+	r := as.resizes[app.Guid]
+
+	if r != nil && r.Clone.Guid != "" {
+		clone, found := apps[r.Clone.Guid]
+		switch {
+		case !found:
+			as.log.Printf("autoscale app %v: clone %s disappeared", app, r.Clone.Guid)
+			delete(as.resizes, app.Guid)
+		case r.Swapping:
+			as.log.Printf("autoscale app %v: replacing app with clone %v failed, deleting clone", app, clone)
+			return true, as.rollBack(r, clone)
+		case r.Job != "":
+			done, err := as.client.JobDone(r.Job)
+			switch {
+			case done && err == nil:
+				as.log.Printf("autoscale app %v: bits copied to clone %v", app, clone)
+				return true, as.startClone(app, r)
+			case done:
+				as.log.Printf("autoscale app %v: copying bits to clone %v failed: %s, deleting clone", app, clone, err)
+				return true, as.rollBack(r, clone)
+			case now.Sub(r.Started) > JobTimeout:
+				as.log.Printf("autoscale app %v: bits not copied to clone %v within %s, deleting clone", app, clone, JobTimeout)
+				return true, as.rollBack(r, clone)
+			case err != nil:
+				return true, errors.Wrap(err, "check copy bits job")
+			}
+			as.log.Printf("autoscale app %v: waiting for the bits to be copied to clone %v", app, clone)
+		case !clone.Stopped && clone.Instances > 0 && clone.InstancesRunning == clone.Instances:
+			as.log.Printf("autoscale app %v: replacing app with clone %v", app, clone)
+			// if the swap fails the clone is deleted, or renamed if the app
+			// was deleted already
+			r.Swapping = true
+			if err := as.client.SwapApp(app, clone); err != nil {
+				return true, errors.Wrap(err, "swap app with clone")
+			}
+			delete(as.resizes, app.Guid)
+		case now.Sub(r.Started) > time.Duration(rule.MemoryScalingTimeout):
+			as.log.Printf("autoscale app %v: instances of clone %v did not start within %s, deleting clone", app, clone, rule.MemoryScalingTimeout)
+			return true, as.rollBack(r, clone)
+		default:
+			as.log.Printf("autoscale app %v: waiting for clone %v to start: %d/%d instances running", app, clone, clone.InstancesRunning, clone.Instances)
+		}
+		return true, nil
+	}
+
+	if r != nil && now.Sub(r.Failed) < VerticalScalingBackoff {
+		return false, nil
+	}
+	if app.Stopped || app.MemoryMB <= 0 || app.Instances != app.InstancesRunning || app.Warming > 0 {
+		return false, nil
+	}
+	memory := memoryFor(rule, aggregate(rule, app))
+	if memory == app.MemoryMB {
+		return false, nil
+	}
+
+	as.log.Printf("autoscale app %v: changing memory from %d MB to %d MB", app, app.MemoryMB, memory)
+	clone, job, err := as.client.CloneApp(app, app.App+CloneSuffix, memory)
+	if err != nil {
+		if clone.Guid != "" {
+			if err := as.client.DeleteApp(clone); err != nil {
+				as.log.Print(errors.Wrapf(err, "autoscale app %v: delete clone", app))
+			}
+		}
+		as.resizes[app.Guid] = &resize{Failed: now}
+		return true, errors.Wrap(err, "clone app")
+	}
+	r = &resize{Clone: clone, Job: job, Started: now}
+	as.resizes[app.Guid] = r
+	if job != "" {
+		as.log.Printf("autoscale app %v: copying bits to clone %v", app, clone)
+		return true, nil
+	}
+	return true, as.startClone(app, r)
+}
+
+// startClone starts the clone once its bits are ready.
+func (as *autoscaler) startClone(app App, r *resize) error {
+	as.log.Printf("autoscale app %v: starting clone %v", app, r.Clone)
+	r.Job, r.Started = "", as.now()
+	if err := as.client.Start(r.Clone); err != nil {
+		// the clone will be deleted after the timeout
+		return errors.Wrap(err, "start clone")
+	}
+	return nil
+}
+
+// rollBack deletes the clone; the memory of the app is not changed again for
+// VerticalScalingBackoff.
+func (as *autoscaler) rollBack(r *resize, clone App) error {
+	r.Clone, r.Job, r.Failed, r.Swapping = App{}, "", as.now(), false
+	if err := as.client.DeleteApp(clone); err != nil {
+		return errors.Wrap(err, "delete clone")
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestMemoryFor(t *testing.T) {
+	rule := Rule{MinMemoryMB: 256, MaxMemoryMB: 2048, ScaleDownMem: 40, ScaleUpMem: 80}
+
+	tests := []struct {
+		memory int
+		mem    int
+		exp    int
+	}{
+		{1024, 60, 1024},
+		{1024, 79, 1024},
+		{1024, 41, 1024},
+		// 1024*90/60=1536
+		{1024, 90, 1536},
+		// 1024*80/60=1365.3, rounded up to 1408
+		{1024, 80, 1408},
+		{1024, 100, 1728},
+		{1536, 100, 2048},
+		{2048, 100, 2048},
+		// 1024*30/60=512
+		{1024, 30, 512},
+		{1024, 0, 256},
+		{256, 0, 256},
+	}
+
+	for i, test := range tests {
+		if r := memoryFor(rule, App{MemoryMB: test.memory, MemAvg: test.mem}); r != test.exp {
+			t.Fatalf("%d: got %d, expected %d", i, r, test.exp)
+		}
+	}
+
+	// without scale down threshold the memory is never decreased
+	rule.ScaleDownMem = 0
+	if r := memoryFor(rule, App{MemoryMB: 1024, MemAvg: 0}); r != 1024 {
+		t.Fatalf("scaled down to %d", r)
+	}
+}
+
+func TestVerticalScaling(t *testing.T) {
+	rules := []Rule{
+		Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 10, MinCpu: 20, MaxCpu: 80, MinMemoryMB: 512, MaxMemoryMB: 2048, ScaleDownMem: 40, ScaleUpMem: 80, MemoryScalingTimeout: Duration(2 * time.Minute)},
+	}
+	if err := validateRules(rules); err != nil {
+		t.Fatalf("validateRules: %s", err)
+	}
+
+	clone := "clone-" + guid
+	tests := []struct {
+		mem          int
+		cloneRunning int // -1 if the clone does not exist
+		memory       int
+		swap         bool
+		delete       bool
+	}{
+		{60, -1, 0, false, false},
+		{90, -1, 1536, false, false},
+		{90, 0, 0, false, false},
+		{90, 1, 0, false, false},
+		{90, 3, 0, true, false},
+		// a new app with the original memory
+		{60, -1, 0, false, false},
+		{30, -1, 512, false, false},
+		{30, 0, 0, false, false},
+		{30, 0, 0, false, false},
+		{30, 0, 0, false, false},
+		{30, 0, 0, false, false},
+		{30, 0, 0, false, true},
+		// no new attempts after a rollback
+		{30, -1, 0, false, false},
+		{90, -1, 0, false, false},
+	}
+
+	now := time.Now()
+	buf := &bytes.Buffer{}
+	as := &autoscaler{rules: rules, log: log.New(buf, "", log.Lshortfile), clock: func() time.Time { return now }}
+
+	for i, test := range tests {
+		now = now.Add(Interval)
+		apps := Apps{guid: App{App: "a", Space: "s", Org: "o", Guid: guid, Instances: 3, InstancesRunning: 3, CpuAvg: 50, MemAvg: test.mem, MemoryMB: 1024}}
+		if test.cloneRunning >= 0 {
+			apps[clone] = App{App: "a" + CloneSuffix, Space: "s", Org: "o", Guid: clone, CloneOf: guid, Instances: 3, InstancesRunning: test.cloneRunning}
+		}
+		mock := &MockClient{Apps: apps}
+		as.client = mock
+		as.autoscaleApps()
+
+		switch {
+		case mock.ScaleDesired != nil:
+			t.Fatalf("%d: Scale called\n%s", i, buf.String())
+		case test.memory == 0 && mock.ClonedApp != nil:
+			t.Fatalf("%d: CloneApp called\n%s", i, buf.String())
+		case test.memory != 0 && (mock.ClonedApp == nil || mock.CloneMemory != test.memory || mock.CloneName != "a_scaled" || mock.StartApp == nil || mock.StartApp.Guid != clone):
+			t.Fatalf("%d: clone not created and started with %d MB\n%s", i, test.memory, buf.String())
+		case test.swap != (mock.SwappedApp != nil) || test.swap && (mock.SwappedApp.Guid != guid || mock.SwappedClone.Guid != clone):
+			t.Fatalf("%d: wrong swap: %v\n%s", i, mock.SwappedApp, buf.String())
+		case test.delete != (mock.DeletedApp != nil) || test.delete && mock.DeletedApp.Guid != clone:
+			t.Fatalf("%d: wrong delete: %v\n%s", i, mock.DeletedApp, buf.String())
+		}
+	}
+}
+
+func TestVerticalScalingCopyBits(t *testing.T) {
+	rules := []Rule{
+		Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 10, MinCpu: 20, MaxCpu: 80, MinMemoryMB: 512, MaxMemoryMB: 2048, ScaleDownMem: 40, ScaleUpMem: 80},
+	}
+	if err := validateRules(rules); err != nil {
+		t.Fatalf("validateRules: %s", err)
+	}
+
+	type step struct {
+		done   bool
+		err    error
+		clone  bool
+		start  bool
+		delete bool
+	}
+	clone := "clone-" + guid
+	tests := [][]step{
+		{
+			{false, nil, true, false, false},
+			{false, nil, false, false, false},
+			// errors reading the job are retried
+			{false, errors.New("api down"), false, false, false},
+			{true, nil, false, true, false},
+		},
+		{
+			{false, nil, true, false, false},
+			{true, errors.New("job failed"), false, false, true},
+		},
+	}
+
+	for i, steps := range tests {
+		now := time.Now()
+		buf := &bytes.Buffer{}
+		as := &autoscaler{rules: rules, log: log.New(buf, "", log.Lshortfile), clock: func() time.Time { return now }}
+
+		for j, test := range steps {
+			now = now.Add(Interval)
+			apps := Apps{guid: App{App: "a", Space: "s", Org: "o", Guid: guid, Instances: 3, InstancesRunning: 3, CpuAvg: 50, MemAvg: 90, MemoryMB: 1024}}
+			if j > 0 {
+				apps[clone] = App{App: "a" + CloneSuffix, Space: "s", Org: "o", Guid: clone, CloneOf: guid, Instances: 3, Stopped: true}
+			}
+			mock := &MockClient{Apps: apps, CloneJob: "job", JobsDone: map[string]bool{"job": test.done}, JobError: test.err}
+			as.client = mock
+			as.autoscaleApps()
+
+			switch {
+			case test.clone != (mock.ClonedApp != nil):
+				t.Fatalf("%d/%d: wrong clone: %v\n%s", i, j, mock.ClonedApp, buf.String())
+			case test.start != (mock.StartApp != nil) || test.start && mock.StartApp.Guid != clone:
+				t.Fatalf("%d/%d: wrong start: %v\n%s", i, j, mock.StartApp, buf.String())
+			case test.delete != (mock.DeletedApp != nil) || test.delete && mock.DeletedApp.Guid != clone:
+				t.Fatalf("%d/%d: wrong delete: %v\n%s", i, j, mock.DeletedApp, buf.String())
+			case mock.ScaleDesired != nil:
+				t.Fatalf("%d/%d: Scale called\n%s", i, j, buf.String())
+			}
+		}
+	}
+}
+
+func TestVerticalScalingSwapFailures(t *testing.T) {
+	rules := []Rule{
+		Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 10, MinCpu: 20, MaxCpu: 80, MinMemoryMB: 512, MaxMemoryMB: 2048, ScaleDownMem: 40, ScaleUpMem: 80},
+	}
+	if err := validateRules(rules); err != nil {
+		t.Fatalf("validateRules: %s", err)
+	}
+
+	type step struct {
+		app          bool // false if the app does not exist
+		cloneRunning int  // -1 if the clone does not exist
+		swapError    bool
+		clone        bool
+		swap         bool
+		delete       bool
+		rename       bool
+	}
+	clone := "clone-" + guid
+	tests := [][]step{
+		// the swap fails before deleting the app: the clone is deleted
+		{
+			{true, -1, false, true, false, false, false},
+			{true, 3, true, false, true, false, false},
+			{true, 3, false, false, false, true, false},
+			{true, -1, false, false, false, false, false},
+		},
+		// the swap fails after deleting the app: the clone is renamed
+		{
+			{true, -1, false, true, false, false, false},
+			{true, 3, true, false, true, false, false},
+			{false, 3, false, false, false, false, true},
+		},
+		// the app was deleted while the clone was starting
+		{
+			{true, -1, false, true, false, false, false},
+			{false, 1, false, false, false, true, false},
+		},
+		// clones left over by a restart
+		{
+			{true, 3, false, false, false, true, false},
+			{true, -1, false, false, false, false, false},
+		},
+		{
+			{false, 3, false, false, false, false, true},
+		},
+	}
+
+	for i, steps := range tests {
+		now := time.Now()
+		buf := &bytes.Buffer{}
+		as := &autoscaler{rules: rules, log: log.New(buf, "", log.Lshortfile), clock: func() time.Time { return now }}
+
+		for j, test := range steps {
+			now = now.Add(Interval)
+			apps := Apps{}
+			if test.app {
+				apps[guid] = App{App: "a", Space: "s", Org: "o", Guid: guid, Instances: 3, InstancesRunning: 3, CpuAvg: 50, MemAvg: 90, MemoryMB: 1024}
+			}
+			if test.cloneRunning >= 0 {
+				apps[clone] = App{App: "a" + CloneSuffix, Space: "s", Org: "o", Guid: clone, CloneOf: guid, Instances: 3, InstancesRunning: test.cloneRunning}
+			}
+			// apps named like clones of apps without memory scaling are left alone
+			apps["other"] = App{App: "b" + CloneSuffix, Space: "s", Org: "o", Guid: "other", Instances: 1, InstancesRunning: 1}
+			mock := &MockClient{Apps: apps}
+			if test.swapError {
+				mock.SwapError = errors.New("rename failed")
+			}
+			as.client = mock
+			as.autoscaleApps()
+
+			switch {
+			case test.clone != (mock.ClonedApp != nil):
+				t.Fatalf("%d/%d: wrong clone: %v\n%s", i, j, mock.ClonedApp, buf.String())
+			case test.swap != (mock.SwappedApp != nil):
+				t.Fatalf("%d/%d: wrong swap: %v\n%s", i, j, mock.SwappedApp, buf.String())
+			case test.delete != (mock.DeletedApp != nil) || test.delete && mock.DeletedApp.Guid != clone:
+				t.Fatalf("%d/%d: wrong delete: %v\n%s", i, j, mock.DeletedApp, buf.String())
+			case test.rename != (mock.RenamedApp != nil) || test.rename && (mock.RenamedApp.Guid != clone || mock.RenameName != "a"):
+				t.Fatalf("%d/%d: wrong rename: %v %s\n%s", i, j, mock.RenamedApp, mock.RenameName, buf.String())
+			}
+		}
+	}
+}
+
+func TestVerticalScalingUnmarkedClones(t *testing.T) {
+	rules := []Rule{
+		Rule{App: "a", Space: "s", Org: "o", MinInstances: 3, MaxInstances: 10, MinCpu: 20, MaxCpu: 80, MinMemoryMB: 512, MaxMemoryMB: 2048, ScaleDownMem: 40, ScaleUpMem: 80},
+		Rule{App: "a" + CloneSuffix, Space: "s", Org: "o", MinInstances: 4, MaxInstances: 10, MinCpu: 20, MaxCpu: 80},
+	}
+	if err := validateRules(rules); err != nil {
+		t.Fatalf("validateRules: %s", err)
+	}
+
+	tests := []struct {
+		app     bool   // false if the app does not exist
+		cloneOf string // marker of the app named like a clone
+	}{
+		{true, ""},
+		{false, ""},
+		{true, "other-guid"},
+	}
+
+	for i, test := range tests {
+		buf := &bytes.Buffer{}
+		as := &autoscaler{rules: rules, log: log.New(buf, "", log.Lshortfile), clock: time.Now}
+		apps := Apps{}
+		if test.app {
+			apps[guid] = App{App: "a", Space: "s", Org: "o", Guid: guid, Instances: 3, InstancesRunning: 3, CpuAvg: 50, MemAvg: 60, MemoryMB: 1024}
+		}
+		apps["mine"] = App{App: "a" + CloneSuffix, Space: "s", Org: "o", Guid: "mine", CloneOf: test.cloneOf, Instances: 4, InstancesRunning: 4, CpuAvg: 90}
+		mock := &MockClient{Apps: apps}
+		as.client = mock
+		as.autoscaleApps()
+
+		switch {
+		case mock.DeletedApp != nil:
+			t.Fatalf("%d: unexpected delete: %v\n%s", i, mock.DeletedApp, buf.String())
+		case mock.RenamedApp != nil:
+			t.Fatalf("%d: unexpected rename: %v\n%s", i, mock.RenamedApp, buf.String())
+		case mock.ClonedApp != nil:
+			t.Fatalf("%d: unexpected clone: %v\n%s", i, mock.ClonedApp, buf.String())
+		case mock.ScaleApp == nil || mock.ScaleApp.Guid != "mine" || *mock.ScaleDesired <= 4:
+			// the app named like a clone is autoscaled by its own rule
+			t.Fatalf("%d: wrong scale: %v\n%s", i, mock.ScaleCalls, buf.String())
+		}
+	}
+}